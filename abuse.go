@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// abuseTracker counts each client's 4xx answers on /api/ routes (bad
+// parameters, rejected keys, 429s) in fixed windows of ABUSE_WINDOW, and
+// bans a client for ABUSE_BAN_DURATION once it reaches ABUSE_MAX_ERRORS in
+// one window. Counts and bans are per process, like the rate limit.
+type abuseTracker struct {
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	bans      map[string]*ClientBan
+	lastSweep time.Time
+}
+
+// ClientBan is one row of GET /admin/bans.
+type ClientBan struct {
+	Client   string `json:"client"`
+	KeyName  string `json:"keyName,omitempty"`
+	Errors   int    `json:"errors"`
+	BannedAt string `json:"bannedAt"`
+	Until    string `json:"until"`
+	until    time.Time
+}
+
+var abuse = &abuseTracker{windows: map[string]*rateWindow{}, bans: map[string]*ClientBan{}}
+
+// banned returns the client's active ban, or nil.
+func (a *abuseTracker) banned(client string, now time.Time) *ClientBan {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := a.bans[client]
+	if b != nil && !now.Before(b.until) {
+		delete(a.bans, client)
+		return nil
+	}
+	return b
+}
+
+// record counts a 4xx answer to client and reports whether it started a
+// ban.
+func (a *abuseTracker) record(client, keyName string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) >= cfg.AbuseWindow {
+		for k, w := range a.windows {
+			if now.Sub(w.start) >= cfg.AbuseWindow {
+				delete(a.windows, k)
+			}
+		}
+		a.lastSweep = now
+	}
+	w := a.windows[client]
+	if w == nil || now.Sub(w.start) >= cfg.AbuseWindow {
+		w = &rateWindow{start: now}
+		a.windows[client] = w
+	}
+	w.count++
+	if w.count < cfg.AbuseMaxErrors {
+		return false
+	}
+	until := now.Add(cfg.AbuseBanDuration)
+	a.bans[client] = &ClientBan{
+		Client:   client,
+		KeyName:  keyName,
+		Errors:   w.count,
+		BannedAt: now.UTC().Format(time.RFC3339),
+		Until:    until.UTC().Format(time.RFC3339),
+		until:    until,
+	}
+	delete(a.windows, client)
+	return true
+}
+
+// withAbuseBans turns away banned clients on /api/ routes with 403 and
+// Retry-After, and counts everyone else's 4xx answers towards a ban. It
+// runs outside withAccess so rejected API keys count too.
+func withAbuseBans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AbuseMaxErrors == 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := rateClient(r)
+		now := time.Now()
+		if b := abuse.banned(client, now); b != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(b.until.Sub(now).Seconds())+1))
+			writeError(w, http.StatusForbidden, "temporarily banned for repeated errors until "+b.Until)
+			return
+		}
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status < 400 || sw.status >= 500 {
+			return
+		}
+		var keyName string
+		if k := requestAPIKey(r); k != nil {
+			keyName = k.Name
+		}
+		if abuse.record(client, keyName, now) {
+			metrics.Count("abuse.bans", 1, nil)
+			log.Printf("[abuse] Banned %s for %v after %d errors within %v", client, cfg.AbuseBanDuration, cfg.AbuseMaxErrors, cfg.AbuseWindow)
+		}
+	})
+}
+
+// handleListBans serves GET /admin/bans: this process's active bans,
+// soonest to expire first.
+func handleListBans(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	abuse.mu.Lock()
+	bans := []ClientBan{}
+	for client, b := range abuse.bans {
+		if !now.Before(b.until) {
+			delete(abuse.bans, client)
+			continue
+		}
+		bans = append(bans, *b)
+	}
+	abuse.mu.Unlock()
+	slices.SortFunc(bans, func(a, b ClientBan) int { return a.until.Compare(b.until) })
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// handleLiftBan serves DELETE /admin/bans/{client}, where client is as
+// listed, e.g. ip:203.0.113.7 or key:12.
+func handleLiftBan(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	abuse.mu.Lock()
+	b, ok := abuse.bans[client]
+	delete(abuse.bans, client)
+	delete(abuse.windows, client)
+	abuse.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no ban for "+client)
+		return
+	}
+	auditChange(r, b, nil)
+	logf(r.Context(), "[abuse] Ban on %s lifted", client)
+	w.WriteHeader(http.StatusNoContent)
+}
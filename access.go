@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// APIKey is a consumer key from api_keys. The key itself is shown once,
+// when it is created; only its SHA-256 is stored. A key with an AdminRole
+// also opens the admin routes that role allows (see requireRole).
+type APIKey struct {
+	ID                     int64  `json:"id"`
+	Name                   string `json:"name"`
+	Prefix                 string `json:"prefix"`
+	RefreshIntervalSeconds *int   `json:"refreshIntervalSeconds"`
+	RateLimitRequests      *int   `json:"rateLimitRequests"`
+	AdminRole              string `json:"adminRole,omitempty"`
+	CreatedAt              string `json:"createdAt"`
+	RevokedAt              string `json:"revokedAt,omitempty"`
+}
+
+// IPRules are the client address lists. An address in deny is always
+// rejected; with allow non-empty, only addresses in it are let through.
+type IPRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// accessRules is the in-memory copy of api_keys and ip_rules that every
+// request is checked against. It is swapped whole on reload.
+type accessRules struct {
+	keys        map[string]*APIKey // active keys by hash
+	allow, deny []*net.IPNet
+}
+
+// access is set by loadAccess before the server starts.
+var access atomic.Pointer[accessRules]
+
+// hashAPIKey is how keys are stored and looked up.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAccess replaces the in-memory rules with the database's.
+func loadAccess(ctx context.Context) error {
+	rules := &accessRules{keys: map[string]*APIKey{}}
+	rows, err := database.QueryContext(ctx, `
+		SELECT id, key_hash, name, prefix, refresh_interval_seconds, rate_limit_requests, admin_role, created_at
+		FROM api_keys WHERE revoked_at = ''
+	`)
+	if err != nil {
+		return fmt.Errorf("loading API keys: %w", err)
+	}
+	for rows.Next() {
+		var k APIKey
+		var hash string
+		if err := rows.Scan(&k.ID, &hash, &k.Name, &k.Prefix, &k.RefreshIntervalSeconds, &k.RateLimitRequests, &k.AdminRole, &k.CreatedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("loading API keys: %w", err)
+		}
+		rules.keys[hash] = &k
+	}
+	rows.Close()
+
+	rows, err = database.QueryContext(ctx, "SELECT cidr, action FROM ip_rules")
+	if err != nil {
+		return fmt.Errorf("loading IP rules: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cidr, action string
+		if err := rows.Scan(&cidr, &action); err != nil {
+			return fmt.Errorf("loading IP rules: %w", err)
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("[access] Ignoring invalid IP rule %q: %v", cidr, err)
+			continue
+		}
+		if action == "allow" {
+			rules.allow = append(rules.allow, n)
+		} else {
+			rules.deny = append(rules.deny, n)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("loading IP rules: %w", err)
+	}
+	access.Store(rules)
+	return nil
+}
+
+// runAccessReloader reloads the access rules and feature flags every
+// interval, picking up changes made by another process: the primary's
+// admin API, seen by a replica, or direct edits to the database. Changes
+// made through this process's admin API apply immediately.
+func runAccessReloader(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := loadAccess(ctx); err != nil {
+				log.Printf("[access] Reload failed, keeping previous rules: %v", err)
+			}
+			if err := loadFlags(ctx); err != nil {
+				log.Printf("[flags] Reload failed, keeping previous flags: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// requestAPIKey returns the active key the request presented, or nil.
+func requestAPIKey(r *http.Request) *APIKey {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil
+	}
+	return access.Load().keys[hashAPIKey(key)]
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAccess enforces the IP lists on every route but /health, so
+// orchestrator probes keep working, and API_KEY_MODE on /api/ routes.
+func withAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rules := access.Load()
+		if len(rules.allow) > 0 || len(rules.deny) > 0 {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || inNets(ip, rules.deny) || (len(rules.allow) > 0 && !inNets(ip, rules.allow)) {
+				writeError(w, http.StatusForbidden, "client address not allowed")
+				return
+			}
+		}
+		if cfg.APIKeyMode != "off" && strings.HasPrefix(r.URL.Path, "/api/") {
+			key := r.Header.Get("X-API-Key")
+			switch {
+			case key == "" && cfg.APIKeyMode == "required":
+				writeError(w, http.StatusUnauthorized, "missing X-API-Key")
+				return
+			case key != "" && rules.keys[hashAPIKey(key)] == nil:
+				writeError(w, http.StatusUnauthorized, "invalid or revoked X-API-Key")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reloadAfterWrite applies an admin change to this process's rules at
+// once.
+func reloadAfterWrite(r *http.Request) {
+	if err := loadAccess(r.Context()); err != nil {
+		logf(r.Context(), "[access] Reload after change failed: %v", err)
+	}
+}
+
+// handleListAPIKeys serves GET /admin/api-keys: every key, revoked ones
+// included, without the secrets.
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, name, prefix, refresh_interval_seconds, rate_limit_requests, admin_role, created_at, revoked_at
+		FROM api_keys ORDER BY id
+	`)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.RefreshIntervalSeconds, &k.RateLimitRequests, &k.AdminRole, &k.CreatedAt, &k.RevokedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		keys = append(keys, k)
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// handleCreateAPIKey serves POST /admin/api-keys with a body of
+// {"name": "dashboard", "refreshIntervalSeconds": 10}, plus
+// "rateLimitRequests" for its own quota and "adminRole" for a key that may
+// call the admin API. The response is the only time
+// the key is shown.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "API keys are read-only on a replica; change them on the primary")
+		return
+	}
+	var req struct {
+		Name                   string `json:"name"`
+		RefreshIntervalSeconds *int   `json:"refreshIntervalSeconds"`
+		RateLimitRequests      *int   `json:"rateLimitRequests"`
+		AdminRole              string `json:"adminRole"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"name\": \"dashboard\", \"refreshIntervalSeconds\": 10}")
+		return
+	}
+	if msg := checkKeyLimits(req.RateLimitRequests, req.RefreshIntervalSeconds); msg != "" {
+		writeError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if req.AdminRole != "" && !slices.Contains(adminRoles, req.AdminRole) {
+		writeError(w, http.StatusBadRequest, "adminRole must be one of "+strings.Join(adminRoles, ", "))
+		return
+	}
+	var b [24]byte
+	rand.Read(b[:])
+	secret := "gs_" + hex.EncodeToString(b[:])
+	k := APIKey{
+		Name:                   req.Name,
+		Prefix:                 secret[:11],
+		RefreshIntervalSeconds: req.RefreshIntervalSeconds,
+		RateLimitRequests:      req.RateLimitRequests,
+		AdminRole:              req.AdminRole,
+		CreatedAt:              time.Now().UTC().Format(time.RFC3339),
+	}
+	res, err := database.ExecContext(r.Context(), `
+		INSERT INTO api_keys (key_hash, name, prefix, refresh_interval_seconds, rate_limit_requests, admin_role, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, hashAPIKey(secret), k.Name, k.Prefix, k.RefreshIntervalSeconds, k.RateLimitRequests, k.AdminRole, k.CreatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	k.ID, _ = res.LastInsertId()
+	reloadAfterWrite(r)
+	auditChange(r, nil, k)
+	logf(r.Context(), "[admin] API key %d (%s) created", k.ID, k.Name)
+	writeJSON(w, http.StatusCreated, struct {
+		APIKey
+		Key string `json:"key"`
+	}{k, secret})
+}
+
+// handleRevokeAPIKey serves DELETE /admin/api-keys/{id}. Revoked keys stay
+// listed; requests using them are rejected from the next reload on, which
+// on this process is immediate.
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "API keys are read-only on a replica; change them on the primary")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "id must be an integer")
+		return
+	}
+	k, err := readAPIKey(r, id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no API key "+r.PathValue("id"))
+		return
+	}
+	before := k
+	if k.RevokedAt == "" {
+		k.RevokedAt = time.Now().UTC().Format(time.RFC3339)
+		if _, err := database.ExecContext(r.Context(), "UPDATE api_keys SET revoked_at = ? WHERE id = ?", k.RevokedAt, id); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		reloadAfterWrite(r)
+		logf(r.Context(), "[admin] API key %d (%s) revoked", k.ID, k.Name)
+	}
+	auditChange(r, before, k)
+	writeJSON(w, http.StatusOK, k)
+}
+
+// readAPIKey returns one key, revoked or not.
+func readAPIKey(r *http.Request, id int64) (APIKey, error) {
+	var k APIKey
+	err := database.QueryRowContext(r.Context(), `
+		SELECT id, name, prefix, refresh_interval_seconds, rate_limit_requests, admin_role, created_at, revoked_at
+		FROM api_keys WHERE id = ?
+	`, id).Scan(&k.ID, &k.Name, &k.Prefix, &k.RefreshIntervalSeconds, &k.RateLimitRequests, &k.AdminRole, &k.CreatedAt, &k.RevokedAt)
+	return k, err
+}
+
+// readIPRules returns the stored lists as written.
+func readIPRules(ctx context.Context) (IPRules, error) {
+	rules := IPRules{Allow: []string{}, Deny: []string{}}
+	rows, err := database.QueryContext(ctx, "SELECT cidr, action FROM ip_rules ORDER BY action, cidr")
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cidr, action string
+		if err := rows.Scan(&cidr, &action); err != nil {
+			return rules, err
+		}
+		if action == "allow" {
+			rules.Allow = append(rules.Allow, cidr)
+		} else {
+			rules.Deny = append(rules.Deny, cidr)
+		}
+	}
+	return rules, rows.Err()
+}
+
+// handleGetIPRules serves GET /admin/ip-rules.
+func handleGetIPRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := readIPRules(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// normalizeCIDR accepts a CIDR or a bare address (a /32 or /128).
+func normalizeCIDR(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an IP address or CIDR", s)
+	}
+	return n.String(), nil
+}
+
+// handlePutIPRules serves PUT /admin/ip-rules with a body of
+// {"allow": ["10.0.0.0/8"], "deny": ["203.0.113.7"]}, replacing both
+// lists. An allowlist applies to the admin API too, so include the
+// operators' addresses.
+func handlePutIPRules(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "IP rules are read-only on a replica; change them on the primary")
+		return
+	}
+	var req IPRules
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"allow\": [\"10.0.0.0/8\"], \"deny\": []}")
+		return
+	}
+	after := IPRules{Allow: []string{}, Deny: []string{}}
+	for _, list := range []struct {
+		in  []string
+		out *[]string
+	}{{req.Allow, &after.Allow}, {req.Deny, &after.Deny}} {
+		for _, s := range list.in {
+			cidr, err := normalizeCIDR(strings.TrimSpace(s))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			*list.out = append(*list.out, cidr)
+		}
+	}
+	before, err := readIPRules(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tx, err := database.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM ip_rules"); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for action, cidrs := range map[string][]string{"allow": after.Allow, "deny": after.Deny} {
+		for _, cidr := range cidrs {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO ip_rules (cidr, action) VALUES (?, ?)", cidr, action); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	reloadAfterWrite(r)
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] IP rules replaced: %d allow, %d deny", len(after.Allow), len(after.Deny))
+	writeJSON(w, http.StatusOK, after)
+}
+
+// handleReloadAccess serves POST /admin/access/reload, for applying direct
+// database edits (or, on a replica, the primary's changes) to the access
+// rules and feature flags without waiting for the periodic reload.
+func handleReloadAccess(w http.ResponseWriter, r *http.Request) {
+	if err := loadAccess(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := loadFlags(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rules := access.Load()
+	writeJSON(w, http.StatusOK, map[string]int{
+		"activeKeys": len(rules.keys),
+		"allow":      len(rules.allow),
+		"deny":       len(rules.deny),
+		"flags":      len(*flags.Load()),
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Admin roles, from least to most privileged. Each includes the ones
+// before it: viewers read, operators also run jobs and checks, admins
+// also change keys, access rules, prices, symbols, flags and config.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var adminRoles = []string{roleViewer, roleOperator, roleAdmin}
+
+// adminCallerKey carries who passed requireRole, for the audit log.
+type adminCallerKey struct{}
+
+// requireAdmin guards a route that needs the admin role.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleAdmin, next)
+}
+
+// requireRole guards operator endpoints. ADMIN_TOKEN has every role; an
+// API key created with an adminRole has that one, sent as the same bearer
+// token. With no ADMIN_TOKEN configured the admin API is disabled
+// entirely. Authenticated calls are recorded in audit_log, and writes
+// honor Idempotency-Key.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := cfg.AdminToken
+		if token == "" {
+			writeError(w, http.StatusForbidden, "admin API disabled (ADMIN_TOKEN not set)")
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		caller := ""
+		if ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			caller = "admin"
+		} else if k := access.Load().keys[hashAPIKey(got)]; ok && k != nil && k.AdminRole != "" {
+			if slices.Index(adminRoles, k.AdminRole) < slices.Index(adminRoles, role) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("API key %s has role %s; this route needs %s", k.Prefix, k.AdminRole, role))
+				return
+			}
+			caller = fmt.Sprintf("key:%d %s", k.ID, k.Name)
+		}
+		if caller == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), adminCallerKey{}, caller)
+		audited(idempotent(next))(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// SymbolAlias maps a legacy identifier, such as TGJU's geram18, to a
+// symbol so /api/gold/{alias} serves it without client changes.
+type SymbolAlias struct {
+	Alias     string `json:"alias"`
+	Symbol    string `json:"symbol"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// handleGoldAlias serves GET /api/gold/{alias}: the aliased symbol's
+// cached price, exactly as /api/gold/18k serves gold_18k.
+func handleGoldAlias(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	var symbol string
+	err := database.QueryRowContext(r.Context(), "SELECT symbol FROM symbol_aliases WHERE alias = ?", alias).Scan(&symbol)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "unknown symbol alias "+alias)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	serveGoldPrice(w, r, symbol)
+}
+
+// symbolAliases returns every symbol's aliases, for the catalog listing.
+func symbolAliases() (map[string][]string, error) {
+	rows, err := database.Query("SELECT alias, symbol FROM symbol_aliases ORDER BY alias")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := map[string][]string{}
+	for rows.Next() {
+		var alias, symbol string
+		if err := rows.Scan(&alias, &symbol); err != nil {
+			return nil, err
+		}
+		aliases[symbol] = append(aliases[symbol], alias)
+	}
+	return aliases, rows.Err()
+}
+
+// handlePutSymbolAlias serves PUT /admin/symbols/{symbol}/aliases/{alias}.
+// An alias belongs to one symbol, so putting it on another moves it.
+func handlePutSymbolAlias(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "symbols are read-only on a replica; change them on the primary")
+		return
+	}
+	symbol, alias := r.PathValue("symbol"), r.PathValue("alias")
+	if !validSymbol(alias) {
+		writeError(w, http.StatusBadRequest, "alias must be lower-case letters, digits and underscores")
+		return
+	}
+	if alias == "18k" {
+		writeError(w, http.StatusBadRequest, "alias 18k is taken by /api/gold/18k")
+		return
+	}
+	var n int
+	database.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM gold_prices WHERE symbol = ?", symbol).Scan(&n)
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "unknown symbol "+symbol)
+		return
+	}
+
+	var before *SymbolAlias
+	prev := SymbolAlias{Alias: alias}
+	err := database.QueryRowContext(r.Context(), "SELECT symbol, created_at FROM symbol_aliases WHERE alias = ?", alias).
+		Scan(&prev.Symbol, &prev.CreatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err == nil {
+		before = &prev
+	}
+
+	after := SymbolAlias{Alias: alias, Symbol: symbol, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	_, err = database.ExecContext(r.Context(), `
+		INSERT INTO symbol_aliases (alias, symbol, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(alias) DO UPDATE SET symbol = excluded.symbol, created_at = excluded.created_at
+	`, after.Alias, after.Symbol, after.CreatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] Alias %s now serves %s", alias, symbol)
+	writeJSON(w, http.StatusOK, after)
+}
+
+// handleDeleteSymbolAlias serves DELETE /admin/symbols/{symbol}/aliases/{alias}.
+func handleDeleteSymbolAlias(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "symbols are read-only on a replica; change them on the primary")
+		return
+	}
+	symbol, alias := r.PathValue("symbol"), r.PathValue("alias")
+	before := SymbolAlias{Alias: alias, Symbol: symbol}
+	err := database.QueryRowContext(r.Context(), "SELECT created_at FROM symbol_aliases WHERE alias = ? AND symbol = ?", alias, symbol).
+		Scan(&before.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "no alias "+alias+" for "+symbol)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := database.ExecContext(r.Context(), "DELETE FROM symbol_aliases WHERE alias = ?", alias); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	auditChange(r, before, nil)
+	logf(r.Context(), "[admin] Alias %s of %s removed", alias, symbol)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Price anomaly kinds: fetched values fetchAndCache refuses to cache.
+const (
+	anomalyNonPositive    = "nonpositive_price"
+	anomalyTimeRegression = "timestamp_regression"
+	anomalyClockJump      = "clock_jump"
+)
+
+// clockJumpTolerance is how far wall-clock and monotonic elapsed time may
+// disagree between two cache writes before the wall clock is distrusted.
+const clockJumpTolerance = time.Minute
+
+// lastWrites is when fetchAndCache last wrote each symbol, with its
+// monotonic reading. It is kept per symbol so a clock jump is caught for
+// every symbol, not only the first one checked after it. Guarded by
+// pollMu.
+var lastWrites = map[string]time.Time{}
+
+// checkPriceWrite vets a fetched price before it is cached: it must be
+// positive, must not be older than the cached row, and the wall clock
+// must not have jumped since the symbol's previous write. A violation is
+// recorded in price_anomalies and returned as an anomaly-class error.
+// Call with pollMu held.
+func checkPriceWrite(ctx context.Context, symbol string, priceRial int64, now time.Time) error {
+	if priceRial <= 0 {
+		return recordAnomaly(ctx, symbol, anomalyNonPositive, priceRial, now,
+			fmt.Sprintf("price %d Rial", priceRial))
+	}
+	if last, ok := lastWrites[symbol]; ok {
+		// Round(0) drops the monotonic reading, leaving wall time.
+		drift := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		if drift > clockJumpTolerance || drift < -clockJumpTolerance {
+			// Re-baseline so one jump is reported once per symbol.
+			lastWrites[symbol] = now
+			return recordAnomaly(ctx, symbol, anomalyClockJump, priceRial, now,
+				fmt.Sprintf("wall clock moved %s against monotonic time since the last write", drift.Round(time.Second)))
+		}
+	}
+	var stored string
+	if err := database.QueryRowContext(ctx, "SELECT fetched_at FROM gold_prices WHERE symbol = ?", symbol).Scan(&stored); err == nil {
+		if t, err := time.Parse(time.RFC3339, stored); err == nil && now.Truncate(time.Second).Before(t) {
+			return recordAnomaly(ctx, symbol, anomalyTimeRegression, priceRial, now,
+				fmt.Sprintf("cached price is from %s, newer than this fetch", stored))
+		}
+	}
+	return nil
+}
+
+func recordAnomaly(ctx context.Context, symbol, kind string, priceRial int64, at time.Time, detail string) error {
+	if !cfg.DryRun {
+		_, err := database.Exec(`
+			INSERT INTO price_anomalies (symbol, kind, price_rial, observed_at, detail)
+			VALUES (?, ?, ?, ?, ?)
+		`, symbol, kind, priceRial, at.UTC().Format(time.RFC3339), detail)
+		if err != nil {
+			logf(ctx, "[anomaly] Storing %s failed: %v", kind, err)
+		}
+	}
+	metrics.Count("price.anomaly", 1, map[string]string{"symbol": symbol, "kind": kind})
+	return classified(errClassAnomaly, "rejected %s price: %s: %s", symbol, kind, detail)
+}
+
+// Anomaly is one row of GET /admin/anomalies.
+type Anomaly struct {
+	ID         int64  `json:"id"`
+	Symbol     string `json:"symbol"`
+	Kind       string `json:"kind"`
+	Price      int64  `json:"price"`
+	ObservedAt string `json:"observedAt"`
+	Detail     string `json:"detail"`
+}
+
+// handleAnomalies serves the most recent rejected prices, newest first.
+// ?limit caps the rows (max 1000).
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 100, 1, 1000)
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, symbol, kind, price_rial, observed_at, detail
+		FROM price_anomalies
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		var a Anomaly
+		if err := rows.Scan(&a.ID, &a.Symbol, &a.Kind, &a.Price, &a.ObservedAt, &a.Detail); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		anomalies = append(anomalies, a)
+	}
+	writeJSON(w, http.StatusOK, anomalies)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Tick archives are gzip-compressed NDJSON: a header line with the format,
+// its version, the schema version and each table's DDL and columns, one
+// line per row, and a trailer with the row counts, so a truncated file is
+// refused instead of half-imported. Values are listed in the header's
+// column order, which lets an archive load into a newer schema.
+const (
+	archiveFormat  = "gold-service-archive"
+	archiveVersion = 1
+)
+
+// archiveTables is the price history an archive carries, in import order.
+var archiveTables = []string{"gold_prices", "candles", "daily_closes", "record_events"}
+
+type archiveHeader struct {
+	Format        string         `json:"format"`
+	Version       int            `json:"version"`
+	SchemaVersion int            `json:"schemaVersion"`
+	CreatedAt     string         `json:"createdAt"`
+	Tables        []archiveTable `json:"tables"`
+}
+
+type archiveTable struct {
+	Name    string   `json:"name"`
+	Schema  string   `json:"schema"`
+	Columns []string `json:"columns"`
+}
+
+// archiveLine is a row ({"table", "values"}) or the trailer ({"end",
+// "rows"}).
+type archiveLine struct {
+	Table  string           `json:"table,omitempty"`
+	Values []any            `json:"values,omitempty"`
+	End    bool             `json:"end,omitempty"`
+	Rows   map[string]int64 `json:"rows,omitempty"`
+}
+
+// runCommand runs a command-line subcommand instead of the server and
+// returns the exit code.
+func runCommand(name string, args []string) int {
+	var run func([]string) error
+	switch name {
+	case "export-archive":
+		run = exportArchiveCommand
+	case "import-archive":
+		run = importArchiveCommand
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nusage:\n  gold-service                       run the service\n  gold-service export-archive [-o file] [-tables list]\n  gold-service import-archive [-replace] file\n", name)
+		return 2
+	}
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		log.Printf("Invalid configuration:\n%v", err)
+		return 1
+	}
+	if cfg.DBDriver != "sqlite" {
+		log.Printf("[archive] %s needs DB_DRIVER=sqlite; in-memory storage belongs to the running process", name)
+		return 1
+	}
+	if err := run(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 2
+		}
+		log.Printf("[archive] %s failed: %v", name, err)
+		return 1
+	}
+	return 0
+}
+
+// exportArchiveCommand writes the archive to -o (stdout by default) from a
+// read-only connection, in one read transaction, so it is consistent
+// while the service keeps running.
+func exportArchiveCommand(args []string) error {
+	fs := flag.NewFlagSet("export-archive", flag.ContinueOnError)
+	out := fs.String("o", "-", "archive file, or - for stdout")
+	tables := fs.String("tables", strings.Join(archiveTables, ","), "comma-separated tables to export")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := strings.Split(*tables, ",")
+	for _, n := range names {
+		if !slices.Contains(archiveTables, n) {
+			return fmt.Errorf("-tables: %q is not one of %s", n, strings.Join(archiveTables, ", "))
+		}
+	}
+
+	var err error
+	if database, err = sql.Open("sqlite", sqliteDSN(cfg)+"&mode=ro"); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	rows, err := exportArchive(context.Background(), w, names)
+	if err != nil {
+		if *out != "-" {
+			os.Remove(*out)
+		}
+		return err
+	}
+	for _, n := range names {
+		log.Printf("[archive] Exported %d %s rows", rows[n], n)
+	}
+	return nil
+}
+
+func exportArchive(ctx context.Context, w io.Writer, names []string) (map[string]int64, error) {
+	tx, err := database.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	header := archiveHeader{Format: archiveFormat, Version: archiveVersion, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&header.SchemaVersion); err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		t := archiveTable{Name: n}
+		if err := tx.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", n).Scan(&t.Schema); err != nil {
+			return nil, fmt.Errorf("reading %s schema: %w", n, err)
+		}
+		if t.Columns, err = tableColumns(ctx, tx, n); err != nil {
+			return nil, err
+		}
+		header.Tables = append(header.Tables, t)
+	}
+
+	gz := gzip.NewWriter(w)
+	bw := bufio.NewWriter(gz)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for _, t := range header.Tables {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY rowid", strings.Join(t.Columns, ", "), t.Name))
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, len(t.Columns))
+		ptrs := make([]any, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if err := enc.Encode(archiveLine{Table: t.Name, Values: values}); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[t.Name]++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Encode(archiveLine{End: true, Rows: counts}); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return counts, gz.Close()
+}
+
+// importArchiveCommand loads an archive into DB_PATH, migrating it first.
+// Rows already present are kept unless -replace is given. Everything is
+// imported in one transaction.
+func importArchiveCommand(args []string) error {
+	fs := flag.NewFlagSet("import-archive", flag.ContinueOnError)
+	replace := fs.Bool("replace", false, "overwrite rows that already exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gold-service import-archive [-replace] file (or - for stdin)")
+	}
+	if cfg.Mode == "replica" || cfg.DryRun {
+		return errors.New("the database is opened read-only with MODE=replica or DRY_RUN")
+	}
+
+	r := io.Reader(os.Stdin)
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var err error
+	if database, err = sql.Open("sqlite", sqliteDSN(cfg)); err != nil {
+		return err
+	}
+	defer database.Close()
+	if err := migrate(); err != nil {
+		return err
+	}
+	read, added, err := importArchive(context.Background(), r, *replace)
+	if err != nil {
+		return err
+	}
+	for _, t := range archiveTables {
+		if n, ok := read[t]; ok {
+			log.Printf("[archive] Imported %d of %d %s rows", added[t], n, t)
+		}
+	}
+	return nil
+}
+
+// importArchive returns, per table, the rows read and the rows written.
+func importArchive(ctx context.Context, r io.Reader, replace bool) (read, added map[string]int64, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil || header.Format != archiveFormat {
+		return nil, nil, errors.New("not a gold-service archive")
+	}
+	if header.Version > archiveVersion {
+		return nil, nil, fmt.Errorf("archive format version %d is newer than this build reads (%d)", header.Version, archiveVersion)
+	}
+	if header.SchemaVersion > len(migrations) {
+		return nil, nil, fmt.Errorf("archive is from schema version %d, newer than this build's %d; upgrade first", header.SchemaVersion, len(migrations))
+	}
+
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	verb := "INSERT OR IGNORE"
+	if replace {
+		verb = "INSERT OR REPLACE"
+	}
+	stmts := map[string]*sql.Stmt{}
+	read, added = map[string]int64{}, map[string]int64{}
+	for _, t := range header.Tables {
+		if !slices.Contains(archiveTables, t.Name) {
+			return nil, nil, fmt.Errorf("archive has unexpected table %q", t.Name)
+		}
+		have, err := tableColumns(ctx, tx, t.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range t.Columns {
+			if !slices.Contains(have, c) {
+				return nil, nil, fmt.Errorf("%s.%s does not exist in this schema", t.Name, c)
+			}
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(t.Columns)), ", ")
+		stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("%s INTO %s (%s) VALUES (%s)", verb, t.Name, strings.Join(t.Columns, ", "), placeholders))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer stmt.Close()
+		stmts[t.Name] = stmt
+		read[t.Name] = 0
+	}
+
+	for {
+		var line archiveLine
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, nil, errors.New("archive is truncated: no trailer")
+			}
+			return nil, nil, err
+		}
+		if line.End {
+			for t, n := range line.Rows {
+				if read[t] != n {
+					return nil, nil, fmt.Errorf("archive is inconsistent: trailer counts %d %s rows, read %d", n, t, read[t])
+				}
+			}
+			break
+		}
+		stmt, ok := stmts[line.Table]
+		if !ok {
+			return nil, nil, fmt.Errorf("row for table %q, which the header does not list", line.Table)
+		}
+		for i, v := range line.Values {
+			if n, ok := v.(json.Number); ok {
+				if line.Values[i], err = n.Int64(); err != nil {
+					line.Values[i], _ = n.Float64()
+				}
+			}
+		}
+		res, err := stmt.ExecContext(ctx, line.Values...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("importing %s row %d: %w", line.Table, read[line.Table]+1, err)
+		}
+		read[line.Table]++
+		if n, _ := res.RowsAffected(); n > 0 {
+			added[line.Table]++
+		}
+	}
+	return read, added, tx.Commit()
+}
+
+// tableColumns lists a table's columns in declaration order.
+func tableColumns(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	if len(cols) == 0 && rows.Err() == nil {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	return cols, rows.Err()
+}
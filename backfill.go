@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// gapBackfillBatch caps how many gaps one detector run backfills.
+const gapBackfillBatch = 50
+
+// backfillSource is the secondary historical API of BACKFILL_URL. It is
+// called as GET BACKFILL_URL?symbol=&from=&to= with RFC3339 bounds and
+// answers {"candles": [{"t", "open", "high", "low", "close"}]}, 1m
+// buckets with prices in Rial.
+type backfillSource struct {
+	name      string
+	url       string
+	apiKey    *secret
+	keySource *secretSource
+	client    *http.Client
+}
+
+// gapBackfill is nil unless BACKFILL_URL is set.
+var gapBackfill *backfillSource
+
+func newBackfillSource(c Config) (*backfillSource, error) {
+	if c.BackfillURL == "" {
+		return nil, nil
+	}
+	key, keySource, err := loadSecret("BACKFILL_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return &backfillSource{
+		name:      c.BackfillName,
+		url:       c.BackfillURL,
+		apiKey:    key,
+		keySource: keySource,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// watchKey keeps b.apiKey current, like brsProvider.watchKey.
+func (b *backfillSource) watchKey(ctx context.Context, interval time.Duration) {
+	if b.keySource == nil || b.keySource.static {
+		return
+	}
+	refreshSecret(ctx, "BACKFILL_KEY", b.keySource, b.apiKey, interval)
+}
+
+// fetch returns the source's 1m candles for symbol in [from, to).
+func (b *backfillSource) fetch(ctx context.Context, symbol string, from, to time.Time) ([]Candle, error) {
+	u, _ := url.Parse(b.url)
+	q := u.Query()
+	q.Set("symbol", symbol)
+	q.Set("from", from.Format(time.RFC3339))
+	q.Set("to", to.Format(time.RFC3339))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if key := b.apiKey.Get(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", b.name, resp.Status)
+	}
+	var body struct {
+		Candles []Candle `json:"candles"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding %s response: %w", b.name, err)
+	}
+	return body.Candles, nil
+}
+
+// backfillGaps fills closed gaps that have not been backfilled yet from
+// the secondary source. Candles land as 1m rows with the source's name
+// and no samples; a live candle is never overwritten. The hours and days
+// they fall in are then rolled up again. A failed fetch leaves the gap
+// for the next run; an answer with no candles still marks it done.
+func backfillGaps(ctx context.Context, b *backfillSource, now time.Time) error {
+	rows, err := database.QueryContext(ctx, `
+		SELECT symbol, start_at, end_at FROM history_gaps
+		WHERE ongoing = 0 AND backfilled_at = '' AND reason != ?
+		ORDER BY start_at
+		LIMIT ?
+	`, gapDeactivated, gapBackfillBatch)
+	if err != nil {
+		return err
+	}
+	type gap struct {
+		symbol     string
+		start, end time.Time
+	}
+	var gaps []gap
+	for rows.Next() {
+		var g gap
+		var start, end string
+		if err := rows.Scan(&g.symbol, &start, &end); err != nil {
+			rows.Close()
+			return err
+		}
+		g.start, _ = time.Parse(time.RFC3339, start)
+		g.end, _ = time.Parse(time.RFC3339, end)
+		gaps = append(gaps, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range gaps {
+		candles, err := b.fetch(ctx, g.symbol, g.start, g.end)
+		if err != nil {
+			metrics.Count("history.backfill", 1, map[string]string{"result": "error"})
+			log.Printf("[backfill] %s gap from %s: %v (will retry)", g.symbol, g.start.Format(time.RFC3339), err)
+			continue
+		}
+		n, err := storeBackfill(ctx, b.name, g.symbol, g.start, g.end, candles, now)
+		if err != nil {
+			return fmt.Errorf("storing %s backfill: %w", g.symbol, err)
+		}
+		metrics.Count("history.backfill", 1, map[string]string{"result": "ok"})
+		log.Printf("[backfill] %s gap %s–%s: %d of %d candles from %s",
+			g.symbol, g.start.Format(time.RFC3339), g.end.Format(time.RFC3339), n, len(candles), b.name)
+		if n == 0 {
+			continue
+		}
+		// Completed buckets only, as compactCandles would.
+		rollupMu.Lock()
+		for _, tier := range []struct {
+			from, to string
+			size     time.Duration
+		}{{res1m, res1h, time.Hour}, {res1h, res1d, 24 * time.Hour}} {
+			until := g.end.Truncate(tier.size).Add(tier.size)
+			if open := now.Truncate(tier.size); until.After(open) {
+				until = open
+			}
+			if err := rollupRange(tier.from, tier.to, tier.size,
+				g.start.Truncate(tier.size).Format(time.RFC3339), until.Format(time.RFC3339)); err != nil {
+				rollupMu.Unlock()
+				return err
+			}
+		}
+		rollupMu.Unlock()
+		queryCache.invalidateAll()
+	}
+	return nil
+}
+
+// storeBackfill writes the candles inside [start, end) and marks the gap
+// backfilled, in one transaction. It returns how many rows were added.
+func storeBackfill(ctx context.Context, source, symbol string, start, end time.Time, candles []Candle, now time.Time) (int, error) {
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	added := 0
+	for _, c := range candles {
+		t, err := time.Parse(time.RFC3339, c.BucketStart)
+		if err != nil || c.Low <= 0 || c.High < c.Low {
+			continue
+		}
+		t = t.UTC().Truncate(time.Minute)
+		if t.Before(start) || !t.Before(end) {
+			continue
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO candles (symbol, resolution, bucket_start, open, high, low, close, samples, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+			ON CONFLICT(symbol, resolution, bucket_start) DO NOTHING
+		`, symbol, res1m, t.Format(time.RFC3339), c.Open, c.High, c.Low, c.Close, source)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE history_gaps SET backfilled_at = ?, backfilled_rows = ?
+		WHERE symbol = ? AND start_at = ?
+	`, now.Format(time.RFC3339), added, symbol, start.Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return added, tx.Commit()
+}
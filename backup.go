@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotTimeFormat names snapshot objects so that lexical order is
+// chronological order.
+const snapshotTimeFormat = "20060102T150405Z"
+
+// backupStore ships consistent snapshots of the SQLite database to
+// S3-compatible object storage and restores them on demand.
+type backupStore struct {
+	s3        *s3Client
+	prefix    string
+	retention time.Duration
+}
+
+// newBackupStore returns nil when no BACKUP_S3_ENDPOINT is configured.
+func newBackupStore(c Config) *backupStore {
+	if c.BackupS3Endpoint == "" {
+		return nil
+	}
+	return &backupStore{
+		s3: &s3Client{
+			endpoint:  c.BackupS3Endpoint,
+			region:    c.BackupS3Region,
+			bucket:    c.BackupS3Bucket,
+			accessKey: c.BackupS3AccessKey,
+			secretKey: c.BackupS3SecretKey,
+			http:      &http.Client{Timeout: 60 * time.Second},
+		},
+		prefix:    c.BackupS3Prefix + "/snapshots/",
+		retention: time.Duration(c.BackupRetentionDays) * 24 * time.Hour,
+	}
+}
+
+// run uploads a snapshot every interval until ctx is cancelled, pruning
+// expired ones after each successful upload.
+func (b *backupStore) run(ctx context.Context, dbPath string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			key, err := b.snapshot(ctx, dbPath)
+			if err != nil {
+				log.Printf("[backup] Snapshot failed: %v", err)
+				continue
+			}
+			log.Printf("[backup] Uploaded %s", key)
+			if err := b.prune(ctx, time.Now()); err != nil {
+				log.Printf("[backup] Pruning old snapshots failed: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// snapshot writes a consistent copy of the live database with VACUUM INTO,
+// gzips it to a second file and streams that to storage, so memory use
+// doesn't grow with the database.
+func (b *backupStore) snapshot(ctx context.Context, dbPath string) (string, error) {
+	tmpPath := dbPath + ".snapshot"
+	gzPath := tmpPath + ".gz"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+	defer os.Remove(gzPath)
+
+	if _, err := database.ExecContext(ctx, "VACUUM INTO ?", tmpPath); err != nil {
+		return "", fmt.Errorf("VACUUM INTO failed: %w", err)
+	}
+	if err := gzipFile(tmpPath, gzPath); err != nil {
+		return "", err
+	}
+
+	key := b.prefix + time.Now().UTC().Format(snapshotTimeFormat) + ".db.gz"
+	if err := b.s3.putFile(ctx, key, gzPath); err != nil {
+		return "", fmt.Errorf("upload failed: %w", err)
+	}
+	return key, nil
+}
+
+// gzipFile compresses src into dst.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// prune deletes snapshots taken more than BACKUP_RETENTION_DAYS before now.
+// The newest snapshot is always kept, and 0 keeps everything. Objects
+// under the prefix that aren't named like snapshots are left alone.
+func (b *backupStore) prune(ctx context.Context, now time.Time) error {
+	if b.retention == 0 {
+		return nil
+	}
+	keys, err := b.s3.list(ctx, b.prefix)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	var snapshots []string
+	for _, key := range keys {
+		if _, err := b.takenAt(key); err == nil {
+			snapshots = append(snapshots, key)
+		}
+	}
+	deleted := 0
+	for _, key := range snapshots[:max(len(snapshots)-1, 0)] {
+		if t, _ := b.takenAt(key); now.Sub(t) <= b.retention {
+			break
+		}
+		if err := b.s3.delete(ctx, key); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("[backup] Deleted %d snapshots older than %v", deleted, b.retention)
+	}
+	return nil
+}
+
+// findSnapshot returns the key of the newest snapshot taken at or before
+// at, or the newest overall when at is zero. It returns "" if none match.
+func (b *backupStore) findSnapshot(ctx context.Context, at time.Time) (string, error) {
+	keys, err := b.s3.list(ctx, b.prefix)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(keys)
+	for i := len(keys) - 1; i >= 0; i-- {
+		takenAt, err := b.takenAt(keys[i])
+		if err != nil {
+			continue
+		}
+		if at.IsZero() || !takenAt.After(at) {
+			return keys[i], nil
+		}
+	}
+	return "", nil
+}
+
+// takenAt parses the time from a snapshot key; other objects under the
+// prefix fail to parse.
+func (b *backupStore) takenAt(key string) (time.Time, error) {
+	return time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(key, b.prefix), ".db.gz"))
+}
+
+// restore replaces the database at dbPath with the snapshot stored under
+// key. It must run before the database is opened.
+func (b *backupStore) restore(ctx context.Context, key, dbPath string) error {
+	compressed, err := b.s3.get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("snapshot is not gzip: %w", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("decompress failed: %w", err)
+	}
+
+	tmpPath := dbPath + ".restore"
+	if err := os.WriteFile(tmpPath, raw, 0o644); err != nil {
+		return err
+	}
+	// Stale WAL/SHM files from the old database would be replayed on top
+	// of the restored one.
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	return os.Rename(tmpPath, dbPath)
+}
+
+// restoreAt resolves BACKUP_RESTORE_AT ("latest" or an RFC3339 time) and
+// restores the matching snapshot into dbPath. The applied spec is recorded
+// in dbPath.restored, so later boots with the same setting keep the data
+// written since instead of rolling it back again.
+func (b *backupStore) restoreAt(ctx context.Context, dbPath, spec string) error {
+	marker := dbPath + ".restored"
+	if applied, err := os.ReadFile(marker); err == nil && strings.TrimSpace(string(applied)) == spec {
+		log.Printf("[backup] BACKUP_RESTORE_AT=%s was already applied; unset it or remove %s to restore again", spec, marker)
+		return nil
+	}
+	var at time.Time
+	if spec != "latest" {
+		var err error
+		at, err = time.Parse(time.RFC3339, spec)
+		if err != nil {
+			return fmt.Errorf("BACKUP_RESTORE_AT must be \"latest\" or RFC3339: %w", err)
+		}
+	}
+	key, err := b.findSnapshot(ctx, at)
+	if err != nil {
+		return fmt.Errorf("listing snapshots failed: %w", err)
+	}
+	if key == "" {
+		log.Printf("[backup] No snapshot found for %q, starting with local database", spec)
+		return nil
+	}
+	if err := b.restore(ctx, key, dbPath); err != nil {
+		return err
+	}
+	if err := os.WriteFile(marker, []byte(spec+"\n"), 0o644); err != nil {
+		return fmt.Errorf("recording the restore failed: %w", err)
+	}
+	log.Printf("[backup] Restored %s into %s", key, dbPath)
+	return nil
+}
+
+// warmStart restores the latest snapshot when dbPath has no cached price
+// yet, so a fresh volume serves data before the first upstream poll.
+// Failures are logged and the service starts with whatever is local.
+func (b *backupStore) warmStart(ctx context.Context, dbPath string) {
+	empty, err := dbIsEmpty(dbPath)
+	if err != nil {
+		log.Printf("[backup] Warm start skipped, can't tell whether %s is empty: %v", dbPath, err)
+		return
+	}
+	if !empty {
+		return
+	}
+	key, err := b.findSnapshot(ctx, time.Time{})
+	if err != nil {
+		log.Printf("[backup] Warm start skipped, listing snapshots failed: %v", err)
+		return
+	}
+	if key == "" {
+		log.Println("[backup] Warm start skipped, no snapshots available")
+		return
+	}
+	if err := b.restore(ctx, key, dbPath); err != nil {
+		log.Printf("[backup] Warm start failed: %v", err)
+		return
+	}
+	log.Printf("[backup] Warm start restored %s into %s", key, dbPath)
+}
+
+// dbIsEmpty reports whether dbPath is missing, zero-length, or has no
+// cached prices. Any other failure to tell, such as a locked or
+// unmigrated database, is an error: the caller must not restore over it.
+func dbIsEmpty(dbPath string) (bool, error) {
+	info, err := os.Stat(dbPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM gold_prices").Scan(&n); err != nil {
+		return false, fmt.Errorf("counting cached prices: %w", err)
+	}
+	return n == 0, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// canaryRetention bounds how long canary reports are kept.
+const canaryRetention = 90 * 24 * time.Hour
+
+// CanaryCheck is one promotion criterion and whether the candidate met it.
+type CanaryCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// CanaryReport compares a candidate (shadow) provider with the active one
+// over a window: accuracy against the served price, availability and
+// latency from fetch_log. Ready is true when every check passed.
+type CanaryReport struct {
+	ID          int64          `json:"id,omitempty"`
+	Candidate   string         `json:"candidate"`
+	Active      string         `json:"active"`
+	WindowStart string         `json:"windowStart"`
+	WindowEnd   string         `json:"windowEnd"`
+	Accuracy    ProviderDiff   `json:"accuracy"`
+	CandidateUp *UpstreamStats `json:"candidateUpstream"`
+	ActiveUp    *UpstreamStats `json:"activeUpstream"`
+	Checks      []CanaryCheck  `json:"checks"`
+	Ready       bool           `json:"ready"`
+	CreatedAt   string         `json:"createdAt"`
+}
+
+// runCanaryReporter builds and stores a report for the shadow provider
+// every interval.
+func runCanaryReporter(ctx context.Context, candidate string, interval time.Duration) {
+	ticker := time.NewTicker(clock.Real(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := buildCanaryReport(ctx, candidate, brsSource, clock.Now().UTC())
+			if err == nil {
+				err = storeCanaryReport(ctx, report)
+			}
+			if err != nil {
+				log.Printf("[canary] Report failed: %v", err)
+				continue
+			}
+			log.Printf("[canary] %s vs %s: ready=%t samples=%d", candidate, brsSource, report.Ready, report.Accuracy.Samples)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// buildCanaryReport evaluates candidate against active over the
+// CANARY_WINDOW ending at now.
+func buildCanaryReport(ctx context.Context, candidate, active string, now time.Time) (*CanaryReport, error) {
+	start := now.Add(-cfg.CanaryWindow)
+	report := &CanaryReport{
+		Candidate:   candidate,
+		Active:      active,
+		WindowStart: start.Format(time.RFC3339),
+		WindowEnd:   now.Format(time.RFC3339),
+		Accuracy:    ProviderDiff{Provider: candidate},
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+
+	var meanRial, meanPct, maxPct sql.NullFloat64
+	var last sql.NullString
+	err := database.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+		       COALESCE(SUM(CASE WHEN error != '' THEN 1 ELSE 0 END), 0),
+		       AVG(ABS(price_rial - primary_price_rial)),
+		       AVG(ABS(price_rial - primary_price_rial) * 100.0 / primary_price_rial),
+		       MAX(ABS(price_rial - primary_price_rial) * 100.0 / primary_price_rial),
+		       MAX(fetched_at)
+		FROM shadow_quotes
+		WHERE provider = ? AND fetched_at >= ? AND fetched_at <= ?
+	`, candidate, report.WindowStart, report.WindowEnd).
+		Scan(&report.Accuracy.Samples, &report.Accuracy.Failures, &meanRial, &meanPct, &maxPct, &last)
+	if err != nil {
+		return nil, fmt.Errorf("reading shadow quotes: %w", err)
+	}
+	report.Accuracy.MeanAbsDiffRial = nullFloat(meanRial)
+	report.Accuracy.MeanAbsDiffPercent = nullFloat(meanPct)
+	report.Accuracy.MaxAbsDiffPercent = nullFloat(maxPct)
+	report.Accuracy.LastFetchedAt = last.String
+	var lastPrice, lastPrimary sql.NullInt64
+	database.QueryRowContext(ctx, `
+		SELECT price_rial, primary_price_rial FROM shadow_quotes
+		WHERE provider = ? AND fetched_at >= ? AND fetched_at <= ?
+		ORDER BY id DESC LIMIT 1
+	`, candidate, report.WindowStart, report.WindowEnd).Scan(&lastPrice, &lastPrimary)
+	report.Accuracy.LastPriceRial = nullInt(lastPrice)
+	report.Accuracy.LastPrimaryPriceRial = nullInt(lastPrimary)
+
+	if report.CandidateUp, err = upstreamStatsBetween(ctx, candidate, report.WindowStart, report.WindowEnd); err != nil {
+		return nil, err
+	}
+	if report.ActiveUp, err = upstreamStatsBetween(ctx, active, report.WindowStart, report.WindowEnd); err != nil {
+		return nil, err
+	}
+
+	report.Checks = canaryChecks(report)
+	report.Ready = true
+	for _, c := range report.Checks {
+		report.Ready = report.Ready && c.Passed
+	}
+	return report, nil
+}
+
+// upstreamStatsBetween aggregates one provider's fetch_log attempts
+// started in [from, to].
+func upstreamStatsBetween(ctx context.Context, provider, from, to string) (*UpstreamStats, error) {
+	rows, err := database.QueryContext(ctx, `
+		SELECT duration_ms, ok, error_class FROM fetch_log
+		WHERE provider = ? AND started_at >= ? AND started_at <= ?
+	`, provider, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("reading fetch log: %w", err)
+	}
+	defer rows.Close()
+	stats := &UpstreamStats{Errors: map[string]int{}}
+	for rows.Next() {
+		var durationMs int64
+		var ok bool
+		var class string
+		if err := rows.Scan(&durationMs, &ok, &class); err != nil {
+			return nil, fmt.Errorf("reading fetch log: %w", err)
+		}
+		stats.add(ok, durationMs, class)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading fetch log: %w", err)
+	}
+	stats.finish()
+	return stats, nil
+}
+
+// canaryChecks applies the promotion criteria: enough samples, a mean
+// divergence within CANARY_MAX_DIFF_BPS, availability no worse than the
+// active provider's, and p95 latency at most twice the active provider's.
+func canaryChecks(r *CanaryReport) []CanaryCheck {
+	checks := []CanaryCheck{{
+		Name:   "samples",
+		Passed: r.Accuracy.Samples >= cfg.CanaryMinSamples,
+		Detail: fmt.Sprintf("%d samples, need %d", r.Accuracy.Samples, cfg.CanaryMinSamples),
+	}}
+
+	accuracy := CanaryCheck{Name: "accuracy", Detail: "no comparable samples"}
+	if p := r.Accuracy.MeanAbsDiffPercent; p != nil {
+		limit := float64(cfg.CanaryMaxDiffBps) / 100
+		accuracy.Passed = *p <= limit
+		accuracy.Detail = fmt.Sprintf("mean divergence %.3f%%, limit %.2f%%", *p, limit)
+	}
+	checks = append(checks, accuracy)
+
+	availability := CanaryCheck{Name: "availability", Detail: "no attempts recorded"}
+	if c, a := r.CandidateUp.SuccessRate, r.ActiveUp.SuccessRate; c != nil && a != nil {
+		availability.Passed = *c >= *a
+		availability.Detail = fmt.Sprintf("success rate %.4f vs active %.4f", *c, *a)
+	} else if c != nil {
+		availability.Passed = true
+		availability.Detail = fmt.Sprintf("success rate %.4f, active has no attempts", *c)
+	}
+	checks = append(checks, availability)
+
+	latency := CanaryCheck{Name: "latency", Detail: "no successful attempts"}
+	if c, a := r.CandidateUp.P95Ms, r.ActiveUp.P95Ms; c != nil && a != nil {
+		latency.Passed = *c <= 2**a
+		latency.Detail = fmt.Sprintf("p95 %dms vs active %dms, limit 2x", *c, *a)
+	} else if c != nil {
+		latency.Passed = true
+		latency.Detail = fmt.Sprintf("p95 %dms, active has no successful attempts", *c)
+	}
+	return append(checks, latency)
+}
+
+func storeCanaryReport(ctx context.Context, r *CanaryReport) error {
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	res, err := database.ExecContext(ctx, `
+		INSERT INTO canary_reports (candidate, active, ready, report, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, r.Candidate, r.Active, r.Ready, string(encoded), r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("storing canary report: %w", err)
+	}
+	r.ID, _ = res.LastInsertId()
+	cutoff := clock.Now().UTC().Add(-canaryRetention).Format(time.RFC3339)
+	database.ExecContext(ctx, "DELETE FROM canary_reports WHERE created_at < ?", cutoff)
+	return nil
+}
+
+// handleCanaryReports serves GET /admin/providers/canary?limit=10: stored
+// reports, newest first.
+func handleCanaryReports(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 10, 1, 1000)
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), "SELECT id, report FROM canary_reports ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	reports := []CanaryReport{}
+	for rows.Next() {
+		var report CanaryReport
+		var encoded string
+		if err := rows.Scan(&report.ID, &encoded); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.Unmarshal([]byte(encoded), &report)
+		reports = append(reports, report)
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
+
+// handleRunCanaryReport serves POST /admin/providers/canary: it builds and
+// stores a report now instead of waiting for the schedule.
+func handleRunCanaryReport(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "canary reports are built on the primary")
+		return
+	}
+	if cfg.ShadowURL == "" {
+		writeError(w, http.StatusConflict, "no candidate provider; set SHADOW_PROVIDER_URL")
+		return
+	}
+	report, err := buildCanaryReport(r.Context(), cfg.ShadowName, brsSource, clock.Now().UTC())
+	if err == nil {
+		err = storeCanaryReport(r.Context(), report)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logf(r.Context(), "[admin] Canary report %d for %s: ready=%t", report.ID, report.Candidate, report.Ready)
+	writeJSON(w, http.StatusCreated, report)
+}
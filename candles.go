@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Candle resolutions. Ticks are written as 1m candles; the compaction job
+// rolls completed 1m candles up into 1h and completed 1h into 1d, and
+// prunes each resolution to its retention.
+const (
+	res1m = "1m"
+	res1h = "1h"
+	res1d = "1d"
+)
+
+// candleSourceMixed marks a rolled-up candle built from live and
+// backfilled candles. Live candles have an empty source, backfilled ones
+// BACKFILL_SOURCE_NAME.
+const candleSourceMixed = "mixed"
+
+// mergeSource is the source of a candle aggregating candles from a and b.
+func mergeSource(a, b string) string {
+	if a == b {
+		return a
+	}
+	return candleSourceMixed
+}
+
+// candleCompactInterval is how often rollup and pruning run.
+const candleCompactInterval = time.Hour
+
+// Candle is one OHLC bucket. BucketStart is the UTC start of the bucket.
+type Candle struct {
+	BucketStart string `json:"t"`
+	BucketMs    *int64 `json:"tMs,omitempty"`
+	Open        int64  `json:"open"`
+	High        int64  `json:"high"`
+	Low         int64  `json:"low"`
+	Close       int64  `json:"close"`
+	Samples     int    `json:"samples"`
+	Source      string `json:"source,omitempty"`
+}
+
+func resolutionDuration(res string) (time.Duration, bool) {
+	switch res {
+	case res1m:
+		return time.Minute, true
+	case res1h:
+		return time.Hour, true
+	case res1d:
+		return 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// upsertTickSQL folds one fetched price into its 1m candle. Arguments:
+// symbol, resolution, bucket start, then the price four times. It runs in
+// the poll cycle's transaction (pollStatements.upsertTick).
+const upsertTickSQL = `
+	INSERT INTO candles (symbol, resolution, bucket_start, open, high, low, close, samples)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+	ON CONFLICT(symbol, resolution, bucket_start) DO UPDATE SET
+		high = MAX(high, excluded.high),
+		low = MIN(low, excluded.low),
+		close = excluded.close,
+		samples = samples + 1,
+		source = CASE source WHEN '' THEN '' ELSE 'mixed' END`
+
+// recordTick folds one fetched price into its 1m candle inside tx.
+func recordTick(ctx context.Context, tx *sql.Tx, symbol string, priceRial int64, at time.Time) error {
+	_, err := tx.StmtContext(ctx, pollStatements.upsertTick).ExecContext(ctx,
+		symbol, res1m, at.UTC().Truncate(time.Minute).Format(time.RFC3339), priceRial, priceRial, priceRial, priceRial)
+	return err
+}
+
+// runCandleCompactor compacts once at startup and then every
+// candleCompactInterval until ctx is cancelled.
+func runCandleCompactor(ctx context.Context) {
+	ticker := time.NewTicker(clock.Real(candleCompactInterval))
+	defer ticker.Stop()
+	for {
+		if err := compactCandles(clock.Now().UTC()); err != nil {
+			log.Printf("[candles] Compaction failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rollupMu serializes rollups, so a backfill re-computing old buckets and
+// the compactor never write an aggregate of the other's stale read.
+var rollupMu sync.Mutex
+
+// compactCandles rolls 1m into 1h and 1h into 1d for buckets that have
+// ended, then deletes candles past their resolution's retention.
+func compactCandles(now time.Time) error {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	defer queryCache.invalidateAll()
+	if err := rollup(res1m, res1h, time.Hour, now); err != nil {
+		return err
+	}
+	if err := rollup(res1h, res1d, 24*time.Hour, now); err != nil {
+		return err
+	}
+	for _, tier := range []struct {
+		res  string
+		days int
+	}{{res1m, cfg.CandleRetention1mDays}, {res1h, cfg.CandleRetention1hDays}, {res1d, cfg.CandleRetention1dDays}} {
+		if tier.days == 0 {
+			continue // kept forever
+		}
+		cutoff := now.AddDate(0, 0, -tier.days).Format(time.RFC3339)
+		res, err := database.Exec("DELETE FROM candles WHERE resolution = ? AND bucket_start < ?", tier.res, cutoff)
+		if err != nil {
+			return fmt.Errorf("pruning %s candles: %w", tier.res, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("[candles] Pruned %d %s candles older than %d days", n, tier.res, tier.days)
+		}
+	}
+	return nil
+}
+
+// rollup aggregates the from-resolution candles of every completed to-sized
+// bucket since the newest existing to-candle (re-computing that one, which
+// may have been written while its bucket was still open).
+func rollup(from, to string, size time.Duration, now time.Time) error {
+	var since string
+	database.QueryRow("SELECT COALESCE(MAX(bucket_start), '') FROM candles WHERE resolution = ?", to).Scan(&since)
+	return rollupRange(from, to, size, since, now.Truncate(size).Format(time.RFC3339))
+}
+
+// rollupRange re-computes the to-sized buckets in [since, until) from the
+// from-resolution candles in them.
+func rollupRange(from, to string, size time.Duration, since, until string) error {
+	rows, err := database.Query(`
+		SELECT symbol, bucket_start, open, high, low, close, samples, source FROM candles
+		WHERE resolution = ? AND bucket_start >= ? AND bucket_start < ?
+		ORDER BY symbol, bucket_start
+	`, from, since, until)
+	if err != nil {
+		return fmt.Errorf("reading %s candles: %w", from, err)
+	}
+	type key struct{ symbol, bucket string }
+	var order []key
+	agg := map[key]*Candle{}
+	for rows.Next() {
+		var symbol string
+		var c Candle
+		if err := rows.Scan(&symbol, &c.BucketStart, &c.Open, &c.High, &c.Low, &c.Close, &c.Samples, &c.Source); err != nil {
+			rows.Close()
+			return err
+		}
+		t, err := time.Parse(time.RFC3339, c.BucketStart)
+		if err != nil {
+			continue
+		}
+		k := key{symbol, t.Truncate(size).Format(time.RFC3339)}
+		a, ok := agg[k]
+		if !ok {
+			a = &Candle{BucketStart: k.bucket, Open: c.Open, High: c.High, Low: c.Low, Source: c.Source}
+			agg[k] = a
+			order = append(order, k)
+		}
+		a.High = max(a.High, c.High)
+		a.Low = min(a.Low, c.Low)
+		a.Close = c.Close
+		a.Samples += c.Samples
+		a.Source = mergeSource(a.Source, c.Source)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range order {
+		a := agg[k]
+		_, err := database.Exec(`
+			INSERT OR REPLACE INTO candles (symbol, resolution, bucket_start, open, high, low, close, samples, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, k.symbol, to, a.BucketStart, a.Open, a.High, a.Low, a.Close, a.Samples, a.Source)
+		if err != nil {
+			return fmt.Errorf("writing %s candle: %w", to, err)
+		}
+	}
+	return nil
+}
+
+// handleCandles serves GET /api/gold/18k/candles?resolution=1h&from=&to=
+// with RFC3339 bounds (default: the last 24 hours), oldest first. With
+// ?tz= the buckets are aligned to that zone instead of UTC.
+func handleCandles(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	res := qp.oneOf("resolution", res1h, res1m, res1h, res1d)
+	to := qp.time("to", clock.Now()).UTC()
+	from := qp.time("from", to.Add(-24*time.Hour)).UTC()
+	if !from.Before(to) {
+		qp.fail("from", "from must be before to")
+	}
+	// NDJSON exports are streamed, so they have no default row cap.
+	ndjson := strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	limit, maxLimit := 1000, 10000
+	if ndjson {
+		limit, maxLimit = -1, math.MaxInt32
+	}
+	limit = qp.intRange("limit", limit, 1, maxLimit)
+	after := qp.cursor("cursor")
+	withMs := qp.unixMs()
+	loc := qp.location("tz")
+	if !qp.valid(w) {
+		return
+	}
+	if loc != nil {
+		serveLocalCandles(w, r, res, loc, from, to, limit, after, ndjson, withMs)
+		return
+	}
+
+	// One extra row tells whether there is a next page. Streamed exports
+	// are not paged.
+	fetch := limit
+	if !ndjson {
+		fetch++
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT rowid, bucket_start, open, high, low, close, samples, source FROM candles
+		WHERE symbol = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?
+		  AND (? = '' OR (bucket_start, rowid) > (?, ?))
+		ORDER BY bucket_start, rowid
+		LIMIT ?
+	`, "gold_18k", res, from.Format(time.RFC3339), to.Format(time.RFC3339), after.T, after.T, after.ID, fetch)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	if ndjson {
+		streamCandles(w, r, rows, withMs)
+		return
+	}
+
+	candles := []Candle{}
+	var last pageCursor
+	more := false
+	for rows.Next() {
+		if len(candles) == limit {
+			more = true
+			break
+		}
+		var c Candle
+		if err := rows.Scan(&last.ID, &c.BucketStart, &c.Open, &c.High, &c.Low, &c.Close, &c.Samples, &c.Source); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		last.T = c.BucketStart
+		if withMs {
+			c.BucketMs = unixMs(c.BucketStart)
+		}
+		candles = append(candles, c)
+	}
+	resp := map[string]any{
+		"symbol":     "gold_18k",
+		"resolution": res,
+		"candles":    candles,
+		"nextCursor": nil,
+	}
+	if more {
+		resp["nextCursor"] = setNextLink(w, r, last)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// streamBatch is how many NDJSON lines are written between flushes.
+const streamBatch = 500
+
+// streamCandles writes one candle per line as rows are read, so neither
+// side holds the whole range in memory. Writes go straight to the
+// connection: a slow client blocks the loop rather than letting output
+// pile up in a buffer. Each flush pushes the write deadline out, so an
+// export may outlast the server's WriteTimeout as long as the client
+// keeps reading, while a stalled client is dropped.
+func streamCandles(w http.ResponseWriter, r *http.Request, rows *sql.Rows, withMs bool) {
+	defer exports.begin()()
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	n := 0
+	for rows.Next() {
+		select {
+		case <-exports.stopping():
+			// Tell the client the export is incomplete rather than let
+			// it look like the end of the data.
+			enc.Encode(map[string]string{"error": "server shutting down"})
+			rc.Flush()
+			logf(r.Context(), "[candles] Export stopped by shutdown after %d rows", n)
+			return
+		default:
+		}
+		var c Candle
+		var rowid int64
+		if err := rows.Scan(&rowid, &c.BucketStart, &c.Open, &c.High, &c.Low, &c.Close, &c.Samples, &c.Source); err != nil {
+			logf(r.Context(), "[candles] Export aborted after %d rows: %v", n, err)
+			return
+		}
+		if withMs {
+			c.BucketMs = unixMs(c.BucketStart)
+		}
+		if err := enc.Encode(c); err != nil {
+			return // client went away
+		}
+		if n++; n%streamBatch == 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logf(r.Context(), "[candles] Export aborted after %d rows: %v", n, err)
+	}
+	rc.Flush()
+}
+
+// localBucket returns the start of the res-sized bucket containing t,
+// with hours and days aligned to loc.
+func localBucket(t time.Time, res string, loc *time.Location) time.Time {
+	lt := t.In(loc)
+	switch res {
+	case res1d:
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, loc)
+	case res1h:
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, loc)
+	}
+	return lt.Truncate(time.Minute)
+}
+
+// localCandles re-buckets stored candles into res-sized buckets aligned to
+// loc. Stored candles are UTC-aligned, and a local day (Asia/Tehran starts
+// at 20:30 UTC) generally does not line up with stored 1h or 1d buckets,
+// so it aggregates the finest resolution available: 1m where it is still
+// retained, then 1h for the hours before that, then 1d before that. Only
+// the part served from coarser tiers is off by the zone's sub-bucket
+// offset.
+func localCandles(ctx context.Context, symbol, res string, loc *time.Location, from, to time.Time) ([]Candle, error) {
+	tiers := []struct {
+		res  string
+		next time.Duration // size of the next coarser tier
+	}{{res1m, time.Hour}, {res1h, 24 * time.Hour}, {res1d, 0}}
+
+	boundary := to
+	var sources [][]Candle
+	for _, tier := range tiers {
+		rows, err := database.QueryContext(ctx, `
+			SELECT bucket_start, open, high, low, close, samples, source FROM candles
+			WHERE symbol = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?
+			ORDER BY bucket_start
+		`, symbol, tier.res, from.UTC().Format(time.RFC3339), boundary.UTC().Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+		var tierCandles []Candle
+		for rows.Next() {
+			var c Candle
+			if err := rows.Scan(&c.BucketStart, &c.Open, &c.High, &c.Low, &c.Close, &c.Samples, &c.Source); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tierCandles = append(tierCandles, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		sources = append(sources, tierCandles)
+
+		// Coarser tiers only fill in before the first bucket this tier
+		// covers, so no price is counted twice.
+		if tier.res == res || tier.next == 0 {
+			break
+		}
+		if len(tierCandles) > 0 {
+			if t, err := time.Parse(time.RFC3339, tierCandles[0].BucketStart); err == nil {
+				boundary = t.Truncate(tier.next)
+			}
+		}
+	}
+
+	var out []Candle
+	var current time.Time
+	for i := len(sources) - 1; i >= 0; i-- { // oldest (coarsest) first
+		for _, c := range sources[i] {
+			t, err := time.Parse(time.RFC3339, c.BucketStart)
+			if err != nil {
+				continue
+			}
+			b := localBucket(t, res, loc)
+			if len(out) == 0 || !b.Equal(current) {
+				current = b
+				c.BucketStart = b.Format(time.RFC3339)
+				out = append(out, c)
+				continue
+			}
+			a := &out[len(out)-1]
+			a.High = max(a.High, c.High)
+			a.Low = min(a.Low, c.Low)
+			a.Close = c.Close
+			a.Samples += c.Samples
+			a.Source = mergeSource(a.Source, c.Source)
+		}
+	}
+	return out, nil
+}
+
+// serveLocalCandles answers a ?tz= candle query. Buckets are built in
+// memory, so pagination and NDJSON apply to the finished buckets; the
+// cursor carries the last bucket start and no rowid.
+func serveLocalCandles(w http.ResponseWriter, r *http.Request, res string, loc *time.Location, from, to time.Time, limit int, after pageCursor, ndjson, withMs bool) {
+	candles, err := localCandles(r.Context(), "gold_18k", res, loc, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if after.T != "" {
+		if t, err := time.Parse(time.RFC3339, after.T); err == nil {
+			i := 0
+			for i < len(candles) {
+				if b, _ := time.Parse(time.RFC3339, candles[i].BucketStart); b.After(t) {
+					break
+				}
+				i++
+			}
+			candles = candles[i:]
+		}
+	}
+	more := limit > 0 && len(candles) > limit
+	if more {
+		candles = candles[:limit]
+	}
+	if withMs {
+		for i := range candles {
+			candles[i].BucketMs = unixMs(candles[i].BucketStart)
+		}
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, c := range candles {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if candles == nil {
+		candles = []Candle{}
+	}
+	resp := map[string]any{
+		"symbol":     "gold_18k",
+		"resolution": res,
+		"tz":         loc.String(),
+		"candles":    candles,
+		"nextCursor": nil,
+	}
+	if more {
+		resp["nextCursor"] = setNextLink(w, r, pageCursor{T: candles[len(candles)-1].BucketStart})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
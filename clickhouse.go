@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// clickhouseTick is one row of the ClickHouse tick table, sent as
+// JSONEachRow. at is "YYYY-MM-DD hh:mm:ss.sss" UTC, which ClickHouse
+// parses into DateTime64(3) without extra settings.
+type clickhouseTick struct {
+	Symbol    string `json:"symbol"`
+	PriceRial int64  `json:"price_rial"`
+	At        string `json:"at"`
+	Source    string `json:"source"`
+}
+
+// clickhouseSink ships every cached tick to ClickHouse for long-term
+// analytics. SQLite stays the serving store: the poller only queues rows,
+// and a background loop inserts them in batches over the HTTP interface.
+// When ClickHouse is down the queue absorbs a few batches, then new ticks
+// are dropped (and counted) rather than slowing the poller.
+type clickhouseSink struct {
+	insertURL     string
+	user          string
+	password      *secret
+	pwSource      *secretSource
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan clickhouseTick
+	done          chan struct{}
+	client        *http.Client
+}
+
+// tickSink is nil unless CLICKHOUSE_URL is set.
+var tickSink *clickhouseSink
+
+func newClickhouseSink(c Config) (*clickhouseSink, error) {
+	if c.ClickhouseURL == "" {
+		return nil, nil
+	}
+	password, source, err := loadSecret("CLICKHOUSE_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(c.ClickhouseURL)
+	q := u.Query()
+	q.Set("query", "INSERT INTO "+c.ClickhouseTable+" FORMAT JSONEachRow")
+	u.RawQuery = q.Encode()
+	return &clickhouseSink{
+		insertURL:     u.String(),
+		user:          c.ClickhouseUser,
+		password:      password,
+		pwSource:      source,
+		batchSize:     c.ClickhouseBatchSize,
+		flushInterval: c.ClickhouseFlushInterval,
+		queue:         make(chan clickhouseTick, 10*c.ClickhouseBatchSize),
+		done:          make(chan struct{}),
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// add queues a tick without blocking.
+func (s *clickhouseSink) add(symbol string, priceRial int64, at time.Time, source string) {
+	t := clickhouseTick{
+		Symbol:    symbol,
+		PriceRial: priceRial,
+		At:        at.UTC().Format("2006-01-02 15:04:05.000"),
+		Source:    source,
+	}
+	select {
+	case s.queue <- t:
+	default:
+		metrics.Count("clickhouse.dropped", 1, nil)
+	}
+}
+
+// run inserts queued ticks every flushInterval, or sooner once a full
+// batch is waiting. On shutdown it flushes what is left and closes done.
+func (s *clickhouseSink) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	var batch []clickhouseTick
+	for {
+		select {
+		case t := <-s.queue:
+			batch = append(batch, t)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flush(flushCtx, batch)
+			cancel()
+			return
+		}
+		s.flush(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// flush inserts one batch, retrying twice. A batch that still fails is
+// dropped: the ticks remain in SQLite's candles, only the raw rows are
+// lost.
+func (s *clickhouseSink) flush(ctx context.Context, batch []clickhouseTick) {
+	if len(batch) == 0 {
+		return
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, t := range batch {
+		enc.Encode(t)
+	}
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(time.Duration(attempt-1) * 2 * time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if err = s.insert(ctx, body.Bytes()); err == nil {
+			metrics.Count("clickhouse.rows_sent", int64(len(batch)), nil)
+			return
+		}
+	}
+	log.Printf("[clickhouse] Dropping %d ticks after 3 attempts: %v", len(batch), err)
+	metrics.Count("clickhouse.dropped", int64(len(batch)), nil)
+}
+
+func (s *clickhouseSink) insert(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.insertURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password.Get())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clock is the time price data lives in: fetch timestamps, staleness,
+// candle buckets, retention and the poller's schedule. Latency
+// measurements, deadlines and admin bookkeeping use real time.
+type Clock interface {
+	Now() time.Time
+	// Real converts a span of this clock's time to the real time to
+	// wait for it, for timers and tickers.
+	Real(d time.Duration) time.Duration
+}
+
+// clock is realClock unless CLOCK_MODE=simulated.
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                     { return time.Now() }
+func (realClock) Real(d time.Duration) time.Duration { return d }
+
+// simClock starts at a configured instant and runs speed times faster than
+// real time; advance jumps it forward. Jumps don't fire pending timers
+// early: a poll already scheduled still waits out its real delay, and its
+// next cycle is planned from the new time.
+type simClock struct {
+	mu        sync.Mutex
+	start     time.Time
+	realStart time.Time
+	speed     int
+	offset    time.Duration
+}
+
+func newSimClock(start time.Time, speed int) *simClock {
+	return &simClock{start: start, realStart: time.Now(), speed: speed}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.start.Add(time.Since(c.realStart)*time.Duration(c.speed) + c.offset)
+}
+
+func (c *simClock) Real(d time.Duration) time.Duration {
+	return max(d/time.Duration(c.speed), time.Millisecond)
+}
+
+func (c *simClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset += d
+}
+
+// clockSince is time.Since on the service clock.
+func clockSince(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+// handleGetClock serves GET /admin/clock.
+func handleGetClock(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{"mode": "real", "now": clock.Now().UTC().Format(time.RFC3339Nano), "speed": 1}
+	if sim, ok := clock.(*simClock); ok {
+		resp["mode"] = "simulated"
+		resp["speed"] = sim.speed
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdvanceClock serves POST /admin/clock/advance with a body of
+// {"by": "6h"}, moving a simulated clock forward.
+func handleAdvanceClock(w http.ResponseWriter, r *http.Request) {
+	sim, ok := clock.(*simClock)
+	if !ok {
+		writeError(w, http.StatusConflict, "the clock is only adjustable with CLOCK_MODE=simulated")
+		return
+	}
+	var req struct {
+		By string `json:"by"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"by\": \"6h\"}")
+		return
+	}
+	d, err := time.ParseDuration(req.By)
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, "by must be a positive duration like 6h")
+		return
+	}
+	before := sim.Now().UTC().Format(time.RFC3339Nano)
+	sim.advance(d)
+	after := sim.Now().UTC().Format(time.RFC3339Nano)
+	auditChange(r, map[string]string{"now": before}, map[string]string{"now": after})
+	logf(r.Context(), "[admin] Simulated clock advanced by %v to %s", d, after)
+	writeJSON(w, http.StatusOK, map[string]any{"mode": "simulated", "now": after, "speed": sim.speed})
+}
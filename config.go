@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the typed service configuration, read once from the
+// environment at startup. Provider API keys are not part of it; they are
+// resolved (and rotated) by secretSourceFromEnv.
+type Config struct {
+	Port int
+	Mode string
+	// DryRun polls and validates upstream data but writes nothing and
+	// notifies no one; see dryrun.go.
+	DryRun       bool
+	PollInterval time.Duration
+	DBPath       string
+	DBDriver     string
+	SeedFile     string
+	AdminToken   string
+
+	// HTTP server limits; see net/http.Server.
+	HTTPReadTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+
+	// ShutdownGrace is how long shutdown waits for requests; running
+	// exports extend it up to ShutdownMaxWait.
+	ShutdownGrace   time.Duration
+	ShutdownMaxWait time.Duration
+
+	BRSAPIURL         string
+	BRSAPIKeyHeader   string
+	UpstreamHeaders   map[string]string
+	UpstreamTimeout   time.Duration
+	FetchTimeout      time.Duration
+	UpstreamUserAgent string
+	SOCKS5Proxy       *url.URL
+	DNSServer         string
+	PinnedIPs         map[string][]string
+	UpstreamRecordDir string
+	UpstreamDecode    string
+	UpstreamReplayDir string
+
+	ShadowURL       string
+	ShadowName      string
+	ShadowHeaders   map[string]string
+	ShadowKeyHeader string
+
+	// Canary reports compare the shadow provider with the active one over
+	// CanaryWindow, every CanaryReportInterval.
+	CanaryReportInterval time.Duration
+	CanaryWindow         time.Duration
+	CanaryMinSamples     int
+	CanaryMaxDiffBps     int
+
+	SecretsRefreshInterval time.Duration
+
+	BackupS3Endpoint    string
+	BackupS3Bucket      string
+	BackupS3Region      string
+	BackupS3AccessKey   string
+	BackupS3SecretKey   string
+	BackupS3Prefix      string
+	BackupInterval      time.Duration
+	BackupRetentionDays int
+	BackupRestoreAt     string
+	BackupWarmStart     bool
+
+	// ClickHouse tick sink; off unless ClickhouseURL is set. The password
+	// is the CLICKHOUSE_PASSWORD secret.
+	ClickhouseURL           string
+	ClickhouseTable         string
+	ClickhouseUser          string
+	ClickhouseBatchSize     int
+	ClickhouseFlushInterval time.Duration
+
+	MetricsBackend      string
+	StatsDAddr          string
+	StatsDPrefix        string
+	StatsDTags          map[string]string
+	MetricsPushInterval time.Duration
+
+	// APIKeyMode is off (X-API-Key is only a caller identity), optional
+	// (a key that is sent must be valid) or required on /api/ routes.
+	APIKeyMode           string
+	AccessReloadInterval time.Duration
+
+	// FeatureFlags are FEATURE_FLAGS overrides of the built-in flag
+	// defaults; rules stored through the admin API win over both.
+	FeatureFlags map[string]FeatureFlag
+
+	RefreshMinInterval time.Duration
+	RevalidateDebounce time.Duration
+
+	// RateLimitRequests is how many /api/ requests a client may make per
+	// RateLimitWindow; 0 disables. API keys can override it.
+	RateLimitRequests int
+	RateLimitWindow   time.Duration
+
+	// AbuseMaxErrors 4xx answers to one client within AbuseWindow ban it
+	// from /api/ for AbuseBanDuration; 0 disables.
+	AbuseMaxErrors   int
+	AbuseWindow      time.Duration
+	AbuseBanDuration time.Duration
+
+	// HoneypotPaths are decoy routes whose callers are flagged as scrapers
+	// for ScraperFlagDuration and then limited to ScraperRateLimitRequests
+	// per RateLimitWindow (0 only flags them).
+	HoneypotPaths            []string
+	ScraperFlagDuration      time.Duration
+	ScraperRateLimitRequests int
+
+	// JSONFieldCase is the default for ?case on /api/ routes: "camel" or
+	// "snake" response field names.
+	JSONFieldCase string
+
+	FreshnessSampleInterval time.Duration
+
+	// GapThreshold is how long a symbol may go without ticks, not counting
+	// MarketClosures, before the gap detector reports a history gap.
+	GapThreshold   time.Duration
+	MarketClosures []marketClosure
+
+	// BackfillURL is a secondary historical API that closed gaps are
+	// filled from; backfilled candles carry BackfillName as their source.
+	BackfillURL  string
+	BackfillName string
+
+	// A MODE=standby region pulls from SyncPrimaryURL every SyncInterval
+	// and polls upstream itself after SyncFailoverAfter without a pull.
+	// SyncToken authenticates standbys to the primary's /internal/sync.
+	SyncPrimaryURL    string
+	SyncToken         string
+	SyncInterval      time.Duration
+	SyncFailoverAfter time.Duration
+	SyncHistoryHours  int
+
+	// LeaderElection=kubernetes lets only the pod holding the Lease
+	// LeaderLeaseName poll upstream and run the primary's jobs.
+	// LeaderIdentity defaults to the hostname, which is the pod name.
+	LeaderElection       string
+	LeaderLeaseName      string
+	LeaderLeaseNamespace string
+	LeaderIdentity       string
+	LeaderLeaseDuration  time.Duration
+
+	// DiscoveryBackend (none, consul or etcd) is where the instance
+	// registers itself at DiscoveryURL, as DiscoveryAddress:PORT under
+	// DiscoveryService, renewing every third of DiscoveryTTL.
+	// DiscoveryPrefix is the etcd key prefix.
+	DiscoveryBackend string
+	DiscoveryURL     string
+	DiscoveryService string
+	DiscoveryAddress string
+	DiscoveryPrefix  string
+	DiscoveryTTL     time.Duration
+
+	// PollerWatchdogMultiple is how many poll intervals past its schedule
+	// a poller cycle may run before the loop is restarted; 0 disables.
+	PollerWatchdogMultiple int
+
+	// TrackedSymbols are polled each cycle; PollConcurrency bounds how
+	// many provider endpoints are requested at once. FX_QUOTES sets their
+	// Quote.
+	TrackedSymbols  []trackedSymbol
+	PollConcurrency int
+
+	// SQLite connection settings; the pragmas apply to every connection.
+	SQLiteBusyTimeout time.Duration
+	SQLiteSynchronous string
+	SQLiteCacheSizeKB int
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+
+	// DBIntegrityCheck is off, quick or full; DBAutoRepair restores the
+	// latest backup over a database that fails it at startup.
+	DBIntegrityCheck string
+	DBAutoRepair     bool
+
+	// QueryCacheTTL bounds how long a cached history response is served;
+	// QueryCacheMaxEntries of 0 disables the cache.
+	QueryCacheTTL        time.Duration
+	QueryCacheMaxEntries int
+
+	// DailyCloseTZ sets the day boundary of daily_closes.
+	DailyCloseTZ *time.Location
+
+	// ClockMode "simulated" runs price data on a clock starting at
+	// SimClockStart (zero: now) and running SimClockSpeed times faster.
+	ClockMode     string
+	SimClockStart time.Time
+	SimClockSpeed int
+
+	CandleRetention1mDays int
+	CandleRetention1hDays int
+	CandleRetention1dDays int
+
+	RecordWebhookURL    string
+	RecordWebhookSecret string
+
+	// Telegram channel publishing is on when TelegramChatID is set; the
+	// bot token is a secret (TELEGRAM_BOT_TOKEN and its _FILE etc. forms).
+	TelegramChatID       string
+	TelegramAPIURL       string
+	TelegramSymbols      []string
+	TelegramChangeBps    int
+	TelegramPostInterval time.Duration
+
+	// Google Sheets export is on when SheetsSpreadsheetID is set; the
+	// service account key is the GOOGLE_SHEETS_CREDENTIALS secret.
+	SheetsSpreadsheetID string
+	SheetsAPIURL        string
+	SheetsRange         string
+	SheetsMode          string
+	SheetsSymbols       []string
+	SheetsInterval      time.Duration
+
+	// Flat-file delivery is on when DeliveryURL (a file:// directory) is
+	// set. DeliveryTimes are minutes after midnight in DailyCloseTZ.
+	DeliveryURL   string
+	DeliveryTimes []int
+
+	// Rate-lock tokens are signed with the RATE_LOCK_SECRET secret and
+	// last RateLockDefaultMinutes unless the caller asks for up to
+	// RateLockMaxMinutes.
+	RateLockDefaultMinutes int
+	RateLockMaxMinutes     int
+
+	// CryptoQuoteSymbols are the assets /api/gold/18k/crypto prices gold
+	// in; fetch them through TrackedSymbols.
+	CryptoQuoteSymbols []string
+
+	// PriceRounding holds per-symbol rounding of served prices.
+	PriceRounding map[string]RoundingRule
+}
+
+// cfg is the configuration the service was started with.
+var cfg Config
+
+// loadConfig parses and validates the environment, reporting every
+// problem at once rather than stopping at the first.
+func loadConfig() (Config, error) {
+	p := &envParser{}
+	c := Config{
+		Port:         p.intRange("PORT", 8080, 1, 65535),
+		Mode:         p.oneOf("MODE", "primary", "primary", "replica", "standby"),
+		DryRun:       p.bool("DRY_RUN", false),
+		PollInterval: p.seconds("POLL_INTERVAL", 60),
+		DBPath:       p.str("DB_PATH", "/data/gold.db"),
+		DBDriver:     p.oneOf("DB_DRIVER", "sqlite", "sqlite", "memory"),
+		SeedFile:     p.str("SEED_FILE", ""),
+		AdminToken:   p.str("ADMIN_TOKEN", ""),
+
+		HTTPReadTimeout:       p.seconds("HTTP_READ_TIMEOUT", 5),
+		HTTPReadHeaderTimeout: p.seconds("HTTP_READ_HEADER_TIMEOUT", 5),
+		HTTPWriteTimeout:      p.seconds("HTTP_WRITE_TIMEOUT", 60),
+		HTTPIdleTimeout:       p.seconds("HTTP_IDLE_TIMEOUT", 120),
+		HTTPMaxHeaderBytes:    p.intRange("HTTP_MAX_HEADER_BYTES", 1<<20, 4096, 64<<20),
+
+		ShutdownGrace:   p.seconds("SHUTDOWN_GRACE", 5),
+		ShutdownMaxWait: p.seconds("SHUTDOWN_MAX_WAIT", 60),
+
+		BRSAPIURL:         p.url("BRS_API_URL", brsAPIURL),
+		BRSAPIKeyHeader:   p.str("BRS_API_KEY_HEADER", ""),
+		UpstreamHeaders:   p.headers("UPSTREAM_HEADERS"),
+		UpstreamTimeout:   p.seconds("UPSTREAM_TIMEOUT", 10),
+		FetchTimeout:      p.seconds("FETCH_TIMEOUT", 30),
+		UpstreamUserAgent: p.str("UPSTREAM_USER_AGENT", defaultUserAgent),
+		SOCKS5Proxy:       p.socks5("UPSTREAM_SOCKS5_PROXY"),
+		DNSServer:         p.dnsServer("UPSTREAM_DNS_SERVER"),
+		PinnedIPs:         p.pinnedIPs("UPSTREAM_PIN_IPS"),
+		UpstreamRecordDir: p.str("UPSTREAM_RECORD_DIR", ""),
+		UpstreamDecode:    p.oneOf("UPSTREAM_DECODE", "tolerant", "tolerant", "strict"),
+		UpstreamReplayDir: p.str("UPSTREAM_REPLAY_DIR", ""),
+
+		ShadowURL:       p.url("SHADOW_PROVIDER_URL", ""),
+		ShadowName:      p.str("SHADOW_PROVIDER_NAME", "shadow"),
+		ShadowHeaders:   p.headers("SHADOW_PROVIDER_HEADERS"),
+		ShadowKeyHeader: p.str("SHADOW_PROVIDER_KEY_HEADER", ""),
+
+		CanaryReportInterval: p.seconds("CANARY_REPORT_INTERVAL", 3600),
+		CanaryWindow:         time.Duration(p.intRange("CANARY_WINDOW_HOURS", 24, 1, 720)) * time.Hour,
+		CanaryMinSamples:     p.intRange("CANARY_MIN_SAMPLES", 60, 1, 1000000),
+		CanaryMaxDiffBps:     p.intRange("CANARY_MAX_DIFF_BPS", 50, 0, 10000),
+
+		SecretsRefreshInterval: p.seconds("SECRETS_REFRESH_INTERVAL", 300),
+
+		BackupS3Endpoint:    p.url("BACKUP_S3_ENDPOINT", ""),
+		BackupS3Bucket:      p.str("BACKUP_S3_BUCKET", ""),
+		BackupS3Region:      p.str("BACKUP_S3_REGION", "us-east-1"),
+		BackupS3AccessKey:   p.str("BACKUP_S3_ACCESS_KEY", ""),
+		BackupS3SecretKey:   p.str("BACKUP_S3_SECRET_KEY", ""),
+		BackupS3Prefix:      strings.Trim(p.str("BACKUP_S3_PREFIX", "gold-service"), "/"),
+		BackupInterval:      p.seconds("BACKUP_INTERVAL", 300),
+		BackupRetentionDays: p.intRange("BACKUP_RETENTION_DAYS", 7, 0, 36500),
+		BackupRestoreAt:     p.str("BACKUP_RESTORE_AT", ""),
+		BackupWarmStart:     p.bool("BACKUP_WARM_START", false),
+
+		ClickhouseURL:           p.url("CLICKHOUSE_URL", ""),
+		ClickhouseTable:         p.str("CLICKHOUSE_TABLE", "gold_ticks"),
+		ClickhouseUser:          p.str("CLICKHOUSE_USER", ""),
+		ClickhouseBatchSize:     p.intRange("CLICKHOUSE_BATCH_SIZE", 1000, 1, 100000),
+		ClickhouseFlushInterval: p.seconds("CLICKHOUSE_FLUSH_INTERVAL", 10),
+
+		MetricsBackend:      p.oneOf("METRICS_BACKEND", "prometheus", "prometheus", "statsd", "dogstatsd"),
+		StatsDAddr:          p.str("STATSD_ADDR", "127.0.0.1:8125"),
+		StatsDPrefix:        p.str("STATSD_PREFIX", "gold."),
+		StatsDTags:          p.tags("STATSD_TAGS"),
+		MetricsPushInterval: p.seconds("METRICS_PUSH_INTERVAL", 10),
+
+		APIKeyMode:           p.oneOf("API_KEY_MODE", "off", "off", "optional", "required"),
+		AccessReloadInterval: p.seconds("ACCESS_RELOAD_INTERVAL", 30),
+
+		FeatureFlags: p.featureFlags("FEATURE_FLAGS"),
+
+		RefreshMinInterval: p.seconds("REFRESH_MIN_INTERVAL", 30),
+		RateLimitRequests:  p.intRange("RATE_LIMIT_REQUESTS", 0, 0, 1000000),
+		RateLimitWindow:    p.seconds("RATE_LIMIT_WINDOW", 60),
+		AbuseMaxErrors:     p.intRange("ABUSE_MAX_ERRORS", 0, 0, 1000000),
+		AbuseWindow:        p.seconds("ABUSE_WINDOW", 60),
+		AbuseBanDuration:   p.seconds("ABUSE_BAN_DURATION", 900),
+		RevalidateDebounce: p.seconds("REVALIDATE_DEBOUNCE", 15),
+
+		HoneypotPaths:            p.paths("HONEYPOT_PATHS"),
+		ScraperFlagDuration:      p.seconds("SCRAPER_FLAG_DURATION", 86400),
+		ScraperRateLimitRequests: p.intRange("SCRAPER_RATE_LIMIT_REQUESTS", 0, 0, 1000000),
+
+		JSONFieldCase: p.oneOf("JSON_FIELD_CASE", "camel", "camel", "snake"),
+
+		FreshnessSampleInterval: p.seconds("FRESHNESS_SAMPLE_INTERVAL", 30),
+
+		GapThreshold:   p.seconds("GAP_THRESHOLD", 300),
+		MarketClosures: p.marketClosures("MARKET_CLOSURES"),
+		BackfillURL:    p.url("BACKFILL_URL", ""),
+		BackfillName:   p.str("BACKFILL_SOURCE_NAME", "backfill"),
+
+		SyncPrimaryURL:    p.url("SYNC_PRIMARY_URL", ""),
+		SyncToken:         p.str("SYNC_TOKEN", ""),
+		SyncInterval:      p.seconds("SYNC_INTERVAL", 15),
+		SyncFailoverAfter: p.seconds("SYNC_FAILOVER_AFTER", 180),
+		SyncHistoryHours:  p.intRange("SYNC_HISTORY_HOURS", 24, 1, 720),
+
+		LeaderElection:       p.oneOf("LEADER_ELECTION", "none", "none", "kubernetes"),
+		LeaderLeaseName:      p.str("LEADER_LEASE_NAME", "gold-price-service"),
+		LeaderLeaseNamespace: p.str("LEADER_LEASE_NAMESPACE", ""),
+		LeaderIdentity:       p.str("LEADER_IDENTITY", ""),
+		LeaderLeaseDuration:  p.seconds("LEADER_LEASE_DURATION", 15),
+
+		DiscoveryBackend: p.oneOf("DISCOVERY_BACKEND", "none", "none", "consul", "etcd"),
+		DiscoveryURL:     p.url("DISCOVERY_URL", ""),
+		DiscoveryService: p.str("DISCOVERY_SERVICE_NAME", "gold-price-service"),
+		DiscoveryAddress: p.str("DISCOVERY_ADDRESS", ""),
+		DiscoveryPrefix:  p.str("DISCOVERY_ETCD_PREFIX", "/services"),
+		DiscoveryTTL:     p.seconds("DISCOVERY_TTL", 30),
+
+		PollerWatchdogMultiple: p.intRange("POLLER_WATCHDOG_MULTIPLE", 3, 0, 100),
+
+		TrackedSymbols:  p.trackedSymbols("TRACKED_SYMBOLS", "gold_18k=IR_GOLD_18K"),
+		PollConcurrency: p.intRange("POLL_CONCURRENCY", 4, 1, 64),
+
+		SQLiteBusyTimeout: time.Duration(p.intRange("SQLITE_BUSY_TIMEOUT_MS", 5000, 0, 600000)) * time.Millisecond,
+		SQLiteSynchronous: p.oneOf("SQLITE_SYNCHRONOUS", "NORMAL", "OFF", "NORMAL", "FULL", "EXTRA"),
+		SQLiteCacheSizeKB: p.intRange("SQLITE_CACHE_SIZE_KB", 8192, 0, 1<<22),
+		DBMaxOpenConns:    p.intRange("DB_MAX_OPEN_CONNS", 8, 1, 1024),
+		DBMaxIdleConns:    p.intRange("DB_MAX_IDLE_CONNS", 4, 0, 1024),
+
+		DBIntegrityCheck: p.oneOf("DB_INTEGRITY_CHECK", "quick", "off", "quick", "full"),
+		DBAutoRepair:     p.bool("DB_AUTO_REPAIR", false),
+
+		QueryCacheTTL:        p.seconds("QUERY_CACHE_TTL", 60),
+		QueryCacheMaxEntries: p.intRange("QUERY_CACHE_MAX_ENTRIES", 1000, 0, 1<<20),
+
+		DailyCloseTZ: p.location("DAILY_CLOSE_TZ", "Asia/Tehran"),
+
+		ClockMode:     p.oneOf("CLOCK_MODE", "real", "real", "simulated"),
+		SimClockStart: p.timestamp("SIM_CLOCK_START"),
+		SimClockSpeed: p.intRange("SIM_CLOCK_SPEED", 1, 1, 3600),
+
+		// Retention in days per candle resolution; 0 keeps them forever.
+		CandleRetention1mDays: p.intRange("CANDLE_RETENTION_1M_DAYS", 30, 0, 1<<20),
+		CandleRetention1hDays: p.intRange("CANDLE_RETENTION_1H_DAYS", 365, 0, 1<<20),
+		CandleRetention1dDays: p.intRange("CANDLE_RETENTION_1D_DAYS", 0, 0, 1<<20),
+
+		RecordWebhookURL:    p.url("RECORD_WEBHOOK_URL", ""),
+		RecordWebhookSecret: p.str("RECORD_WEBHOOK_SECRET", ""),
+
+		TelegramChatID:       p.str("TELEGRAM_CHAT_ID", ""),
+		TelegramAPIURL:       p.url("TELEGRAM_API_URL", "https://api.telegram.org"),
+		TelegramSymbols:      p.symbolList("TELEGRAM_SYMBOLS", "gold_18k"),
+		TelegramChangeBps:    p.intRange("TELEGRAM_CHANGE_BPS", 100, 0, 10000),
+		TelegramPostInterval: time.Duration(p.intRange("TELEGRAM_POST_INTERVAL", 0, 0, 7*86400)) * time.Second,
+
+		SheetsSpreadsheetID: p.str("SHEETS_SPREADSHEET_ID", ""),
+		SheetsAPIURL:        p.url("SHEETS_API_URL", "https://sheets.googleapis.com"),
+		SheetsRange:         p.str("SHEETS_RANGE", "Sheet1!A:C"),
+		SheetsMode:          p.oneOf("SHEETS_MODE", "daily", "daily", "snapshot"),
+		SheetsSymbols:       p.symbolList("SHEETS_SYMBOLS", "gold_18k"),
+		SheetsInterval:      p.seconds("SHEETS_INTERVAL", 3600),
+
+		DeliveryURL:   p.str("DELIVERY_URL", ""),
+		DeliveryTimes: p.timesOfDay("DELIVERY_TIMES", "09:00"),
+
+		RateLockDefaultMinutes: p.intRange("RATE_LOCK_DEFAULT_MINUTES", 5, 1, 1440),
+		RateLockMaxMinutes:     p.intRange("RATE_LOCK_MAX_MINUTES", 15, 1, 1440),
+
+		CryptoQuoteSymbols: p.symbolList("CRYPTO_QUOTE_SYMBOLS", "usdt,btc"),
+		PriceRounding:      p.rounding("PRICE_ROUNDING"),
+	}
+
+	if c.BackupS3Endpoint != "" && c.BackupS3Bucket == "" {
+		p.fail("BACKUP_S3_BUCKET is required when BACKUP_S3_ENDPOINT is set")
+	}
+	if spec := c.BackupRestoreAt; spec != "" && spec != "latest" {
+		if _, err := time.Parse(time.RFC3339, spec); err != nil {
+			p.fail("BACKUP_RESTORE_AT must be \"latest\" or an RFC3339 time, got %q", spec)
+		}
+	}
+	if c.ShutdownMaxWait < c.ShutdownGrace {
+		p.fail("SHUTDOWN_MAX_WAIT (%v) must not be shorter than SHUTDOWN_GRACE (%v)", c.ShutdownMaxWait, c.ShutdownGrace)
+	}
+	p.fxQuotes("FX_QUOTES", c.TrackedSymbols)
+	if c.RateLockDefaultMinutes > c.RateLockMaxMinutes {
+		p.fail("RATE_LOCK_DEFAULT_MINUTES (%d) must not exceed RATE_LOCK_MAX_MINUTES (%d)", c.RateLockDefaultMinutes, c.RateLockMaxMinutes)
+	}
+	if c.DeliveryURL != "" && !strings.HasPrefix(c.DeliveryURL, "file://") {
+		p.fail("DELIVERY_URL must be a file:// URL, got %q", c.DeliveryURL)
+	}
+	if !clickhouseTableRe.MatchString(c.ClickhouseTable) {
+		p.fail("CLICKHOUSE_TABLE must be a table name like db.table, got %q", c.ClickhouseTable)
+	}
+	if c.ClockMode == "real" && (!c.SimClockStart.IsZero() || c.SimClockSpeed != 1) {
+		p.fail("SIM_CLOCK_START and SIM_CLOCK_SPEED require CLOCK_MODE=simulated")
+	}
+	// The default threshold grows with POLL_INTERVAL; only an explicit
+	// GAP_THRESHOLD that slow polling would trip constantly is an error.
+	if os.Getenv("GAP_THRESHOLD") == "" {
+		c.GapThreshold = max(c.GapThreshold, 2*c.PollInterval)
+	} else if c.GapThreshold < 2*c.PollInterval {
+		p.fail("GAP_THRESHOLD (%v) must be at least twice POLL_INTERVAL (%v)", c.GapThreshold, c.PollInterval)
+	}
+	if c.BackfillName == "" || c.BackfillName == candleSourceMixed {
+		p.fail("BACKFILL_SOURCE_NAME must be set and not %q", candleSourceMixed)
+	}
+	if c.DryRun && c.Mode != "primary" {
+		p.fail("DRY_RUN requires MODE=primary")
+	}
+	if c.Mode == "standby" {
+		if c.SyncPrimaryURL == "" || c.SyncToken == "" {
+			p.fail("MODE=standby requires SYNC_PRIMARY_URL and SYNC_TOKEN")
+		}
+		if c.SyncFailoverAfter < 2*c.SyncInterval {
+			p.fail("SYNC_FAILOVER_AFTER (%v) must be at least twice SYNC_INTERVAL (%v)", c.SyncFailoverAfter, c.SyncInterval)
+		}
+	}
+	if c.LeaderElection != "none" && c.Mode != "primary" {
+		p.fail("LEADER_ELECTION requires MODE=primary")
+	}
+	if c.LeaderLeaseDuration < 3*time.Second {
+		p.fail("LEADER_LEASE_DURATION must be at least 3 seconds, got %v", c.LeaderLeaseDuration)
+	}
+	if c.DiscoveryURL == "" {
+		switch c.DiscoveryBackend {
+		case "consul":
+			c.DiscoveryURL = "http://127.0.0.1:8500"
+		case "etcd":
+			c.DiscoveryURL = "http://127.0.0.1:2379"
+		}
+	}
+	if c.DiscoveryTTL < 6*time.Second {
+		p.fail("DISCOVERY_TTL must be at least 6 seconds, got %v", c.DiscoveryTTL)
+	}
+	if c.UpstreamRecordDir != "" && c.UpstreamReplayDir != "" {
+		p.fail("UPSTREAM_RECORD_DIR and UPSTREAM_REPLAY_DIR are mutually exclusive")
+	}
+	if c.DBDriver == "memory" {
+		// The in-memory database lives only as long as one of its pooled
+		// connections, and has no file to replicate, back up or restore.
+		if c.Mode == "replica" {
+			p.fail("MODE=replica requires DB_DRIVER=sqlite")
+		}
+		if c.BackupS3Endpoint != "" {
+			p.fail("BACKUP_S3_ENDPOINT requires DB_DRIVER=sqlite")
+		}
+		if c.DBMaxIdleConns < 1 {
+			p.fail("DB_MAX_IDLE_CONNS must be at least 1 with DB_DRIVER=memory")
+		}
+	} else if c.Mode != "replica" && !c.DryRun {
+		// A dry run writes nothing, so it may inspect a read-only copy.
+		if err := checkWritable(c.DBPath); err != nil {
+			p.fail("DB_PATH %s is not writable: %v", c.DBPath, err)
+		}
+	}
+	return c, errors.Join(p.errs...)
+}
+
+// clickhouseTableRe limits CLICKHOUSE_TABLE to a plain, optionally
+// database-qualified name, since it is spliced into the INSERT query.
+var clickhouseTableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// checkWritable verifies the service can create and modify the database
+// at path: its directory must accept new files (WAL/SHM, snapshots), and
+// an existing file must open for writing.
+func checkWritable(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".gold-write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if db, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		db.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// logSummary prints the effective configuration with secrets masked.
+func (c Config) logSummary() {
+	onOff := func(set bool) string {
+		if set {
+			return "on"
+		}
+		return "off"
+	}
+	keyVia := "query"
+	if c.BRSAPIKeyHeader != "" {
+		keyVia = "header " + c.BRSAPIKeyHeader
+	}
+	proxy := "env"
+	if c.SOCKS5Proxy != nil {
+		proxy = c.SOCKS5Proxy.Redacted()
+	}
+	dns := "system"
+	if c.DNSServer != "" {
+		dns = c.DNSServer
+	}
+	recording := "off"
+	switch {
+	case c.UpstreamRecordDir != "":
+		recording = "record " + c.UpstreamRecordDir
+	case c.UpstreamReplayDir != "":
+		recording = "replay " + c.UpstreamReplayDir
+	}
+	backups := "off"
+	if c.BackupS3Endpoint != "" {
+		backups = fmt.Sprintf("%s/%s/%s every %v keep %dd", c.BackupS3Endpoint, c.BackupS3Bucket, c.BackupS3Prefix, c.BackupInterval, c.BackupRetentionDays)
+	}
+	clickhouse := "off"
+	if c.ClickhouseURL != "" {
+		clickhouse = fmt.Sprintf("%s table=%s batch=%d every %v", c.ClickhouseURL, c.ClickhouseTable, c.ClickhouseBatchSize, c.ClickhouseFlushInterval)
+	}
+	shadow := "off"
+	if c.ShadowURL != "" {
+		shadow = fmt.Sprintf("%s (%s) canary every %v over %v", c.ShadowName, c.ShadowURL, c.CanaryReportInterval, c.CanaryWindow)
+	}
+
+	db := c.DBPath
+	if c.DBDriver == "memory" {
+		db = "memory"
+	}
+	mode := c.Mode
+	if c.DryRun {
+		mode += " (dry run)"
+	}
+	log.Printf("[config] mode=%s port=%d db=%s poll=%v seed=%s admin_api=%s api_keys=%s",
+		mode, c.Port, db, c.PollInterval, onOff(c.SeedFile != ""), onOff(c.AdminToken != ""), c.APIKeyMode)
+	log.Printf("[config] http read=%v read_header=%v write=%v idle=%v max_header_bytes=%d shutdown_grace=%v shutdown_max=%v",
+		c.HTTPReadTimeout, c.HTTPReadHeaderTimeout, c.HTTPWriteTimeout, c.HTTPIdleTimeout, c.HTTPMaxHeaderBytes, c.ShutdownGrace, c.ShutdownMaxWait)
+	log.Printf("[config] upstream url=%s key_via=%s timeout=%v fetch_timeout=%v proxy=%s dns=%s pinned_hosts=%d extra_headers=%d decode=%s recording=%s",
+		c.BRSAPIURL, keyVia, c.UpstreamTimeout, c.FetchTimeout, proxy, dns, len(c.PinnedIPs), len(c.UpstreamHeaders), c.UpstreamDecode, recording)
+	log.Printf("[config] shadow=%s backups=%s warm_start=%t secrets_refresh=%v",
+		shadow, backups, c.BackupWarmStart, c.SecretsRefreshInterval)
+	log.Printf("[config] clickhouse=%s", clickhouse)
+	if c.Mode == "standby" {
+		log.Printf("[config] sync primary=%s every %v failover_after=%v history=%dh",
+			c.SyncPrimaryURL, c.SyncInterval, c.SyncFailoverAfter, c.SyncHistoryHours)
+	}
+	if c.RateLimitRequests > 0 {
+		log.Printf("[config] rate_limit=%d per %v", c.RateLimitRequests, c.RateLimitWindow)
+	}
+	if c.AbuseMaxErrors > 0 {
+		log.Printf("[config] abuse_ban=%d errors per %v bans for %v", c.AbuseMaxErrors, c.AbuseWindow, c.AbuseBanDuration)
+	}
+	if c.JSONFieldCase != "camel" {
+		log.Printf("[config] json_field_case=%s", c.JSONFieldCase)
+	}
+	if len(c.HoneypotPaths) > 0 {
+		log.Printf("[config] honeypot=%s flag_for=%v scraper_rate_limit=%d",
+			strings.Join(c.HoneypotPaths, ","), c.ScraperFlagDuration, c.ScraperRateLimitRequests)
+	}
+	if c.LeaderElection != "none" {
+		log.Printf("[config] leader_election=%s lease=%s identity=%s duration=%v",
+			c.LeaderElection, c.LeaderLeaseName, c.LeaderIdentity, c.LeaderLeaseDuration)
+	}
+	if c.DiscoveryBackend != "none" {
+		log.Printf("[config] discovery=%s url=%s service=%s ttl=%v",
+			c.DiscoveryBackend, c.DiscoveryURL, c.DiscoveryService, c.DiscoveryTTL)
+	}
+	if c.TelegramChatID != "" {
+		log.Printf("[config] telegram chat=%s symbols=%s change_bps=%d interval=%v",
+			c.TelegramChatID, strings.Join(c.TelegramSymbols, ","), c.TelegramChangeBps, c.TelegramPostInterval)
+	}
+	if c.SheetsSpreadsheetID != "" {
+		log.Printf("[config] sheets spreadsheet=%s range=%s mode=%s symbols=%s every %v",
+			c.SheetsSpreadsheetID, c.SheetsRange, c.SheetsMode, strings.Join(c.SheetsSymbols, ","), c.SheetsInterval)
+	}
+	if c.DeliveryURL != "" {
+		u, _ := url.Parse(c.DeliveryURL)
+		var times []string
+		for _, m := range c.DeliveryTimes {
+			times = append(times, fmt.Sprintf("%02d:%02d", m/60, m%60))
+		}
+		log.Printf("[config] delivery url=%s times=%s tz=%s", u.Redacted(), strings.Join(times, ","), c.DailyCloseTZ)
+	}
+	log.Printf("[config] sqlite busy_timeout=%v synchronous=%s cache=%dKiB max_open=%d max_idle=%d",
+		c.SQLiteBusyTimeout, c.SQLiteSynchronous, c.SQLiteCacheSizeKB, c.DBMaxOpenConns, c.DBMaxIdleConns)
+	if c.MetricsBackend != "prometheus" {
+		log.Printf("[config] metrics=%s addr=%s prefix=%q push=%v global_tags=%d",
+			c.MetricsBackend, c.StatsDAddr, c.StatsDPrefix, c.MetricsPushInterval, len(c.StatsDTags))
+	}
+}
+
+// envParser reads typed values from the environment, collecting errors.
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) fail(format string, args ...any) {
+	p.errs = append(p.errs, fmt.Errorf(format, args...))
+}
+
+func (p *envParser) str(key, def string) string {
+	return envOrDefault(key, def)
+}
+
+func (p *envParser) intRange(key string, def, min, max int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min || n > max {
+		p.fail("%s must be an integer between %d and %d, got %q", key, min, max, raw)
+		return def
+	}
+	return n
+}
+
+// symbolList parses a comma-separated list of cache symbols.
+func (p *envParser) symbolList(key, def string) []string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		raw = def
+	}
+	var symbols []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if !validSymbol(s) {
+			p.fail("%s: %q is not a symbol", key, s)
+			continue
+		}
+		symbols = append(symbols, s)
+	}
+	return symbols
+}
+
+// timesOfDay parses a comma-separated list of HH:MM times into sorted
+// minutes after midnight.
+func (p *envParser) timesOfDay(key, def string) []int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		raw = def
+	}
+	var minutes []int
+	for _, s := range strings.Split(raw, ",") {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			p.fail("%s: %q is not a time like 09:30", key, s)
+			continue
+		}
+		minutes = append(minutes, t.Hour()*60+t.Minute())
+	}
+	slices.Sort(minutes)
+	return slices.Compact(minutes)
+}
+
+// paths parses an optional comma-separated list of URL paths.
+func (p *envParser) paths(key string) []string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	var paths []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "/") || strings.ContainsAny(s, " ?#") {
+			p.fail("%s: %q is not a path like /api/v1/prices", key, s)
+			continue
+		}
+		paths = append(paths, s)
+	}
+	return paths
+}
+
+// timestamp parses an optional RFC 3339 time.
+func (p *envParser) timestamp(key string) time.Time {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		p.fail("%s must be an RFC 3339 time like 2025-01-01T00:00:00Z, got %q", key, raw)
+	}
+	return t
+}
+
+// seconds parses a positive whole number of seconds.
+func (p *envParser) seconds(key string, def int) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return time.Duration(def) * time.Second
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		p.fail("%s must be a positive number of seconds, got %q", key, raw)
+		return time.Duration(def) * time.Second
+	}
+	return time.Duration(n) * time.Second
+}
+
+// location loads an IANA time zone such as Asia/Tehran.
+func (p *envParser) location(key, def string) *time.Location {
+	name := envOrDefault(key, def)
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		p.fail("%s must be an IANA time zone name, got %q", key, name)
+		return time.UTC
+	}
+	return loc
+}
+
+func (p *envParser) bool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.fail("%s must be true or false, got %q", key, raw)
+		return def
+	}
+	return b
+}
+
+func (p *envParser) oneOf(key, def string, allowed ...string) string {
+	v := envOrDefault(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	p.fail("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), v)
+	return def
+}
+
+// url requires an absolute http(s) URL when the variable is set.
+func (p *envParser) url(key, def string) string {
+	raw := envOrDefault(key, def)
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.fail("%s must be an http(s) URL, got %q", key, raw)
+	}
+	return raw
+}
+
+// headers decodes a JSON object of extra request headers, e.g.
+// {"Referer": "https://brsapi.ir/"}.
+func (p *envParser) headers(key string) map[string]string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		p.fail("%s must be a JSON object of header names to values: %v", key, err)
+	}
+	return headers
+}
+
+// tags parses DogStatsD-style "env:prod,region:eu" global tags.
+func (p *envParser) tags(key string) map[string]string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	tags := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || k == "" {
+			p.fail("%s entry %q must look like key:value", key, pair)
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// socks5 parses socks5://[user:pass@]host:port.
+func (p *envParser) socks5(key string) *url.URL {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "socks5" || u.Host == "" {
+		p.fail("%s must look like socks5://host:port", key)
+		return nil
+	}
+	return u
+}
+
+// dnsServer normalizes host[:port], defaulting the port to 53.
+func (p *envParser) dnsServer(key string) string {
+	server := os.Getenv(key)
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// pinnedIPs parses "BrsApi.ir=1.2.3.4,5.6.7.8;other.host=9.9.9.9" into
+// lower-cased hostnames.
+func (p *envParser) pinnedIPs(key string) map[string][]string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	pins := map[string][]string{}
+	for _, entry := range strings.Split(raw, ";") {
+		host, ips, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || host == "" {
+			p.fail("%s entry %q must look like host=ip[,ip]", key, entry)
+			continue
+		}
+		for _, ip := range strings.Split(ips, ",") {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				p.fail("%s: %q is not an IP address", key, ip)
+				continue
+			}
+			pins[strings.ToLower(host)] = append(pins[strings.ToLower(host)], ip)
+		}
+	}
+	return pins
+}
+
+// trackedSymbols parses "symbol=UPSTREAM[@url],..." where symbol is the
+// cache key, UPSTREAM the provider item symbol, and url an optional
+// endpoint other than BRS_API_URL, e.g.
+// "gold_18k=IR_GOLD_18K,usd=USD,btc=BTC@https://example.com/crypto.php".
+func (p *envParser) trackedSymbols(key, def string) []trackedSymbol {
+	var symbols []trackedSymbol
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(envOrDefault(key, def), ",") {
+		entry = strings.TrimSpace(entry)
+		symbol, upstream, ok := strings.Cut(entry, "=")
+		upstream, endpoint, _ := strings.Cut(upstream, "@")
+		if !ok || !validSymbol(symbol) || upstream == "" {
+			p.fail("%s entry %q must look like symbol=UPSTREAM[@url] with a lower-case symbol", key, entry)
+			continue
+		}
+		if seen[symbol] {
+			p.fail("%s lists %s twice", key, symbol)
+			continue
+		}
+		seen[symbol] = true
+		if endpoint != "" {
+			if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				p.fail("%s: %s endpoint must be an http(s) URL, got %q", key, symbol, endpoint)
+				continue
+			}
+		}
+		symbols = append(symbols, trackedSymbol{Symbol: symbol, Upstream: upstream, URL: endpoint})
+	}
+	return symbols
+}
+
+// fxQuotes parses "symbol:quote,..." into the Quote of tracked symbols
+// whose provider price is in another tracked currency rather than Toman,
+// e.g. "btc:usd" for a crypto section priced in dollars. A quote must be
+// Toman-priced itself.
+func (p *envParser) fxQuotes(key string, tracked []trackedSymbol) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return
+	}
+	index := map[string]int{}
+	for i, s := range tracked {
+		index[s.Symbol] = i
+	}
+	quotes := map[string]string{}
+	for _, part := range strings.Split(raw, ",") {
+		base, quote, ok := strings.Cut(strings.TrimSpace(part), ":")
+		_, baseTracked := index[base]
+		_, quoteTracked := index[quote]
+		if !ok || !baseTracked || !quoteTracked || base == quote {
+			p.fail("%s: %q must be symbol:quote with two different TRACKED_SYMBOLS", key, part)
+			continue
+		}
+		quotes[base] = quote
+	}
+	for base, quote := range quotes {
+		if _, chained := quotes[quote]; chained {
+			p.fail("%s: %s is quoted in %s, which is not priced in Toman", key, base, quote)
+			continue
+		}
+		tracked[index[base]].Quote = quote
+	}
+}
+
+// rounding parses "symbol=step[:nearest|down|up],...", e.g.
+// "gold_18k=1000,usd=100:down", with steps in Rial.
+func (p *envParser) rounding(key string) map[string]RoundingRule {
+	raw := os.Getenv(key)
+	out := map[string]RoundingRule{}
+	if raw == "" {
+		return out
+	}
+	for _, part := range strings.Split(raw, ",") {
+		symbol, rule, ok := strings.Cut(strings.TrimSpace(part), "=")
+		step, mode, _ := strings.Cut(rule, ":")
+		if mode == "" {
+			mode = roundNearest
+		}
+		n, err := strconv.ParseInt(step, 10, 64)
+		if !ok || !validSymbol(symbol) || err != nil || n < 1 || (mode != roundNearest && mode != roundDown && mode != roundUp) {
+			p.fail("%s: %q must look like symbol=step[:nearest|down|up] with a positive step", key, part)
+			continue
+		}
+		out[symbol] = RoundingRule{Step: n, Mode: mode}
+	}
+	return out
+}
+
+// marketClosures parses "day[ HH:MM-HH:MM],...", where day is a weekday
+// (sun..sat) or a date like 2026-03-20 and the hours default to the whole
+// day, e.g. "fri,thu 14:00-24:00,2026-03-20", in DAILY_CLOSE_TZ.
+func (p *envParser) marketClosures(key string) []marketClosure {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return nil
+	}
+	var out []marketClosure
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		day, hours, _ := strings.Cut(part, " ")
+		c := marketClosure{spec: part, day: strings.ToLower(day), from: 0, to: 24 * 60}
+		_, dateErr := time.Parse(time.DateOnly, day)
+		ok := dateErr == nil || slices.Contains(weekdayNames, c.day)
+		if hours != "" {
+			from, to, found := strings.Cut(hours, "-")
+			c.from, c.to = minuteOfDay(from), minuteOfDay(to)
+			ok = ok && found && c.from >= 0 && c.to > c.from
+		}
+		if !ok {
+			p.fail("%s: %q must look like fri, fri 14:00-24:00 or 2026-03-20", key, part)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// minuteOfDay parses HH:MM, allowing 24:00, or returns -1.
+func minuteOfDay(s string) int {
+	if s == "24:00" {
+		return 24 * 60
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return -1
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// featureFlags parses "name=on|off|<percent>%,...", e.g.
+// "convert=off,watchlists=25%". Names must be known flags.
+func (p *envParser) featureFlags(key string) map[string]FeatureFlag {
+	raw := os.Getenv(key)
+	out := map[string]FeatureFlag{}
+	if raw == "" {
+		return out
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if _, known := featureDefaults[name]; !ok || !known {
+			p.fail("%s: %q is not name=on|off|N%% for a known flag", key, part)
+			continue
+		}
+		f := FeatureFlag{Name: name, Enabled: true, RolloutPercent: 100, APIKeyIDs: []int64{}, Source: "env"}
+		switch value {
+		case "on":
+		case "off":
+			f.Enabled = false
+		default:
+			n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || !strings.HasSuffix(value, "%") || n < 0 || n > 100 {
+				p.fail("%s: %s must be on, off or a percentage like 25%%, got %q", key, name, value)
+				continue
+			}
+			f.RolloutPercent = n
+		}
+		out[name] = f
+	}
+	return out
+}
+
+// validSymbol accepts cache keys like gold_18k: lower-case letters, digits
+// and underscores.
+func validSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// configDocumentVersion is bumped when ConfigDocument changes shape.
+const configDocumentVersion = 1
+
+// exportedEnv are the non-secret settings shipped with a config export.
+// Thresholds and alert rules are set in the environment, so an import only
+// reports where they differ; they have to be changed in the deployment.
+var exportedEnv = []string{
+	"TRACKED_SYMBOLS", "FX_QUOTES", "POLL_INTERVAL", "REFRESH_MIN_INTERVAL",
+	"POLLER_WATCHDOG_MULTIPLE", "CANARY_MIN_SAMPLES", "CANARY_MAX_DIFF_BPS",
+	"FEATURE_FLAGS", "API_KEY_MODE", "DAILY_CLOSE_TZ", "PRICE_ROUNDING",
+	"CRYPTO_QUOTE_SYMBOLS", "TELEGRAM_SYMBOLS", "TELEGRAM_CHANGE_BPS",
+	"TELEGRAM_POST_INTERVAL", "RATE_LOCK_DEFAULT_MINUTES", "RATE_LOCK_MAX_MINUTES",
+	"GAP_THRESHOLD", "MARKET_CLOSURES", "RATE_LIMIT_REQUESTS", "RATE_LIMIT_WINDOW",
+	"ABUSE_MAX_ERRORS", "ABUSE_WINDOW", "ABUSE_BAN_DURATION",
+	"HONEYPOT_PATHS", "SCRAPER_FLAG_DURATION", "SCRAPER_RATE_LIMIT_REQUESTS",
+	"JSON_FIELD_CASE",
+}
+
+// ConfigDocument is the runtime configuration kept in the database, plus
+// the settings in exportedEnv that are set. API keys are metadata only:
+// their secrets are never stored, so keys can't be cloned.
+type ConfigDocument struct {
+	Version     int               `json:"version"`
+	ExportedAt  string            `json:"exportedAt,omitempty"`
+	Symbols     []SymbolState     `json:"symbols"`
+	Aliases     []SymbolAlias     `json:"aliases"`
+	Flags       []FeatureFlag     `json:"flags"`
+	IPRules     IPRules           `json:"ipRules"`
+	APIKeys     []APIKey          `json:"apiKeys"`
+	Environment map[string]string `json:"environment"`
+}
+
+// readConfigDocument collects the current configuration.
+func readConfigDocument(ctx context.Context) (*ConfigDocument, error) {
+	doc := &ConfigDocument{
+		Version: configDocumentVersion, Symbols: []SymbolState{}, Aliases: []SymbolAlias{},
+		Flags: []FeatureFlag{}, APIKeys: []APIKey{}, Environment: map[string]string{},
+	}
+	rows, err := database.QueryContext(ctx, "SELECT symbol, active, deactivated_at, reason FROM symbols ORDER BY symbol")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var s SymbolState
+		if err := rows.Scan(&s.Symbol, &s.Active, &s.DeactivatedAt, &s.Reason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		doc.Symbols = append(doc.Symbols, s)
+	}
+	rows.Close()
+
+	rows, err = database.QueryContext(ctx, "SELECT alias, symbol, created_at FROM symbol_aliases ORDER BY alias")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var a SymbolAlias
+		if err := rows.Scan(&a.Alias, &a.Symbol, &a.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		doc.Aliases = append(doc.Aliases, a)
+	}
+	rows.Close()
+
+	rows, err = database.QueryContext(ctx, "SELECT name, enabled, rollout_percent, api_key_ids, updated_at FROM feature_flags ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		f := FeatureFlag{Source: "db"}
+		var ids string
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.RolloutPercent, &ids, &f.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		json.Unmarshal([]byte(ids), &f.APIKeyIDs)
+		doc.Flags = append(doc.Flags, f)
+	}
+	rows.Close()
+
+	rows, err = database.QueryContext(ctx, "SELECT id, name, prefix, refresh_interval_seconds, rate_limit_requests, admin_role, created_at, revoked_at FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.RefreshIntervalSeconds, &k.RateLimitRequests, &k.AdminRole, &k.CreatedAt, &k.RevokedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		doc.APIKeys = append(doc.APIKeys, k)
+	}
+	rows.Close()
+
+	if doc.IPRules, err = readIPRules(ctx); err != nil {
+		return nil, err
+	}
+	for _, name := range exportedEnv {
+		if v := os.Getenv(name); v != "" {
+			doc.Environment[name] = v
+		}
+	}
+	return doc, nil
+}
+
+// handleExportConfig serves GET /admin/config/export: the configuration as
+// one JSON document, to check into a repository or clone an environment
+// with PUT.
+func handleExportConfig(w http.ResponseWriter, r *http.Request) {
+	doc, err := readConfigDocument(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	doc.ExportedAt = clock.Now().UTC().Format(time.RFC3339)
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// handleImportConfig serves PUT /admin/config/export with a document from
+// GET. Each database section present in the body (symbols, aliases,
+// flags, ipRules) replaces the stored one; omitted sections are kept.
+// Everything is validated first and written in one transaction. apiKeys
+// and environment are not written; the response warns where they differ
+// from this instance.
+func handleImportConfig(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "configuration is read-only on a replica; change it on the primary")
+		return
+	}
+	var req struct {
+		Version     int               `json:"version"`
+		Symbols     *[]SymbolState    `json:"symbols"`
+		Aliases     *[]SymbolAlias    `json:"aliases"`
+		Flags       *[]FeatureFlag    `json:"flags"`
+		IPRules     *IPRules          `json:"ipRules"`
+		APIKeys     []APIKey          `json:"apiKeys"`
+		Environment map[string]string `json:"environment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<22)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON document from GET /admin/config/export")
+		return
+	}
+	if req.Version != configDocumentVersion {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported document version %d; this service reads version %d", req.Version, configDocumentVersion))
+		return
+	}
+	if err := validateConfigImport(req.Symbols, req.Aliases, req.Flags, req.IPRules); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	before, err := readConfigDocument(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	tx, err := database.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+	var stmts [][]any
+	if req.Symbols != nil {
+		stmts = append(stmts, []any{"DELETE FROM symbols"})
+		for _, s := range *req.Symbols {
+			at := s.DeactivatedAt
+			if s.Active {
+				at = ""
+			} else if at == "" {
+				at = now
+			}
+			stmts = append(stmts, []any{"INSERT OR REPLACE INTO symbols (symbol, active, deactivated_at, reason) VALUES (?, ?, ?, ?)", s.Symbol, s.Active, at, s.Reason})
+		}
+	}
+	if req.Aliases != nil {
+		stmts = append(stmts, []any{"DELETE FROM symbol_aliases"})
+		for _, a := range *req.Aliases {
+			stmts = append(stmts, []any{"INSERT OR REPLACE INTO symbol_aliases (alias, symbol, created_at) VALUES (?, ?, ?)", a.Alias, a.Symbol, now})
+		}
+	}
+	if req.Flags != nil {
+		stmts = append(stmts, []any{"DELETE FROM feature_flags"})
+		for _, f := range *req.Flags {
+			if f.APIKeyIDs == nil {
+				f.APIKeyIDs = []int64{}
+			}
+			ids, _ := json.Marshal(f.APIKeyIDs)
+			stmts = append(stmts, []any{"INSERT OR REPLACE INTO feature_flags (name, enabled, rollout_percent, api_key_ids, updated_at) VALUES (?, ?, ?, ?, ?)", f.Name, f.Enabled, f.RolloutPercent, string(ids), now})
+		}
+	}
+	if req.IPRules != nil {
+		stmts = append(stmts, []any{"DELETE FROM ip_rules"})
+		for action, cidrs := range map[string][]string{"allow": req.IPRules.Allow, "deny": req.IPRules.Deny} {
+			for _, cidr := range cidrs {
+				stmts = append(stmts, []any{"INSERT OR IGNORE INTO ip_rules (cidr, action) VALUES (?, ?)", cidr, action})
+			}
+		}
+	}
+	for _, s := range stmts {
+		if _, err := tx.ExecContext(r.Context(), s[0].(string), s[1:]...); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	reloadAfterWrite(r)
+	if err := loadFlags(r.Context()); err != nil {
+		logf(r.Context(), "[flags] Reload after change failed: %v", err)
+	}
+
+	after, err := readConfigDocument(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	warnings := configImportWarnings(after, req.APIKeys, req.Environment)
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] Configuration imported: %d symbols, %d aliases, %d flags, %d allow, %d deny, %d warnings",
+		len(after.Symbols), len(after.Aliases), len(after.Flags), len(after.IPRules.Allow), len(after.IPRules.Deny), len(warnings))
+	writeJSON(w, http.StatusOK, map[string]any{"config": after, "warnings": warnings})
+}
+
+// validateConfigImport checks the sections of an import that will be
+// written, normalizing IP rules in place.
+func validateConfigImport(symbols *[]SymbolState, aliases *[]SymbolAlias, flagRules *[]FeatureFlag, ipRules *IPRules) error {
+	if symbols != nil {
+		for _, s := range *symbols {
+			if !validSymbol(s.Symbol) {
+				return fmt.Errorf("symbol %q must be lower-case letters, digits and underscores", s.Symbol)
+			}
+		}
+	}
+	if aliases != nil {
+		for _, a := range *aliases {
+			if !validSymbol(a.Alias) || a.Alias == "18k" || !validSymbol(a.Symbol) {
+				return fmt.Errorf("alias %q of %q is not a valid alias", a.Alias, a.Symbol)
+			}
+		}
+	}
+	if flagRules != nil {
+		for _, f := range *flagRules {
+			if _, ok := featureDefaults[f.Name]; !ok {
+				return fmt.Errorf("unknown feature flag %s", f.Name)
+			}
+			if f.RolloutPercent < 0 || f.RolloutPercent > 100 {
+				return fmt.Errorf("feature flag %s: rolloutPercent must be between 0 and 100", f.Name)
+			}
+		}
+	}
+	if ipRules != nil {
+		for _, list := range []*[]string{&ipRules.Allow, &ipRules.Deny} {
+			for i, s := range *list {
+				cidr, err := normalizeCIDR(strings.TrimSpace(s))
+				if err != nil {
+					return err
+				}
+				(*list)[i] = cidr
+			}
+		}
+	}
+	return nil
+}
+
+// configImportWarnings lists what an import couldn't apply: API keys this
+// instance lacks, flag rules naming them by ID (IDs differ between
+// instances), and environment settings that differ from the document.
+func configImportWarnings(doc *ConfigDocument, keys []APIKey, env map[string]string) []string {
+	warnings := []string{}
+	have := map[string]bool{}
+	for _, k := range doc.APIKeys {
+		have[k.Prefix] = true
+	}
+	for _, k := range keys {
+		if k.RevokedAt == "" && !have[k.Prefix] {
+			warnings = append(warnings, fmt.Sprintf("API key %s (%s) is not on this instance; create it with POST /admin/api-keys", k.Prefix, k.Name))
+		}
+	}
+	ids := map[int64]bool{}
+	for _, k := range doc.APIKeys {
+		ids[k.ID] = true
+	}
+	for _, f := range doc.Flags {
+		for _, id := range f.APIKeyIDs {
+			if !ids[id] {
+				warnings = append(warnings, fmt.Sprintf("feature flag %s names API key %d, which is not on this instance", f.Name, id))
+			}
+		}
+	}
+	for _, name := range exportedEnv {
+		if env[name] != doc.Environment[name] {
+			warnings = append(warnings, fmt.Sprintf("%s is %q here but %q in the document; set it in the environment", name, doc.Environment[name], env[name]))
+		}
+	}
+	return warnings
+}
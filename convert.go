@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rialSymbol is the pivot every cached price is quoted in; it can be used
+// as either side of a conversion.
+const rialSymbol = "irr"
+
+// ConversionRate is a cached price used by a conversion.
+type ConversionRate struct {
+	Symbol    string `json:"symbol"`
+	PriceRial int64  `json:"priceRial"`
+	FetchedAt string `json:"fetchedAt"`
+	Stale     bool   `json:"stale"`
+}
+
+// FXPair is a provider's own rate between two tracked symbols, stored for
+// items priced in another currency (FX_QUOTES): one Base is Rate Quote.
+type FXPair struct {
+	Base      string  `json:"base"`
+	Quote     string  `json:"quote"`
+	Rate      float64 `json:"rate"`
+	FetchedAt string  `json:"fetchedAt"`
+	Stale     bool    `json:"stale"`
+}
+
+// recordPair stores a pair's latest rate inside the poll transaction.
+func recordPair(ctx context.Context, tx *sql.Tx, p FXPair, at time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO fx_pairs (base, quote, rate, fetched_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(base, quote) DO UPDATE SET rate = excluded.rate, fetched_at = excluded.fetched_at
+	`, p.Base, p.Quote, p.Rate, at.UTC().Format(time.RFC3339))
+	return err
+}
+
+// rateEdge is one step of the rates graph: one unit of the node it leaves
+// is rate units of to. Exactly one of price or pair says where it came
+// from.
+type rateEdge struct {
+	to    string
+	rate  float64
+	price *ConversionRate
+	pair  *FXPair
+}
+
+// ratesGraph links every active cached symbol to irr through its Rial price, and
+// the two sides of every stored pair directly. Pair edges are listed
+// first, so among equally short paths the provider's own rates win over
+// crossing through Rial.
+func ratesGraph(ctx context.Context) (map[string][]rateEdge, error) {
+	graph := map[string][]rateEdge{}
+	rows, err := database.QueryContext(ctx, "SELECT base, quote, rate, fetched_at FROM fx_pairs WHERE rate > 0")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		p := &FXPair{}
+		if err := rows.Scan(&p.Base, &p.Quote, &p.Rate, &p.FetchedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fetchedAt, _ := time.Parse(time.RFC3339, p.FetchedAt)
+		p.Stale = clockSince(fetchedAt) > staleThreshold
+		graph[p.Base] = append(graph[p.Base], rateEdge{to: p.Quote, rate: p.Rate, pair: p})
+		graph[p.Quote] = append(graph[p.Quote], rateEdge{to: p.Base, rate: 1 / p.Rate, pair: p})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.QueryContext(ctx, `
+		SELECT symbol, p.price_rial, p.fetched_at FROM gold_prices p
+		LEFT JOIN symbols s USING (symbol)
+		WHERE p.price_rial > 0 AND COALESCE(s.active, 1) = 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &ConversionRate{}
+		if err := rows.Scan(&c.Symbol, &c.PriceRial, &c.FetchedAt); err != nil {
+			return nil, err
+		}
+		fetchedAt, _ := time.Parse(time.RFC3339, c.FetchedAt)
+		c.Stale = clockSince(fetchedAt) > staleThreshold
+		graph[c.Symbol] = append(graph[c.Symbol], rateEdge{to: rialSymbol, rate: float64(c.PriceRial), price: c})
+		graph[rialSymbol] = append(graph[rialSymbol], rateEdge{to: c.Symbol, rate: 1 / float64(c.PriceRial), price: c})
+	}
+	return graph, rows.Err()
+}
+
+// shortestRatePath finds the path from one node to another with the
+// fewest steps, or nil if none.
+func shortestRatePath(graph map[string][]rateEdge, from, to string) []rateEdge {
+	if from == to {
+		return []rateEdge{}
+	}
+	type step struct {
+		prev string
+		edge rateEdge
+	}
+	reached := map[string]step{from: {}}
+	queue := []string{from}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, e := range graph[node] {
+			if _, seen := reached[e.to]; seen {
+				continue
+			}
+			reached[e.to] = step{prev: node, edge: e}
+			if e.to != to {
+				queue = append(queue, e.to)
+				continue
+			}
+			var path []rateEdge
+			for n := to; n != from; n = reached[n].prev {
+				path = append([]rateEdge{reached[n].edge}, path...)
+			}
+			return path
+		}
+	}
+	return nil
+}
+
+// Conversion is amount units of From expressed in To, with the path
+// taken and the cached prices and pair rates it used.
+type Conversion struct {
+	From   string           `json:"from"`
+	To     string           `json:"to"`
+	Amount float64          `json:"amount"`
+	Result float64          `json:"result"`
+	Rate   float64          `json:"rate"`
+	Path   []string         `json:"path"`
+	Rates  []ConversionRate `json:"rates"`
+	Pairs  []FXPair         `json:"pairs"`
+}
+
+// convertAlong converts amount from one node to another over the shortest
+// path, or returns nil if the graph doesn't connect them.
+func convertAlong(graph map[string][]rateEdge, from, to string, amount float64) *Conversion {
+	edges := shortestRatePath(graph, from, to)
+	if edges == nil {
+		return nil
+	}
+	c := &Conversion{From: from, To: to, Amount: amount, Rate: 1, Path: []string{from}, Rates: []ConversionRate{}, Pairs: []FXPair{}}
+	for _, e := range edges {
+		c.Rate *= e.rate
+		c.Path = append(c.Path, e.to)
+		if e.price != nil {
+			c.Rates = append(c.Rates, *e.price)
+		} else {
+			c.Pairs = append(c.Pairs, *e.pair)
+		}
+	}
+	c.Result = amount * c.Rate
+	return c
+}
+
+// handleConvert serves GET /api/convert?from=gold_18k&to=usd&amount=10:
+// amount units of from expressed in to, along the shortest path through
+// the rates graph. The path and the cached prices and pair rates it used
+// are returned with their fetch times, so callers can see how the result
+// was reached and judge how current it is.
+func handleConvert(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	from, to := qp.str("from", ""), qp.str("to", "")
+	if from == "" {
+		qp.fail("from", "from is required")
+	}
+	if to == "" {
+		qp.fail("to", "to is required")
+	}
+	amount := 1.0
+	if v := qp.q.Get("amount"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(n > 0) || math.IsInf(n, 0) {
+			qp.fail("amount", "amount must be a positive number")
+		}
+		amount = n
+	}
+	if !qp.valid(w) {
+		return
+	}
+
+	graph, err := ratesGraph(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, symbol := range []string{from, to} {
+		if _, ok := graph[symbol]; !ok && symbol != rialSymbol {
+			writeError(w, http.StatusNotFound, "no cached price for "+symbol)
+			return
+		}
+	}
+	c := convertAlong(graph, from, to, amount)
+	if c == nil {
+		writeError(w, http.StatusNotFound, "no rates path from "+from+" to "+to)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// handleGoldInCrypto serves GET /api/gold/18k/crypto: one gram of 18k
+// gold in each of CRYPTO_QUOTE_SYMBOLS, converted like /api/convert.
+// Configured assets without a cached price are listed in missing.
+func handleGoldInCrypto(w http.ResponseWriter, r *http.Request) {
+	graph, err := ratesGraph(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, ok := graph["gold_18k"]; !ok {
+		writeError(w, http.StatusServiceUnavailable, "no cached price yet")
+		return
+	}
+	prices, missing := []*Conversion{}, []string{}
+	for _, asset := range cfg.CryptoQuoteSymbols {
+		if c := convertAlong(graph, "gold_18k", asset, 1); c != nil {
+			prices = append(prices, c)
+		} else {
+			missing = append(missing, asset)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"symbol":  "gold_18k",
+		"prices":  prices,
+		"missing": missing,
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// DailyClose is a symbol's last fetched price of a local day
+// (DAILY_CLOSE_TZ).
+type DailyClose struct {
+	Day   string `json:"day"`
+	Price int64  `json:"price"`
+}
+
+// upsertCloseSQL sets the close of a local day to the latest tick, so the
+// row is final once the day ends with no job needed at midnight.
+// Arguments: symbol, day, price, closed_at. It runs in the poll cycle's
+// transaction (pollStatements.upsertClose).
+const upsertCloseSQL = `
+	INSERT INTO daily_closes (symbol, day, close_rial, closed_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(symbol, day) DO UPDATE SET
+		close_rial = excluded.close_rial,
+		closed_at = excluded.closed_at
+	WHERE excluded.closed_at >= daily_closes.closed_at`
+
+// closeDay is the local calendar day t falls in.
+func closeDay(t time.Time) string {
+	return t.In(cfg.DailyCloseTZ).Format(time.DateOnly)
+}
+
+// recordClose updates symbol's close for the day of at inside tx.
+func recordClose(ctx context.Context, tx *sql.Tx, symbol string, priceRial int64, at time.Time) error {
+	_, err := tx.StmtContext(ctx, pollStatements.upsertClose).ExecContext(ctx,
+		symbol, closeDay(at), priceRial, at.UTC().Format(time.RFC3339))
+	return err
+}
+
+// previousClose returns symbol's close on the last day before the one now
+// falls in, usually yesterday, or nil without one. It is a primary-key
+// lookup, not a scan of the day's candles.
+func previousClose(ctx context.Context, symbol string, now time.Time) (*DailyClose, error) {
+	var c DailyClose
+	err := database.QueryRowContext(ctx, `
+		SELECT day, close_rial FROM daily_closes
+		WHERE symbol = ? AND day < ?
+		ORDER BY day DESC LIMIT 1
+	`, symbol, closeDay(now)).Scan(&c.Day, &c.Price)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// changeSince fills the verbose response's change fields against the
+// previous close, from the raw price. They stay nil without one.
+func (v *GoldPriceVerbose) changeSince(prev *DailyClose) {
+	v.PreviousClose = prev
+	if prev == nil || prev.Price == 0 {
+		return
+	}
+	price := v.Price
+	if v.PriceRaw != nil {
+		price = *v.PriceRaw
+	}
+	change := price - prev.Price
+	pct := math.Round(float64(change)/float64(prev.Price)*10000) / 100
+	v.Change, v.ChangePercent = &change, &pct
+}
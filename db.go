@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations are applied in order and PRAGMA user_version records how
+// many have run. Append only — never edit an entry that has shipped.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS gold_prices (
+		symbol     TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		price_rial INTEGER NOT NULL,
+		fetched_at TEXT NOT NULL
+	)`,
+	`ALTER TABLE gold_prices ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE gold_prices ADD COLUMN fetch_duration_ms INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE gold_prices ADD COLUMN attempt INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS shadow_quotes (
+		id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+		provider           TEXT NOT NULL,
+		symbol             TEXT NOT NULL,
+		price_rial         INTEGER,
+		primary_price_rial INTEGER,
+		error              TEXT NOT NULL DEFAULT '',
+		fetched_at         TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_shadow_quotes_provider_time ON shadow_quotes (provider, fetched_at)`,
+	`CREATE TABLE IF NOT EXISTS fetch_log (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		provider    TEXT NOT NULL,
+		started_at  TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		ok          INTEGER NOT NULL,
+		error_class TEXT NOT NULL DEFAULT '',
+		error       TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_fetch_log_started ON fetch_log (started_at)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		at          TEXT NOT NULL,
+		request_id  TEXT NOT NULL,
+		actor       TEXT NOT NULL,
+		remote_addr TEXT NOT NULL,
+		method      TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		query       TEXT NOT NULL DEFAULT '',
+		status      INTEGER NOT NULL,
+		before      TEXT NOT NULL DEFAULT '',
+		after       TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key          TEXT PRIMARY KEY,
+		fingerprint  TEXT NOT NULL,
+		status       INTEGER NOT NULL,
+		content_type TEXT NOT NULL DEFAULT '',
+		body         BLOB NOT NULL,
+		created_at   TEXT NOT NULL
+	)`,
+	`ALTER TABLE gold_prices ADD COLUMN manual_override INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS symbols (
+		symbol         TEXT PRIMARY KEY,
+		active         INTEGER NOT NULL DEFAULT 1,
+		deactivated_at TEXT NOT NULL DEFAULT '',
+		reason         TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS freshness_samples (
+		symbol     TEXT NOT NULL,
+		sampled_at TEXT NOT NULL,
+		fresh      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_freshness_samples_time ON freshness_samples (sampled_at)`,
+	`CREATE TABLE IF NOT EXISTS candles (
+		symbol       TEXT NOT NULL,
+		resolution   TEXT NOT NULL,
+		bucket_start TEXT NOT NULL,
+		open         INTEGER NOT NULL,
+		high         INTEGER NOT NULL,
+		low          INTEGER NOT NULL,
+		close        INTEGER NOT NULL,
+		samples      INTEGER NOT NULL,
+		PRIMARY KEY (symbol, resolution, bucket_start)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_candles_symbol_time ON candles (symbol, bucket_start)`,
+	`CREATE TABLE IF NOT EXISTS record_events (
+		id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+		symbol              TEXT NOT NULL,
+		kind                TEXT NOT NULL,
+		price_rial          INTEGER NOT NULL,
+		at                  TEXT NOT NULL,
+		previous_price_rial INTEGER NOT NULL,
+		previous_at         TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_anomalies (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		symbol      TEXT NOT NULL,
+		kind        TEXT NOT NULL,
+		price_rial  INTEGER NOT NULL,
+		observed_at TEXT NOT NULL,
+		detail      TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS daily_closes (
+		symbol     TEXT NOT NULL,
+		day        TEXT NOT NULL,
+		close_rial INTEGER NOT NULL,
+		closed_at  TEXT NOT NULL,
+		PRIMARY KEY (symbol, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS watchlists (
+		owner      TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		symbols    TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (owner, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id                       INTEGER PRIMARY KEY AUTOINCREMENT,
+		key_hash                 TEXT NOT NULL UNIQUE,
+		name                     TEXT NOT NULL,
+		prefix                   TEXT NOT NULL,
+		refresh_interval_seconds INTEGER,
+		created_at               TEXT NOT NULL,
+		revoked_at               TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS ip_rules (
+		cidr   TEXT NOT NULL,
+		action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+		PRIMARY KEY (cidr, action)
+	)`,
+	`CREATE TABLE IF NOT EXISTS feature_flags (
+		name            TEXT PRIMARY KEY,
+		enabled         INTEGER NOT NULL,
+		rollout_percent INTEGER NOT NULL,
+		api_key_ids     TEXT NOT NULL,
+		updated_at      TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS canary_reports (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		candidate  TEXT NOT NULL,
+		active     TEXT NOT NULL,
+		ready      INTEGER NOT NULL,
+		report     TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS symbol_fetch_status (
+		symbol               TEXT PRIMARY KEY,
+		ok                   INTEGER NOT NULL,
+		last_attempt_at      TEXT NOT NULL,
+		last_success_at      TEXT NOT NULL DEFAULT '',
+		consecutive_failures INTEGER NOT NULL DEFAULT 0,
+		error_class          TEXT NOT NULL DEFAULT '',
+		error                TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS telegram_posts (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		posted_at  TEXT NOT NULL,
+		reason     TEXT NOT NULL,
+		prices     TEXT NOT NULL,
+		message_id INTEGER NOT NULL DEFAULT 0,
+		error      TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS sheets_exports (
+		symbol      TEXT NOT NULL,
+		day         TEXT NOT NULL,
+		exported_at TEXT NOT NULL,
+		PRIMARY KEY (symbol, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS file_deliveries (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		scheduled_for TEXT NOT NULL DEFAULT '',
+		started_at    TEXT NOT NULL,
+		file          TEXT NOT NULL,
+		rows          INTEGER NOT NULL DEFAULT 0,
+		bytes         INTEGER NOT NULL DEFAULT 0,
+		duration_ms   INTEGER NOT NULL DEFAULT 0,
+		error         TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_snapshots (
+		owner      TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		note       TEXT NOT NULL DEFAULT '',
+		prices     TEXT NOT NULL,
+		PRIMARY KEY (owner, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS fx_pairs (
+		base       TEXT NOT NULL,
+		quote      TEXT NOT NULL,
+		rate       REAL NOT NULL,
+		fetched_at TEXT NOT NULL,
+		PRIMARY KEY (base, quote)
+	)`,
+	`ALTER TABLE gold_prices ADD COLUMN buy_rial INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE gold_prices ADD COLUMN sell_rial INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS symbol_aliases (
+		alias      TEXT PRIMARY KEY,
+		symbol     TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS history_gaps (
+		symbol       TEXT NOT NULL,
+		start_at     TEXT NOT NULL,
+		end_at       TEXT NOT NULL,
+		open_seconds INTEGER NOT NULL,
+		ongoing      INTEGER NOT NULL,
+		reason       TEXT NOT NULL,
+		detail       TEXT NOT NULL,
+		detected_at  TEXT NOT NULL,
+		PRIMARY KEY (symbol, start_at)
+	)`,
+	`ALTER TABLE candles ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE history_gaps ADD COLUMN backfilled_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE history_gaps ADD COLUMN backfilled_rows INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE api_keys ADD COLUMN admin_role TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE api_keys ADD COLUMN rate_limit_requests INTEGER`,
+}
+
+// migrate brings the schema up to date.
+func migrate() error {
+	var version int
+	if err := database.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version failed: %w", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("recording migration %d failed: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if version < len(migrations) {
+		log.Printf("[db] Schema migrated from version %d to %d", version, len(migrations))
+	}
+	return nil
+}
+
+// sqliteDSN builds the connection string for c.DBPath. The pragmas are set
+// per connection: busy_timeout makes concurrent writers (poller, shadow,
+// fetch log) and readers wait instead of failing with SQLITE_BUSY;
+// synchronous=NORMAL is durable enough under WAL; cache_size is negative
+// to mean KiB.
+//
+// DB_DRIVER=memory opens the same schema in SQLite's memdb VFS instead: a
+// name starting with "/" is shared by every connection in the process and
+// never touches disk. It is dropped when the last connection closes, so
+// the pool must keep one idle.
+func sqliteDSN(c Config) string {
+	path := c.DBPath
+	if c.DBDriver == "memory" {
+		path = "/gold.db?vfs=memdb&"
+	} else {
+		path += "?"
+	}
+	dsn := fmt.Sprintf("file:%s_pragma=busy_timeout(%d)&_pragma=synchronous(%s)&_pragma=cache_size(-%d)",
+		path, c.SQLiteBusyTimeout.Milliseconds(), c.SQLiteSynchronous, c.SQLiteCacheSizeKB)
+	if c.Mode == "replica" || c.DryRun && c.DBDriver == "sqlite" {
+		dsn += "&mode=ro"
+	}
+	return dsn
+}
+
+// pollStatements are prepared once at startup and reused by every poll
+// cycle inside its transaction (tx.StmtContext), instead of re-parsing the
+// SQL for each symbol on each cycle.
+var pollStatements struct {
+	upsertPrice *sql.Stmt
+	upsertTick  *sql.Stmt
+	upsertClose *sql.Stmt
+}
+
+// preparePollStatements prepares pollStatements. Primary mode only: the
+// statements write.
+func preparePollStatements() error {
+	var err error
+	if pollStatements.upsertPrice, err = database.Prepare(upsertPriceSQL); err != nil {
+		return fmt.Errorf("preparing price upsert: %w", err)
+	}
+	if pollStatements.upsertTick, err = database.Prepare(upsertTickSQL); err != nil {
+		return fmt.Errorf("preparing tick upsert: %w", err)
+	}
+	if pollStatements.upsertClose, err = database.Prepare(upsertCloseSQL); err != nil {
+		return fmt.Errorf("preparing daily close upsert: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// upstreamDecodeStrict, set by UPSTREAM_DECODE=strict, makes any item
+// field of the wrong type fail the whole response, as before tolerant
+// decoding existed.
+var upstreamDecodeStrict bool
+
+// UnmarshalJSON decodes an item tolerantly: a price may be a number or a
+// numeric string with thousands separators or Persian digits, and a
+// non-string name is dropped, as is a buy or sell side that isn't a
+// price. An item whose symbol is missing or whose symbol or price can't
+// be read still decodes, with the reason in malformed, so only a wanted
+// symbol being malformed fails the poll. In strict mode a field of the
+// wrong type is a decode error.
+func (it *BrsApiItem) UnmarshalJSON(data []byte) error {
+	if upstreamDecodeStrict {
+		type plain BrsApiItem
+		return json.Unmarshal(data, (*plain)(it))
+	}
+	var raw struct {
+		Symbol json.RawMessage `json:"symbol"`
+		Name   json.RawMessage `json:"name"`
+		Price  json.RawMessage `json:"price"`
+		Buy    json.RawMessage `json:"buy"`
+		Sell   json.RawMessage `json:"sell"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw.Symbol, &it.Symbol); err != nil && raw.Symbol != nil {
+		it.malformed = fmt.Sprintf("symbol %s is not a string", raw.Symbol)
+		return nil
+	}
+	if it.Symbol == "" {
+		it.malformed = "no symbol"
+		return nil
+	}
+	if json.Unmarshal(raw.Name, &it.Name) != nil {
+		it.Name = ""
+	}
+	price, coerced, err := decodePrice(raw.Price)
+	if err != nil {
+		it.malformed = err.Error()
+		return nil
+	}
+	it.Price, it.coerced = price, coerced
+	it.Buy, _, _ = decodePrice(raw.Buy)
+	it.Sell, _, _ = decodePrice(raw.Sell)
+	return nil
+}
+
+// decodePrice reads a JSON number, or a string like "4,300,000" or
+// "۴۳۰۰۰۰۰", reporting whether it had to coerce a string. A missing or
+// null price is 0, which validation treats as "no price".
+func decodePrice(raw json.RawMessage) (price float64, coerced bool, err error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, false, nil
+	}
+	if raw[0] != '"' {
+		if err := json.Unmarshal(raw, &price); err != nil {
+			return 0, false, fmt.Errorf("price %s is not a number", raw)
+		}
+		return price, false, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, false, fmt.Errorf("price %s is not a number", raw)
+	}
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '۰' && r <= '۹': // Persian digits
+			return '0' + (r - '۰')
+		case r >= '٠' && r <= '٩': // Arabic-Indic digits
+			return '0' + (r - '٠')
+		case r == ',', r == '٬', r == ' ':
+			return -1
+		case r == '٫': // Arabic decimal separator
+			return '.'
+		}
+		return r
+	}, s)
+	price, err = strconv.ParseFloat(cleaned, 64)
+	if err != nil || math.IsNaN(price) || math.IsInf(price, 0) {
+		return 0, false, fmt.Errorf("price %q is not a number", s)
+	}
+	return price, true, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fileDelivery writes a CSV snapshot of the cached prices to DELIVERY_URL
+// at each of DELIVERY_TIMES (local to DAILY_CLOSE_TZ), for systems that
+// only ingest flat files. Files are written under a temporary name and
+// renamed, so a reader never sees a partial file. Every run is recorded
+// in file_deliveries; a failed run is not retried until the next slot.
+type fileDelivery struct {
+	dest  *url.URL
+	times []int // minutes after local midnight, ascending
+	mu    sync.Mutex
+}
+
+// delivery is nil unless DELIVERY_URL is set.
+var delivery *fileDelivery
+
+func newFileDelivery(c Config) (*fileDelivery, error) {
+	if c.DeliveryURL == "" {
+		return nil, nil
+	}
+	dest, _ := url.Parse(c.DeliveryURL)
+	return &fileDelivery{dest: dest, times: c.DeliveryTimes}, nil
+}
+
+// next returns the first delivery slot after t.
+func (d *fileDelivery) next(t time.Time) time.Time {
+	local := t.In(cfg.DailyCloseTZ)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, cfg.DailyCloseTZ)
+	for day := 0; day < 2; day++ {
+		for _, m := range d.times {
+			slot := time.Date(midnight.Year(), midnight.Month(), midnight.Day()+day, m/60, m%60, 0, 0, cfg.DailyCloseTZ)
+			if slot.After(t) {
+				return slot
+			}
+		}
+	}
+	return midnight.AddDate(0, 0, 2)
+}
+
+// run delivers at each slot until ctx is done.
+func (d *fileDelivery) run(ctx context.Context) {
+	for {
+		slot := d.next(clock.Now())
+		timer := time.NewTimer(clock.Real(slot.Sub(clock.Now())))
+		select {
+		case <-timer.C:
+			d.deliver(ctx, slot)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Delivery is a row of file_deliveries.
+type Delivery struct {
+	ID           int64  `json:"id"`
+	ScheduledFor string `json:"scheduledFor,omitempty"`
+	StartedAt    string `json:"startedAt"`
+	File         string `json:"file"`
+	Rows         int    `json:"rows"`
+	Bytes        int    `json:"bytes"`
+	DurationMs   int64  `json:"durationMs"`
+	Error        string `json:"error,omitempty"`
+}
+
+// deliver writes one snapshot and records the attempt. slot is zero for a
+// manual run.
+func (d *fileDelivery) deliver(ctx context.Context, slot time.Time) *Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start := time.Now()
+	now := clock.Now()
+	rec := &Delivery{
+		StartedAt: now.UTC().Format(time.RFC3339),
+		File:      "gold-prices-" + now.In(cfg.DailyCloseTZ).Format("20060102-1504") + ".csv",
+	}
+	if !slot.IsZero() {
+		rec.ScheduledFor = slot.UTC().Format(time.RFC3339)
+	}
+	body, rows, err := snapshotCSV(ctx)
+	if err == nil {
+		rec.Rows, rec.Bytes = rows, len(body)
+		err = d.upload(rec.File, body)
+	}
+	rec.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		rec.Error = err.Error()
+		metrics.Count("delivery.run", 1, map[string]string{"result": "error"})
+		log.Printf("[delivery] %s to %s failed: %v", rec.File, d.dest.Redacted(), err)
+	} else {
+		metrics.Count("delivery.run", 1, map[string]string{"result": "ok"})
+		log.Printf("[delivery] Delivered %s (%d rows) to %s", rec.File, rec.Rows, d.dest.Redacted())
+	}
+	res, dbErr := database.ExecContext(ctx, `
+		INSERT INTO file_deliveries (scheduled_for, started_at, file, rows, bytes, duration_ms, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, rec.ScheduledFor, rec.StartedAt, rec.File, rec.Rows, rec.Bytes, rec.DurationMs, rec.Error)
+	if dbErr != nil {
+		log.Printf("[delivery] Recording delivery failed: %v", dbErr)
+	} else {
+		rec.ID, _ = res.LastInsertId()
+	}
+	return rec
+}
+
+// snapshotCSV renders every active cached price as CSV with a header row.
+func snapshotCSV(ctx context.Context) ([]byte, int, error) {
+	rows, err := database.QueryContext(ctx, `
+		SELECT p.symbol, p.name, p.price_rial, p.fetched_at, p.source FROM gold_prices p
+		LEFT JOIN symbols s ON s.symbol = p.symbol
+		WHERE COALESCE(s.active, 1) = 1
+		ORDER BY p.symbol
+	`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"symbol", "name", "price_rial", "fetched_at", "source"})
+	n := 0
+	for rows.Next() {
+		var price int64
+		rec := make([]string, 5)
+		if err := rows.Scan(&rec[0], &rec[1], &price, &rec[3], &rec[4]); err != nil {
+			return nil, 0, err
+		}
+		rec[2] = strconv.FormatInt(price, 10)
+		cw.Write(rec)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if n == 0 {
+		return nil, 0, errors.New("no cached prices")
+	}
+	cw.Flush()
+	return buf.Bytes(), n, cw.Error()
+}
+
+// upload stores body as name in the destination directory.
+func (d *fileDelivery) upload(name string, body []byte) error {
+	dir := d.dest.Path
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// handleDeliveries serves GET /admin/deliveries?limit=20: recent delivery
+// runs, newest first.
+func handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 20, 1, 1000)
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, scheduled_for, started_at, file, rows, bytes, duration_ms, error FROM file_deliveries
+		ORDER BY id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	runs := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.ScheduledFor, &d.StartedAt, &d.File, &d.Rows, &d.Bytes, &d.DurationMs, &d.Error); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		runs = append(runs, d)
+	}
+	resp := map[string]any{"deliveries": runs}
+	if delivery != nil {
+		resp["destination"] = delivery.dest.Redacted()
+		resp["nextAt"] = delivery.next(clock.Now()).UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDeliverNow serves POST /admin/deliveries: deliver a snapshot now,
+// outside the schedule.
+func handleDeliverNow(w http.ResponseWriter, r *http.Request) {
+	if delivery == nil {
+		writeError(w, http.StatusConflict, "file delivery is off; set DELIVERY_URL on the primary")
+		return
+	}
+	d := delivery.deliver(r.Context(), time.Time{})
+	if d.Error != "" {
+		writeJSON(w, http.StatusBadGateway, d)
+		return
+	}
+	logf(r.Context(), "[admin] Delivered %s", d.File)
+	writeJSON(w, http.StatusCreated, d)
+}
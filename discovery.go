@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceInstance is what gets registered: where this instance serves
+// prices, its role and its current /health status.
+type serviceInstance struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Role    string `json:"role"`
+	Mode    string `json:"mode"`
+	Status  string `json:"status"`
+	URL     string `json:"url"`
+}
+
+// serviceRegistry is a discovery backend. register is called again
+// whenever heartbeat reports that the registration was lost.
+type serviceRegistry interface {
+	register(ctx context.Context, inst serviceInstance) error
+	heartbeat(ctx context.Context, inst serviceInstance) error
+	deregister(ctx context.Context, inst serviceInstance) error
+}
+
+// errRegistrationLost is returned by heartbeat when the backend no longer
+// knows the instance, e.g. after a Consul agent restart or an expired
+// etcd lease.
+var errRegistrationLost = errors.New("registration lost")
+
+// discoveryRegistrar keeps this instance registered in DISCOVERY_BACKEND.
+type discoveryRegistrar struct {
+	backend  string
+	registry serviceRegistry
+	inst     serviceInstance
+	token    *secret
+	tokenSrc *secretSource
+	ttl      time.Duration
+	done     chan struct{}
+}
+
+// discovery is nil unless DISCOVERY_BACKEND is set.
+var discovery *discoveryRegistrar
+
+func newDiscoveryRegistrar(c Config) (*discoveryRegistrar, error) {
+	if c.DiscoveryBackend == "none" {
+		return nil, nil
+	}
+	token, tokenSrc, err := loadSecret("DISCOVERY_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	address := c.DiscoveryAddress
+	if address == "" {
+		if address, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("DISCOVERY_ADDRESS is unset and the hostname is unknown: %w", err)
+		}
+	}
+	d := &discoveryRegistrar{
+		backend:  c.DiscoveryBackend,
+		token:    token,
+		tokenSrc: tokenSrc,
+		ttl:      c.DiscoveryTTL,
+		done:     make(chan struct{}),
+		inst: serviceInstance{
+			ID:      fmt.Sprintf("%s-%s-%d", c.DiscoveryService, address, c.Port),
+			Name:    c.DiscoveryService,
+			Address: address,
+			Port:    c.Port,
+			Mode:    c.Mode,
+			URL:     "http://" + net.JoinHostPort(address, strconv.Itoa(c.Port)),
+		},
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch c.DiscoveryBackend {
+	case "consul":
+		d.registry = &consulRegistry{url: strings.TrimSuffix(c.DiscoveryURL, "/"), token: token, ttl: c.DiscoveryTTL, client: client}
+	case "etcd":
+		d.registry = &etcdRegistry{url: strings.TrimSuffix(c.DiscoveryURL, "/"), prefix: c.DiscoveryPrefix, token: token, ttl: c.DiscoveryTTL, client: client}
+	}
+	return d, nil
+}
+
+// serviceRole is the role other services select on: the primary is the
+// leader that polls and writes, unless another pod holds the leader lease.
+func serviceRole() string {
+	switch {
+	case cfg.Mode != "primary":
+		return cfg.Mode
+	case leader != nil && !leader.isHeld():
+		return "follower"
+	}
+	return "leader"
+}
+
+// run registers the instance and reports its health every third of
+// DISCOVERY_TTL. It registers again when its role changes or the backend
+// has lost the registration (errRegistrationLost); any other failure is
+// counted and retried on the next tick. On shutdown it deregisters and
+// closes done, which the server waits for before draining, so callers
+// stop being routed here first.
+func (d *discoveryRegistrar) run(ctx context.Context) {
+	defer close(d.done)
+	if d.tokenSrc != nil && !d.tokenSrc.static {
+		go refreshSecret(ctx, "DISCOVERY_TOKEN", d.tokenSrc, d.token, cfg.SecretsRefreshInterval)
+	}
+	ticker := time.NewTicker(d.ttl / 3)
+	defer ticker.Stop()
+	registered, role := false, ""
+	for {
+		inst := d.inst
+		inst.Role = serviceRole()
+		inst.Status = checkHealth(ctx).Status
+		var err error
+		if registered && inst.Role == role {
+			err = d.registry.heartbeat(ctx, inst)
+		}
+		if !registered || inst.Role != role || errors.Is(err, errRegistrationLost) {
+			if errors.Is(err, errRegistrationLost) {
+				log.Printf("[discovery] %s lost %s; registering again", d.backend, inst.ID)
+			}
+			if err = d.registry.register(ctx, inst); err == nil {
+				registered, role = true, inst.Role
+				log.Printf("[discovery] Registered %s in %s as %s (%s)", inst.ID, d.backend, inst.Role, inst.Status)
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			metrics.Count("discovery.errors", 1, map[string]string{"backend": d.backend})
+			log.Printf("[discovery] %s: %v (will retry)", d.backend, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if registered {
+				deregCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := d.registry.deregister(deregCtx, d.inst); err != nil {
+					log.Printf("[discovery] Deregistering %s from %s failed: %v", d.inst.ID, d.backend, err)
+				} else {
+					log.Printf("[discovery] Deregistered %s from %s", d.inst.ID, d.backend)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// discoveryCall sends a JSON request to a discovery backend and decodes
+// the JSON answer into out, if given.
+func discoveryCall(ctx context.Context, client *http.Client, method, target string, header http.Header, body, out any) (int, error) {
+	var r io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding %s response: %w", req.URL.Path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// consulRegistry registers with the local Consul agent's HTTP API. The
+// service carries a TTL check that heartbeat keeps passing, warning or
+// critical to match /health; an instance that stops reporting turns
+// critical after DISCOVERY_TTL and is removed by Consul after ten times
+// that.
+type consulRegistry struct {
+	url    string
+	token  *secret
+	ttl    time.Duration
+	client *http.Client
+}
+
+var consulCheckStatus = map[string]string{
+	healthOK:        "passing",
+	healthDegraded:  "warning",
+	healthUnhealthy: "critical",
+}
+
+func (c *consulRegistry) header() http.Header {
+	h := http.Header{}
+	if t := c.token.Get(); t != "" {
+		h.Set("X-Consul-Token", t)
+	}
+	return h
+}
+
+func (c *consulRegistry) register(ctx context.Context, inst serviceInstance) error {
+	body := map[string]any{
+		"ID":      inst.ID,
+		"Name":    inst.Name,
+		"Address": inst.Address,
+		"Port":    inst.Port,
+		"Tags":    []string{inst.Role},
+		"Meta":    map[string]string{"role": inst.Role, "mode": inst.Mode, "url": inst.URL},
+		"Check": map[string]any{
+			"CheckID":                        "service:" + inst.ID,
+			"Name":                           "gold-service health",
+			"TTL":                            c.ttl.String(),
+			"Status":                         consulCheckStatus[inst.Status],
+			"DeregisterCriticalServiceAfter": (10 * c.ttl).String(),
+		},
+	}
+	_, err := discoveryCall(ctx, c.client, http.MethodPut, c.url+"/v1/agent/service/register", c.header(), body, nil)
+	return err
+}
+
+func (c *consulRegistry) heartbeat(ctx context.Context, inst serviceInstance) error {
+	body := map[string]string{"Status": consulCheckStatus[inst.Status], "Output": "health " + inst.Status}
+	status, err := discoveryCall(ctx, c.client, http.MethodPut, c.url+"/v1/agent/check/update/service:"+url.PathEscape(inst.ID), c.header(), body, nil)
+	if status == http.StatusNotFound {
+		return errRegistrationLost
+	}
+	return err
+}
+
+func (c *consulRegistry) deregister(ctx context.Context, inst serviceInstance) error {
+	_, err := discoveryCall(ctx, c.client, http.MethodPut, c.url+"/v1/agent/service/deregister/"+url.PathEscape(inst.ID), c.header(), nil, nil)
+	return err
+}
+
+// etcdRegistry writes the instance as JSON under
+// DISCOVERY_PREFIX/<name>/<id> through etcd's v3 JSON gateway, attached to
+// a lease of DISCOVERY_TTL. heartbeat keeps the lease alive and rewrites
+// the value when the health status changes; a crashed instance's key
+// disappears when its lease expires.
+type etcdRegistry struct {
+	url    string
+	prefix string
+	token  *secret
+	ttl    time.Duration
+	client *http.Client
+
+	lease      string // lease ID, as the gateway encodes int64s
+	lastStatus string
+}
+
+func (e *etcdRegistry) header() http.Header {
+	h := http.Header{}
+	if t := e.token.Get(); t != "" {
+		h.Set("Authorization", t)
+	}
+	return h
+}
+
+func (e *etcdRegistry) key(inst serviceInstance) string {
+	return strings.TrimSuffix(e.prefix, "/") + "/" + inst.Name + "/" + inst.ID
+}
+
+// register grants a lease unless the current one is still alive, as it
+// is when only the role changed, and writes the key under it.
+func (e *etcdRegistry) register(ctx context.Context, inst serviceInstance) error {
+	if e.lease != "" {
+		return e.put(ctx, inst)
+	}
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	body := map[string]any{"TTL": int64(e.ttl.Seconds())}
+	if _, err := discoveryCall(ctx, e.client, http.MethodPost, e.url+"/v3/lease/grant", e.header(), body, &grant); err != nil {
+		return err
+	}
+	if grant.ID == "" {
+		return errors.New("etcd granted no lease")
+	}
+	e.lease = grant.ID
+	return e.put(ctx, inst)
+}
+
+func (e *etcdRegistry) put(ctx context.Context, inst serviceInstance) error {
+	value, _ := json.Marshal(inst)
+	body := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key(inst))),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": e.lease,
+	}
+	if _, err := discoveryCall(ctx, e.client, http.MethodPost, e.url+"/v3/kv/put", e.header(), body, nil); err != nil {
+		return err
+	}
+	e.lastStatus = inst.Status
+	return nil
+}
+
+func (e *etcdRegistry) heartbeat(ctx context.Context, inst serviceInstance) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if _, err := discoveryCall(ctx, e.client, http.MethodPost, e.url+"/v3/lease/keepalive", e.header(), map[string]string{"ID": e.lease}, &resp); err != nil {
+		return err
+	}
+	// The gateway omits TTL (zero) once the lease has expired.
+	if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl <= 0 {
+		e.lease = ""
+		return errRegistrationLost
+	}
+	if inst.Status != e.lastStatus {
+		return e.put(ctx, inst)
+	}
+	return nil
+}
+
+func (e *etcdRegistry) deregister(ctx context.Context, inst serviceInstance) error {
+	if e.lease == "" {
+		return nil
+	}
+	_, err := discoveryCall(ctx, e.client, http.MethodPost, e.url+"/v3/lease/revoke", e.header(), map[string]string{"ID": e.lease}, nil)
+	return err
+}
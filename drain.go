@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// exportTracker counts in-flight streamed exports (NDJSON candles, audit
+// CSV) so shutdown can wait for them instead of cutting them off.
+type exportTracker struct {
+	mu     sync.Mutex
+	active int
+	stop   chan struct{} // closed when running exports must end now
+	once   sync.Once
+}
+
+var exports = &exportTracker{stop: make(chan struct{})}
+
+// begin registers an export; the returned func marks it finished.
+func (t *exportTracker) begin() func() {
+	t.mu.Lock()
+	t.active++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.active--
+		t.mu.Unlock()
+	}
+}
+
+func (t *exportTracker) inFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// stopping is closed once shutdown has waited as long as it will; exports
+// should then write their termination marker and return.
+func (t *exportTracker) stopping() <-chan struct{} {
+	return t.stop
+}
+
+func (t *exportTracker) terminate() {
+	t.once.Do(func() { close(t.stop) })
+}
+
+// shutdownServer stops accepting connections and drains the rest. Plain
+// requests get SHUTDOWN_GRACE. While exports are still running the
+// deadline keeps extending, up to SHUTDOWN_MAX_WAIT; then they are told
+// to stop, given a second to say so, and whatever is left is closed.
+func shutdownServer(server *http.Server) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		extended := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return // drained
+			}
+			elapsed := time.Since(start)
+			n := exports.inFlight()
+			switch {
+			case elapsed < cfg.ShutdownGrace:
+			case n == 0:
+				cancel()
+				return
+			case elapsed >= cfg.ShutdownMaxWait:
+				log.Printf("[shutdown] Stopping %d exports still running after %v", n, cfg.ShutdownMaxWait)
+				exports.terminate()
+				time.Sleep(time.Second)
+				cancel()
+				return
+			case !extended:
+				log.Printf("[shutdown] Waiting for %d exports to finish (up to %v)", n, cfg.ShutdownMaxWait)
+				extended = true
+			}
+		}
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[shutdown] Closed remaining connections: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// dryRunWrites are the non-GET routes that don't write or notify, so they
+// still work with DRY_RUN set.
+var dryRunWrites = map[string]bool{
+	"POST /api/rate-locks":        true,
+	"POST /api/rate-locks/verify": true,
+	"POST /admin/access/reload":   true,
+	"POST /admin/clock/advance":   true,
+}
+
+// withDryRun answers 409 to every request that would write or notify while
+// DRY_RUN is set. Poll cycles check cfg.DryRun themselves.
+func withDryRun(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.DryRun && r.Method != http.MethodGet && r.Method != http.MethodHead && !dryRunWrites[r.Method+" "+r.URL.Path] {
+			writeError(w, http.StatusConflict, "this instance is a dry run (DRY_RUN=true) and makes no changes")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvelopeMeta is the metadata ?envelope=true adds to every JSON response.
+type EnvelopeMeta struct {
+	GeneratedAt string        `json:"generatedAt"`
+	RequestID   string        `json:"requestId"`
+	Cache       EnvelopeCache `json:"cache"`
+}
+
+// EnvelopeCache says whether the response came from queryCache and how old
+// the cached copy was.
+type EnvelopeCache struct {
+	Hit        bool `json:"hit"`
+	AgeSeconds int  `json:"ageSeconds"`
+}
+
+// envelopeWriter holds back a JSON response so it can be wrapped, or
+// renamed by withFieldCase. Anything else, such as /metrics or an NDJSON
+// export, is written straight through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	passthrough bool
+	body        bytes.Buffer
+}
+
+func (e *envelopeWriter) WriteHeader(code int) {
+	if e.wroteHeader {
+		return
+	}
+	e.wroteHeader, e.status = true, code
+	if !strings.HasPrefix(e.Header().Get("Content-Type"), "application/json") {
+		e.passthrough = true
+		e.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (e *envelopeWriter) Write(p []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.passthrough {
+		return e.ResponseWriter.Write(p)
+	}
+	return e.body.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (e *envelopeWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// withEnvelope wraps JSON responses in {"data": ..., "meta": {...}} when
+// the request has ?envelope=true, for gateways and SDKs that want the
+// same metadata from every endpoint. Error bodies keep their fields, with
+// "data": null and meta added. The request ID is the caller's
+// X-Request-ID or a new one, echoed in the header either way.
+func withEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("envelope") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		qp := paramsOf(r)
+		if !qp.bool("envelope") {
+			if qp.valid(w) {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		id := requestID(r)
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+
+		ew := &envelopeWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ew, r)
+		if ew.passthrough {
+			return
+		}
+		if !ew.wroteHeader {
+			ew.status = http.StatusOK
+		}
+		meta := EnvelopeMeta{
+			GeneratedAt: clock.Now().UTC().Format(time.RFC3339),
+			RequestID:   id,
+			Cache:       EnvelopeCache{Hit: w.Header().Get("X-Cache") == "HIT"},
+		}
+		meta.Cache.AgeSeconds, _ = strconv.Atoi(w.Header().Get("Age"))
+
+		out := map[string]any{"data": json.RawMessage(bytes.TrimSpace(ew.body.Bytes())), "meta": meta}
+		var fields map[string]json.RawMessage
+		if ew.status >= 400 && json.Unmarshal(ew.body.Bytes(), &fields) == nil {
+			out = map[string]any{}
+			for k, v := range fields {
+				out[k] = v
+			}
+			out["data"], out["meta"] = nil, meta
+		}
+		if ew.body.Len() == 0 {
+			out["data"] = nil
+		}
+		w.Header().Del("Content-Length")
+		writeJSON(w, ew.status, out)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// extremeRanges maps the accepted ?range= values to their lookback; zero
+// means all history.
+var extremeRanges = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"all": 0,
+}
+
+// Extreme is a record price and when it was first reached. Precision is
+// the candle resolution the time comes from: older history survives only
+// as 1h or 1d candles.
+type Extreme struct {
+	Price     int64  `json:"price"`
+	At        string `json:"at"`
+	AtMs      *int64 `json:"atMs,omitempty"`
+	Precision string `json:"precision"`
+}
+
+// findExtreme returns the highest (high=true) or lowest candle value for
+// symbol since the given time. Every resolution is searched because
+// coarser ones cover history the finer ones no longer keep; for ties the
+// finest resolution, then the earliest bucket, wins.
+func findExtreme(ctx context.Context, symbol string, since time.Time, high bool) (*Extreme, error) {
+	query := `
+		SELECT high, bucket_start, resolution FROM candles
+		WHERE symbol = ? AND bucket_start >= ?
+		ORDER BY high DESC, CASE resolution WHEN '1m' THEN 0 WHEN '1h' THEN 1 ELSE 2 END, bucket_start
+		LIMIT 1`
+	if !high {
+		query = `
+		SELECT low, bucket_start, resolution FROM candles
+		WHERE symbol = ? AND bucket_start >= ?
+		ORDER BY low ASC, CASE resolution WHEN '1m' THEN 0 WHEN '1h' THEN 1 ELSE 2 END, bucket_start
+		LIMIT 1`
+	}
+	from := ""
+	if !since.IsZero() {
+		from = since.UTC().Format(time.RFC3339)
+	}
+	var e Extreme
+	err := database.QueryRowContext(ctx, query, symbol, from).Scan(&e.Price, &e.At, &e.Precision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// handleExtremes serves GET /api/gold/18k/extremes?range=24h|7d|30d|all.
+// high and low are null when the range has no history.
+func handleExtremes(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	withMs := qp.unixMs()
+	name := qp.oneOf("range", "24h", "24h", "7d", "30d", "all")
+	if !qp.valid(w) {
+		return
+	}
+	lookback := extremeRanges[name]
+	var since time.Time
+	if lookback > 0 {
+		since = clock.Now().Add(-lookback)
+	}
+
+	hi, err := findExtreme(r.Context(), "gold_18k", since, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	lo, err := findExtreme(r.Context(), "gold_18k", since, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if withMs {
+		for _, e := range []*Extreme{hi, lo} {
+			if e != nil {
+				e.AtMs = unixMs(e.At)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"symbol": "gold_18k",
+		"range":  name,
+		"high":   hi,
+		"low":    lo,
+	})
+}
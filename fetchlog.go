@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// fetchLogRetention bounds the fetch history kept in fetch_log.
+const fetchLogRetention = 30 * 24 * time.Hour
+
+// recordFetch appends one upstream attempt to fetch_log. err == nil
+// records a success. A dry run only counts it.
+func recordFetch(provider string, start time.Time, err error) {
+	ok, class, msg := 1, "", ""
+	if err != nil {
+		ok, class, msg = 0, errorClass(err), err.Error()
+	}
+	result := "ok"
+	if err != nil {
+		result = class
+	}
+	metrics.Count("upstream.fetch", 1, map[string]string{"provider": provider, "result": result})
+	metrics.Timing("upstream.fetch_duration", time.Since(start), map[string]string{"provider": provider})
+
+	// start is real time, for the duration; started_at is on the service
+	// clock like the rest of the data.
+	elapsed := time.Since(start)
+	if cfg.DryRun {
+		return
+	}
+	_, dbErr := database.Exec(`
+		INSERT INTO fetch_log (provider, started_at, duration_ms, ok, error_class, error)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, provider, clock.Now().Add(-elapsed).UTC().Format(time.RFC3339), elapsed.Milliseconds(), ok, class, msg)
+	if dbErr != nil {
+		log.Printf("[fetchlog] Insert failed: %v", dbErr)
+		return
+	}
+	database.Exec("DELETE FROM fetch_log WHERE started_at < ?", clock.Now().UTC().Add(-fetchLogRetention).Format(time.RFC3339))
+}
+
+// FetchLogEntry is one row of GET /admin/fetch-log.
+type FetchLogEntry struct {
+	Provider   string `json:"provider"`
+	StartedAt  string `json:"startedAt"`
+	DurationMs int64  `json:"durationMs"`
+	OK         bool   `json:"ok"`
+	ErrorClass string `json:"errorClass,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleFetchLog serves the most recent fetch attempts, newest first.
+// ?class=schema filters to one failure class; ?limit caps the rows (max 1000).
+func handleFetchLog(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 100, 1, 1000)
+	class := qp.oneOf("class", "", errClassOutage, errClassRejected, errClassSchema, errClassStorage, errClassAnomaly)
+	if !qp.valid(w) {
+		return
+	}
+
+	rows, err := database.Query(`
+		SELECT provider, started_at, duration_ms, ok, error_class, error
+		FROM fetch_log
+		WHERE ? = '' OR error_class = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, class, class, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	entries := []FetchLogEntry{}
+	for rows.Next() {
+		var e FetchLogEntry
+		if err := rows.Scan(&e.Provider, &e.StartedAt, &e.DurationMs, &e.OK, &e.ErrorClass, &e.Error); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// withFieldCase rewrites JSON response field names to snake_case when the
+// request has ?case=snake, for consumers with fixed snake_case schemas.
+// JSON_FIELD_CASE=snake makes that the default on /api/ routes only: the
+// admin API and /internal/sync keep camelCase unless asked, so config
+// exports still import and standbys still decode their batches. It runs
+// outside withEnvelope so the envelope's meta is renamed too. Request
+// bodies and query parameters keep their camelCase names, and non-JSON
+// responses pass through untouched.
+func withFieldCase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fieldCase := "camel"
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			fieldCase = cfg.JSONFieldCase
+		}
+		if r.URL.Query().Has("case") {
+			qp := paramsOf(r)
+			fieldCase = qp.oneOf("case", fieldCase, "camel", "snake")
+			if !qp.valid(w) {
+				return
+			}
+		}
+		if fieldCase != "snake" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &envelopeWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ew, r)
+		if ew.passthrough {
+			return
+		}
+		if !ew.wroteHeader {
+			ew.status = http.StatusOK
+		}
+		body, err := snakeCaseJSON(ew.body.Bytes())
+		if err != nil {
+			body = ew.body.Bytes()
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(ew.status)
+		w.Write(body)
+	})
+}
+
+// snakeCaseJSON renames the object keys in src with snakeCase, keeping
+// their order, and leaves values alone. It returns one JSON value per
+// line, as writeJSON does.
+func snakeCaseJSON(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if len(bytes.TrimSpace(src)) == 0 {
+		return src, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	for dec.More() {
+		if err := snakeCaseValue(dec, &out); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
+
+func snakeCaseValue(dec *json.Decoder, out *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		out.WriteByte('{')
+		for i := 0; dec.More(); i++ {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			name, _ := json.Marshal(snakeCase(key.(string)))
+			out.Write(name)
+			out.WriteByte(':')
+			if err := snakeCaseValue(dec, out); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case json.Delim('['):
+		out.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := snakeCaseValue(dec, out); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	default:
+		raw, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		out.Write(raw)
+		return nil
+	}
+	// Consume the closing delimiter.
+	_, err = dec.Token()
+	return err
+}
+
+// snakeCase turns a camelCase field name like fetchDurationMs into
+// fetch_duration_ms. Keys that aren't camelCase identifiers, such as
+// symbols (gold_18k, USD) used as map keys, are returned unchanged.
+func snakeCase(name string) string {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return name
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return name
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' {
+			prev := name[i-1]
+			nextLower := i+1 < len(name) && name[i+1] >= 'a' && name[i+1] <= 'z'
+			if prev < 'A' || prev > 'Z' || nextLower {
+				b.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
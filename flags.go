@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// featureDefaults lists every flag and whether it is on when neither the
+// database nor FEATURE_FLAGS says otherwise. Gate new, risky endpoints
+// with requireFlag and add them here (off, to ship dark).
+var featureDefaults = map[string]bool{
+	"convert":    true,
+	"watchlists": true,
+	"snapshots":  true,
+}
+
+// FeatureFlag is a flag's rule. A disabled flag is off for everyone.
+// Otherwise it is on for the API keys listed in APIKeyIDs and for
+// RolloutPercent of the remaining callers, bucketed by caller so each one
+// sees a stable answer.
+type FeatureFlag struct {
+	Name           string  `json:"name"`
+	Enabled        bool    `json:"enabled"`
+	RolloutPercent int     `json:"rolloutPercent"`
+	APIKeyIDs      []int64 `json:"apiKeyIds"`
+	Source         string  `json:"source"` // "default", "env" or "db"
+	UpdatedAt      string  `json:"updatedAt,omitempty"`
+}
+
+// flags holds the stored rules by name, reloaded with the access rules.
+var flags atomic.Pointer[map[string]FeatureFlag]
+
+// loadFlags replaces the in-memory flag rules with the database's.
+func loadFlags(ctx context.Context) error {
+	rows, err := database.QueryContext(ctx, "SELECT name, enabled, rollout_percent, api_key_ids, updated_at FROM feature_flags")
+	if err != nil {
+		return fmt.Errorf("loading feature flags: %w", err)
+	}
+	defer rows.Close()
+	stored := map[string]FeatureFlag{}
+	for rows.Next() {
+		f := FeatureFlag{Source: "db"}
+		var ids string
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.RolloutPercent, &ids, &f.UpdatedAt); err != nil {
+			return fmt.Errorf("loading feature flags: %w", err)
+		}
+		json.Unmarshal([]byte(ids), &f.APIKeyIDs)
+		stored[f.Name] = f
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("loading feature flags: %w", err)
+	}
+	flags.Store(&stored)
+	return nil
+}
+
+// effectiveFlag resolves a flag: a database rule wins over FEATURE_FLAGS,
+// which wins over featureDefaults.
+func effectiveFlag(name string) FeatureFlag {
+	if f, ok := (*flags.Load())[name]; ok {
+		return f
+	}
+	if f, ok := cfg.FeatureFlags[name]; ok {
+		return f
+	}
+	return FeatureFlag{Name: name, Enabled: featureDefaults[name], RolloutPercent: 100, APIKeyIDs: []int64{}, Source: "default"}
+}
+
+// flagEnabled reports whether name is on for the caller of r.
+func flagEnabled(r *http.Request, name string) bool {
+	f := effectiveFlag(name)
+	if !f.Enabled {
+		return false
+	}
+	if k := requestAPIKey(r); k != nil {
+		for _, id := range f.APIKeyIDs {
+			if id == k.ID {
+				return true
+			}
+		}
+	}
+	if f.RolloutPercent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + rateClient(r)))
+	return int(h.Sum32()%100) < f.RolloutPercent
+}
+
+// requireFlag answers 404 while name is off for the caller, so a dark
+// endpoint looks like it doesn't exist.
+func requireFlag(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !flagEnabled(r, name) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleListFlags serves GET /admin/flags: every known flag with its
+// effective rule and where that rule comes from.
+func handleListFlags(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(featureDefaults))
+	for name := range featureDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]FeatureFlag, 0, len(names))
+	for _, name := range names {
+		list = append(list, effectiveFlag(name))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleSetFlag serves PUT /admin/flags/{name} with a body of
+// {"enabled": true, "rolloutPercent": 10, "apiKeyIds": [3]}.
+func handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "feature flags are read-only on a replica; change them on the primary")
+		return
+	}
+	name := r.PathValue("name")
+	if _, ok := featureDefaults[name]; !ok {
+		writeError(w, http.StatusNotFound, "unknown feature flag "+name)
+		return
+	}
+	var req struct {
+		Enabled        *bool   `json:"enabled"`
+		RolloutPercent *int    `json:"rolloutPercent"`
+		APIKeyIDs      []int64 `json:"apiKeyIds"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"enabled\": true, \"rolloutPercent\": 10, \"apiKeyIds\": [3]}")
+		return
+	}
+	after := FeatureFlag{Name: name, Enabled: *req.Enabled, RolloutPercent: 100, APIKeyIDs: req.APIKeyIDs, Source: "db"}
+	if req.RolloutPercent != nil {
+		if *req.RolloutPercent < 0 || *req.RolloutPercent > 100 {
+			writeError(w, http.StatusBadRequest, "rolloutPercent must be between 0 and 100")
+			return
+		}
+		after.RolloutPercent = *req.RolloutPercent
+	}
+	if after.APIKeyIDs == nil {
+		after.APIKeyIDs = []int64{}
+	}
+	after.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	before := effectiveFlag(name)
+
+	ids, _ := json.Marshal(after.APIKeyIDs)
+	_, err := database.ExecContext(r.Context(), `
+		INSERT INTO feature_flags (name, enabled, rollout_percent, api_key_ids, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			enabled = excluded.enabled,
+			rollout_percent = excluded.rollout_percent,
+			api_key_ids = excluded.api_key_ids,
+			updated_at = excluded.updated_at
+	`, name, after.Enabled, after.RolloutPercent, string(ids), after.UpdatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := loadFlags(r.Context()); err != nil {
+		logf(r.Context(), "[flags] Reload after change failed: %v", err)
+	}
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] Feature flag %s set: enabled=%t rollout=%d%% keys=%d", name, after.Enabled, after.RolloutPercent, len(after.APIKeyIDs))
+	writeJSON(w, http.StatusOK, after)
+}
+
+// handleDeleteFlag serves DELETE /admin/flags/{name}, dropping the stored
+// rule so FEATURE_FLAGS or the built-in default applies again.
+func handleDeleteFlag(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "feature flags are read-only on a replica; change them on the primary")
+		return
+	}
+	name := r.PathValue("name")
+	before := effectiveFlag(name)
+	res, err := database.ExecContext(r.Context(), "DELETE FROM feature_flags WHERE name = ?", name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "no stored rule for feature flag "+name)
+		return
+	}
+	if err := loadFlags(r.Context()); err != nil {
+		logf(r.Context(), "[flags] Reload after change failed: %v", err)
+	}
+	after := effectiveFlag(name)
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] Feature flag %s reset to %s", name, after.Source)
+	writeJSON(w, http.StatusOK, after)
+}
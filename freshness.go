@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// freshnessRetention covers the longest SLO window.
+const freshnessRetention = 30 * 24 * time.Hour
+
+// freshnessWindows are the rolling windows reported for the freshness SLO.
+var freshnessWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// runFreshnessSampler records, every interval, whether each active
+// symbol's cached price is within staleThreshold. The share of fresh
+// samples over a window approximates the share of time it was fresh.
+func runFreshnessSampler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(clock.Real(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sampleFreshness(clock.Now().UTC())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sampleFreshness(now time.Time) {
+	_, err := database.Exec(`
+		INSERT INTO freshness_samples (symbol, sampled_at, fresh)
+		SELECT symbol, ?, fetched_at >= ?
+		FROM gold_prices
+		WHERE symbol NOT IN (SELECT symbol FROM symbols WHERE active = 0)
+	`, now.Format(time.RFC3339), now.Add(-staleThreshold).Format(time.RFC3339))
+	if err != nil {
+		log.Printf("[freshness] Sampling failed: %v", err)
+		return
+	}
+	database.Exec("DELETE FROM freshness_samples WHERE sampled_at < ?", now.Add(-freshnessRetention).Format(time.RFC3339))
+}
+
+// FreshnessWindow is the freshness SLI of one symbol over one window.
+// FreshPercent is nil when the window has no samples yet.
+type FreshnessWindow struct {
+	Samples      int      `json:"samples"`
+	FreshPercent *float64 `json:"freshPercent"`
+}
+
+// readFreshness returns symbol -> window name -> SLI.
+func readFreshness(ctx context.Context) (map[string]map[string]FreshnessWindow, error) {
+	result := map[string]map[string]FreshnessWindow{}
+	now := clock.Now().UTC()
+	for _, win := range freshnessWindows {
+		rows, err := database.QueryContext(ctx, `
+			SELECT symbol, COUNT(*), AVG(fresh) * 100
+			FROM freshness_samples
+			WHERE sampled_at >= ?
+			GROUP BY symbol
+		`, now.Add(-win.d).Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var symbol string
+			var w FreshnessWindow
+			var pct float64
+			if err := rows.Scan(&symbol, &w.Samples, &pct); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			w.FreshPercent = &pct
+			if result[symbol] == nil {
+				result[symbol] = map[string]FreshnessWindow{}
+			}
+			result[symbol][win.name] = w
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// Symbols sampled at all get every window, even empty ones.
+	for _, windows := range result {
+		for _, win := range freshnessWindows {
+			if _, ok := windows[win.name]; !ok {
+				windows[win.name] = FreshnessWindow{}
+			}
+		}
+	}
+	return result, nil
+}
+
+// handleFreshness serves GET /api/freshness: per symbol, the percentage of
+// samples in the last 1h/24h/30d where the cached price was fresh.
+func handleFreshness(w http.ResponseWriter, r *http.Request) {
+	result, err := readFreshness(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"staleThresholdSeconds": int64(staleThreshold.Seconds()),
+		"symbols":               result,
+	})
+}
+
+// setDataAge sets X-Cache, Age and X-Data-Age-Seconds on a price response
+// served from the gold_prices cache. fetchedAt is the oldest price in the
+// body. It is a MISS only when ?refresh=true fetched upstream for this
+// request; Age lets CDNs count the time the price spent cached against
+// their own TTL.
+func setDataAge(w http.ResponseWriter, fetchedAt time.Time) {
+	age := strconv.FormatInt(int64(max(clockSince(fetchedAt), 0).Seconds()), 10)
+	if w.Header().Get("X-Refresh") == "ok" {
+		w.Header().Set("X-Cache", "MISS")
+	} else {
+		w.Header().Set("X-Cache", "HIT")
+	}
+	w.Header().Set("Age", age)
+	w.Header().Set("X-Data-Age-Seconds", age)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gap reasons, from the fetch log and anomalies recorded during the gap.
+const (
+	gapDeactivated     = "deactivated"      // the symbol was switched off
+	gapServiceDown     = "service_down"     // no fetch was attempted at all
+	gapUpstreamFailing = "upstream_failing" // every fetch failed
+	gapRejected        = "rejected"         // fetches succeeded but the price was refused
+	gapSymbolMissing   = "symbol_missing"   // fetches succeeded without this symbol
+)
+
+// gapDetectInterval is how often the gap detector runs; gapScanWindow is
+// how far back each run re-reads 1m candles. Gaps found earlier are kept.
+const (
+	gapDetectInterval = time.Hour
+	gapScanWindow     = 7 * 24 * time.Hour
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// marketClosure is one MARKET_CLOSURES entry: a weekday or date, and the
+// minutes of that day, in DAILY_CLOSE_TZ, when no ticks are expected.
+type marketClosure struct {
+	spec     string
+	day      string
+	from, to int
+}
+
+func (c marketClosure) contains(t time.Time) bool {
+	local := t.In(cfg.DailyCloseTZ)
+	if c.day != local.Format(time.DateOnly) && c.day != weekdayNames[local.Weekday()] {
+		return false
+	}
+	m := local.Hour()*60 + local.Minute()
+	return m >= c.from && m < c.to
+}
+
+// openTime is the part of [start, end) outside market closures, counted
+// in whole minutes like the 1m candles it is measured against.
+func openTime(start, end time.Time) time.Duration {
+	var open time.Duration
+	for t := start; t.Before(end); t = t.Add(time.Minute) {
+		closed := false
+		for _, c := range cfg.MarketClosures {
+			if c.contains(t) {
+				closed = true
+				break
+			}
+		}
+		if !closed {
+			open += time.Minute
+		}
+	}
+	return open
+}
+
+// HistoryGap is one row of GET /admin/gaps: a stretch with no 1m candle
+// for the symbol. End is the first tick after it, or the last scan while
+// Ongoing. BackfilledAt is set once BACKFILL_URL was asked to fill it.
+type HistoryGap struct {
+	Symbol          string `json:"symbol"`
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	DurationSeconds int64  `json:"durationSeconds"`
+	OpenSeconds     int64  `json:"openSeconds"`
+	Ongoing         bool   `json:"ongoing"`
+	Reason          string `json:"reason"`
+	Detail          string `json:"detail"`
+	DetectedAt      string `json:"detectedAt"`
+	BackfilledAt    string `json:"backfilledAt,omitempty"`
+	BackfilledRows  int    `json:"backfilledRows,omitempty"`
+}
+
+// runGapDetector scans for gaps once at startup and then every
+// gapDetectInterval until ctx is cancelled, backfilling them afterwards
+// when BACKFILL_URL is set.
+func runGapDetector(ctx context.Context) {
+	ticker := time.NewTicker(clock.Real(gapDetectInterval))
+	defer ticker.Stop()
+	for {
+		if err := detectGaps(ctx, clock.Now().UTC()); err != nil {
+			log.Printf("[gaps] Detection failed: %v", err)
+		} else if gapBackfill != nil {
+			if err := backfillGaps(ctx, gapBackfill, clock.Now().UTC()); err != nil {
+				log.Printf("[backfill] Failed: %v", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// detectGaps records every gap of the tracked symbols in the last
+// gapScanWindow whose open-market time reaches GAP_THRESHOLD. A gap still
+// running at now is stored as ongoing and updated, under the same start,
+// by later runs.
+func detectGaps(ctx context.Context, now time.Time) error {
+	now = now.Truncate(time.Minute)
+	since := now.Add(-gapScanWindow).Format(time.RFC3339)
+	found := 0
+	for _, s := range cfg.TrackedSymbols {
+		// The last tick before the window bounds a gap that crosses it.
+		var prev string
+		database.QueryRowContext(ctx, `
+			SELECT COALESCE(MAX(bucket_start), '') FROM candles
+			WHERE symbol = ? AND resolution = ? AND bucket_start < ?
+		`, s.Symbol, res1m, since).Scan(&prev)
+		var ticks []time.Time
+		if t, err := time.Parse(time.RFC3339, prev); err == nil {
+			ticks = append(ticks, t)
+		}
+		rows, err := database.QueryContext(ctx, `
+			SELECT bucket_start FROM candles
+			WHERE symbol = ? AND resolution = ? AND bucket_start >= ?
+			ORDER BY bucket_start
+		`, s.Symbol, res1m, since)
+		if err != nil {
+			return fmt.Errorf("reading %s ticks: %w", s.Symbol, err)
+		}
+		for rows.Next() {
+			var bucket string
+			if err := rows.Scan(&bucket); err != nil {
+				rows.Close()
+				return err
+			}
+			if t, err := time.Parse(time.RFC3339, bucket); err == nil {
+				ticks = append(ticks, t)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ticks) == 0 {
+			continue // never fetched; nothing to chart yet
+		}
+
+		// now closes the trailing gap, if the ticks have stopped.
+		for i, start := range ticks {
+			start = start.Add(time.Minute)
+			end, ongoing := now, true
+			if i+1 < len(ticks) {
+				end, ongoing = ticks[i+1], false
+			}
+			if !start.Before(end) {
+				continue
+			}
+			open := openTime(start, end)
+			if open < cfg.GapThreshold {
+				continue
+			}
+			reason, detail := classifyGap(ctx, s.Symbol, start, end)
+			_, err := database.ExecContext(ctx, `
+				INSERT INTO history_gaps (symbol, start_at, end_at, open_seconds, ongoing, reason, detail, detected_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(symbol, start_at) DO UPDATE SET
+					end_at = excluded.end_at,
+					open_seconds = excluded.open_seconds,
+					ongoing = excluded.ongoing,
+					reason = excluded.reason,
+					detail = excluded.detail
+			`, s.Symbol, start.Format(time.RFC3339), end.Format(time.RFC3339), int64(open.Seconds()), ongoing, reason, detail, now.Format(time.RFC3339))
+			if err != nil {
+				return fmt.Errorf("storing %s gap: %w", s.Symbol, err)
+			}
+			found++
+		}
+	}
+	metrics.Gauge("history.gaps_in_window", float64(found), nil)
+	if found > 0 {
+		log.Printf("[gaps] %d gap(s) over %v in the last %v", found, cfg.GapThreshold, gapScanWindow)
+	}
+	return nil
+}
+
+// classifyGap explains a gap from what was recorded during it: whether the
+// symbol was off, whether the primary provider was polled at all, whether
+// those fetches failed, and whether this symbol's price was rejected.
+func classifyGap(ctx context.Context, symbol string, start, end time.Time) (reason, detail string) {
+	from, to := start.Format(time.RFC3339), end.Format(time.RFC3339)
+
+	var active bool
+	var deactivatedAt string
+	err := database.QueryRowContext(ctx, "SELECT active, deactivated_at FROM symbols WHERE symbol = ?", symbol).Scan(&active, &deactivatedAt)
+	if err == nil && !active && deactivatedAt < to {
+		return gapDeactivated, "deactivated at " + deactivatedAt
+	}
+
+	var attempts, failed int
+	database.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(ok = 0), 0) FROM fetch_log
+		WHERE provider = ? AND started_at >= ? AND started_at < ?
+	`, primaryProvider.name, from, to).Scan(&attempts, &failed)
+	if attempts == 0 {
+		return gapServiceDown, "no fetch attempts recorded"
+	}
+	if failed == attempts {
+		var class string
+		var n int
+		database.QueryRowContext(ctx, `
+			SELECT error_class, COUNT(*) AS n FROM fetch_log
+			WHERE provider = ? AND ok = 0 AND started_at >= ? AND started_at < ?
+			GROUP BY error_class ORDER BY n DESC LIMIT 1
+		`, primaryProvider.name, from, to).Scan(&class, &n)
+		return gapUpstreamFailing, fmt.Sprintf("%d failed fetches, %d of them %s", failed, n, class)
+	}
+
+	rows, err := database.QueryContext(ctx, `
+		SELECT kind, COUNT(*) FROM price_anomalies
+		WHERE symbol = ? AND observed_at >= ? AND observed_at < ?
+		GROUP BY kind ORDER BY kind
+	`, symbol, from, to)
+	if err == nil {
+		var kinds []string
+		for rows.Next() {
+			var kind string
+			var n int
+			if rows.Scan(&kind, &n) == nil {
+				kinds = append(kinds, fmt.Sprintf("%d %s", n, kind))
+			}
+		}
+		rows.Close()
+		if len(kinds) > 0 {
+			return gapRejected, "prices rejected: " + strings.Join(kinds, ", ")
+		}
+	}
+	return gapSymbolMissing, fmt.Sprintf("%d successful fetches without a %s price", attempts-failed, symbol)
+}
+
+// handleGaps serves GET /admin/gaps: detected history gaps, newest first.
+// ?symbol and ?reason filter; ?limit caps the rows (max 1000).
+func handleGaps(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	symbol := qp.str("symbol", "")
+	reason := qp.oneOf("reason", "", gapDeactivated, gapServiceDown, gapUpstreamFailing, gapRejected, gapSymbolMissing)
+	limit := qp.intRange("limit", 100, 1, 1000)
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT symbol, start_at, end_at, open_seconds, ongoing, reason, detail, detected_at, backfilled_at, backfilled_rows
+		FROM history_gaps
+		WHERE (? = '' OR symbol = ?) AND (? = '' OR reason = ?)
+		ORDER BY start_at DESC
+		LIMIT ?
+	`, symbol, symbol, reason, reason, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	gaps := []HistoryGap{}
+	for rows.Next() {
+		var g HistoryGap
+		if err := rows.Scan(&g.Symbol, &g.Start, &g.End, &g.OpenSeconds, &g.Ongoing, &g.Reason, &g.Detail, &g.DetectedAt, &g.BackfilledAt, &g.BackfilledRows); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		start, _ := time.Parse(time.RFC3339, g.Start)
+		end, _ := time.Parse(time.RFC3339, g.End)
+		g.DurationSeconds = int64(end.Sub(start).Seconds())
+		gaps = append(gaps, g)
+	}
+	closures := []string{}
+	for _, c := range cfg.MarketClosures {
+		closures = append(closures, c.spec)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"thresholdSeconds": int64(cfg.GapThreshold.Seconds()),
+		"marketClosures":   closures,
+		"timezone":         cfg.DailyCloseTZ.String(),
+		"gaps":             gaps,
+	})
+}
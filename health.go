@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// Component and overall health states, from best to worst.
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// minFreeDiskBytes is the free space on the DB volume below which the
+// service reports itself degraded.
+const minFreeDiskBytes = 100 << 20
+
+// HealthResponse is the /health body. Status is the worst of the
+// component statuses.
+type HealthResponse struct {
+	Status     string                    `json:"status"`
+	Mode       string                    `json:"mode"`
+	Components map[string]map[string]any `json:"components"`
+}
+
+// handleHealth reports per-component status. It returns 503 only when the
+// service cannot serve prices at all (database unreachable); degraded
+// states still return 200 so orchestrators don't restart a container
+// that is serving slightly stale data.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := checkHealth(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status == healthUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkHealth runs every component check; service registration reports
+// the same status.
+func checkHealth(ctx context.Context) HealthResponse {
+	resp := HealthResponse{
+		Status: healthOK,
+		Mode:   cfg.Mode,
+		Components: map[string]map[string]any{
+			"database": checkDatabase(ctx),
+			"poller":   checkPoller(),
+			"disk":     checkDisk(),
+		},
+	}
+	if cfg.Mode == "standby" {
+		resp.Components["sync"] = checkSync()
+	}
+	if leader != nil {
+		resp.Components["leader"] = checkLeader()
+	}
+	for _, c := range resp.Components {
+		resp.Status = worseHealth(resp.Status, c["status"].(string))
+	}
+	return resp
+}
+
+func checkDatabase(ctx context.Context) map[string]any {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	var one int
+	if err := database.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return map[string]any{"status": healthUnhealthy, "error": err.Error()}
+	}
+	result := map[string]any{
+		"status":    healthOK,
+		"latencyMs": float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	// Age of the newest cached price; the only freshness signal a replica has.
+	var newest string
+	if err := database.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(fetched_at), '') FROM gold_prices
+		WHERE symbol NOT IN (SELECT symbol FROM symbols WHERE active = 0)
+	`).Scan(&newest); err == nil && newest != "" {
+		result["newestFetchedAt"] = newest
+		if t, err := time.Parse(time.RFC3339, newest); err == nil {
+			age := clockSince(t)
+			result["ageSeconds"] = int64(age.Seconds())
+			if age > staleThreshold {
+				result["status"] = healthDegraded
+			}
+		}
+	}
+	return result
+}
+
+func checkPoller() map[string]any {
+	if !pollsUpstream() {
+		return map[string]any{"status": healthOK, "state": "disabled"}
+	}
+
+	poller.mu.Lock()
+	lastSuccess, fails, restarts := poller.lastSuccess, poller.consecutiveFails, poller.watchdogRestarts
+	failuresByClass := map[string]int{}
+	for class, n := range poller.failuresByClass {
+		failuresByClass[class] = n
+	}
+	poller.mu.Unlock()
+
+	// The poller has no explicit circuit breaker; it is "open" while
+	// backoffDuration has stretched retries beyond the normal interval.
+	breaker := "closed"
+	if backoffDuration(fails, poller.interval) > poller.interval {
+		breaker = "open"
+	}
+
+	result := map[string]any{
+		"status":              healthOK,
+		"state":               "running",
+		"consecutiveFailures": fails,
+		"failuresByClass":     failuresByClass,
+		"breaker":             breaker,
+		"watchdogRestarts":    restarts,
+	}
+	if lastSuccess.IsZero() {
+		result["status"] = healthDegraded
+	} else {
+		since := clockSince(lastSuccess)
+		result["lastSuccessAt"] = lastSuccess.UTC().Format(time.RFC3339)
+		result["sinceLastSuccessSeconds"] = int64(since.Seconds())
+		if since > staleThreshold {
+			result["status"] = healthDegraded
+		}
+	}
+	if breaker == "open" {
+		result["status"] = healthDegraded
+	}
+
+	// Cycles succeed when any symbol is cached, so also report active
+	// symbols whose latest fetch failed.
+	failing := []string{}
+	if rows, err := database.Query(`
+		SELECT symbol FROM symbol_fetch_status
+		WHERE ok = 0 AND symbol NOT IN (SELECT symbol FROM symbols WHERE active = 0)
+		ORDER BY symbol
+	`); err == nil {
+		for rows.Next() {
+			var symbol string
+			if rows.Scan(&symbol) == nil {
+				failing = append(failing, symbol)
+			}
+		}
+		rows.Close()
+	}
+	result["failingSymbols"] = failing
+	if len(failing) > 0 {
+		result["status"] = healthDegraded
+	}
+	return result
+}
+
+func checkDisk() map[string]any {
+	if cfg.DBDriver == "memory" {
+		return map[string]any{"status": healthOK, "storage": "memory"}
+	}
+	free, total, err := diskUsage(filepath.Dir(cfg.DBPath))
+	if err != nil {
+		// Unknown disk state shouldn't fail the healthcheck.
+		return map[string]any{"status": healthOK, "error": err.Error()}
+	}
+	status := healthOK
+	if free < minFreeDiskBytes {
+		status = healthDegraded
+	}
+	return map[string]any{
+		"status":     status,
+		"freeBytes":  free,
+		"totalBytes": total,
+	}
+}
+
+func worseHealth(a, b string) string {
+	rank := map[string]int{healthOK: 0, healthDegraded: 1, healthUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// scraperFlags remembers clients that requested a HONEYPOT_PATHS decoy.
+// No page or document links to the decoys, so only something crawling or
+// guessing URLs finds them. Flags are per process, like bans.
+type scraperFlags struct {
+	mu    sync.Mutex
+	flags map[string]*FlaggedScraper
+}
+
+// FlaggedScraper is one row of GET /admin/scrapers.
+type FlaggedScraper struct {
+	Client    string `json:"client"`
+	KeyName   string `json:"keyName,omitempty"`
+	UserAgent string `json:"userAgent"`
+	Path      string `json:"path"`
+	Hits      int    `json:"hits"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+	Until     string `json:"until"`
+	until     time.Time
+}
+
+var scrapers = &scraperFlags{flags: map[string]*FlaggedScraper{}}
+
+// flagged reports whether client hit a decoy within SCRAPER_FLAG_DURATION.
+func (s *scraperFlags) flagged(client string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.flags[client]
+	if f != nil && !now.Before(f.until) {
+		delete(s.flags, client)
+		return false
+	}
+	return f != nil
+}
+
+// flag records a decoy hit and reports whether it newly flagged client.
+// Each hit extends the flag.
+func (s *scraperFlags) flag(client, keyName, userAgent, path string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until := now.Add(cfg.ScraperFlagDuration)
+	f := s.flags[client]
+	fresh := f == nil || !now.Before(f.until)
+	if fresh {
+		f = &FlaggedScraper{Client: client, FirstSeen: now.UTC().Format(time.RFC3339)}
+		s.flags[client] = f
+	}
+	f.KeyName, f.UserAgent, f.Path = keyName, userAgent, path
+	f.Hits++
+	f.LastSeen = now.UTC().Format(time.RFC3339)
+	f.Until, f.until = until.UTC().Format(time.RFC3339), until
+	return fresh
+}
+
+// withHoneypot answers HONEYPOT_PATHS exactly like an unknown route and
+// flags the caller, per rateClient, as a scraper. While flagged, a client
+// gets SCRAPER_RATE_LIMIT_REQUESTS instead of its usual limit. It runs
+// outside withAccess so callers without a valid key are flagged too, and
+// inside withAbuseBans so the 404 counts towards a ban.
+func withHoneypot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(cfg.HoneypotPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := rateClient(r)
+		var keyName string
+		if k := requestAPIKey(r); k != nil {
+			keyName = k.Name
+		}
+		metrics.Count("honeypot.hits", 1, nil)
+		if scrapers.flag(client, keyName, r.UserAgent(), r.URL.Path, time.Now()) {
+			log.Printf("[honeypot] %s (%q) requested %s; flagged as a scraper for %v", client, r.UserAgent(), r.URL.Path, cfg.ScraperFlagDuration)
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// handleListScrapers serves GET /admin/scrapers: clients currently
+// flagged, most recently seen first.
+func handleListScrapers(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	scrapers.mu.Lock()
+	flags := []FlaggedScraper{}
+	for client, f := range scrapers.flags {
+		if !now.Before(f.until) {
+			delete(scrapers.flags, client)
+			continue
+		}
+		flags = append(flags, *f)
+	}
+	scrapers.mu.Unlock()
+	slices.SortFunc(flags, func(a, b FlaggedScraper) int { return b.until.Compare(a.until) })
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// handleUnflagScraper serves DELETE /admin/scrapers/{client}, for a client
+// that turned out to be legitimate.
+func handleUnflagScraper(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	scrapers.mu.Lock()
+	f, ok := scrapers.flags[client]
+	delete(scrapers.flags, client)
+	scrapers.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no scraper flag for "+client)
+		return
+	}
+	auditChange(r, f, nil)
+	logf(r.Context(), "[honeypot] Scraper flag on %s cleared", client)
+	w.WriteHeader(http.StatusNoContent)
+}
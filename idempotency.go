@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyRetention is how long a stored response can be replayed.
+const idempotencyRetention = 24 * time.Hour
+
+// idempotencyMu serializes keyed writes so two concurrent retries with the
+// same key can't both execute. Keyed writes are rare enough for one lock.
+var idempotencyMu sync.Mutex
+
+// bodyRecorder keeps a copy of the response for later replay.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bodyRecorder) WriteHeader(code int) {
+	b.status = code
+	b.ResponseWriter.WriteHeader(code)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	b.body.Write(p)
+	return b.ResponseWriter.Write(p)
+}
+
+// idempotent honors the Idempotency-Key header on write requests: the
+// first response for a key is stored, and a retry with the same key and
+// the same request gets that response back (with Idempotent-Replayed:
+// true) instead of running the handler again. Reusing a key for a
+// different request is rejected with 422. Keys are stored per rateClient,
+// so one caller can't replay, or collide with, another caller's key. 5xx
+// responses are not stored, so a retry after a server error runs again.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		key = rateClient(r) + " " + key
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+
+		var storedFingerprint, contentType string
+		var status int
+		var storedBody []byte
+		err = database.QueryRow(`
+			SELECT fingerprint, status, content_type, body FROM idempotency_keys
+			WHERE key = ? AND created_at >= ?
+		`, key, time.Now().UTC().Add(-idempotencyRetention).Format(time.RFC3339)).Scan(&storedFingerprint, &status, &contentType, &storedBody)
+		switch {
+		case err == nil && storedFingerprint != fingerprint:
+			writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			return
+		case err == nil:
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(status)
+			w.Write(storedBody)
+			return
+		case !errors.Is(err, sql.ErrNoRows):
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status >= 500 {
+			return
+		}
+		now := time.Now().UTC()
+		_, err = database.Exec(`
+			INSERT OR REPLACE INTO idempotency_keys (key, fingerprint, status, content_type, body, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, key, fingerprint, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), now.Format(time.RFC3339))
+		if err != nil {
+			log.Printf("[idempotency] Storing response for key %q failed: %v", key, err)
+			return
+		}
+		database.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", now.Add(-idempotencyRetention).Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// integrityProblemLimit caps how many problems integrity_check reports.
+const integrityProblemLimit = 100
+
+// checkIntegrity runs PRAGMA integrity_check (or quick_check) on db and
+// returns the problems found; none means the database is sound. A check
+// that cannot run at all, e.g. "file is not a database", is reported as a
+// problem too.
+func checkIntegrity(ctx context.Context, db *sql.DB, quick bool) []string {
+	pragma := "integrity_check"
+	if quick {
+		pragma = "quick_check"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA %s(%d)", pragma, integrityProblemLimit))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return append(problems, err.Error())
+		}
+		// Skip "ok" and the "*** in database main ***" header line.
+		if line != "ok" && !strings.HasPrefix(line, "*** in database") {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// checkIntegrityAtBoot checks the database file before it is opened for
+// serving. When it is corrupt and DB_AUTO_REPAIR is on, the file is moved
+// aside and the latest backup snapshot restored in its place; otherwise
+// the problems are only logged. Replicas never repair: their file belongs
+// to the primary.
+func checkIntegrityAtBoot(ctx context.Context, dbPath string, backups *backupStore) {
+	if cfg.DBIntegrityCheck == "off" {
+		return
+	}
+	if info, err := os.Stat(dbPath); err != nil || info.Size() == 0 {
+		return // nothing to check yet
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		log.Printf("[integrity] Opening %s failed: %v", dbPath, err)
+		return
+	}
+	start := time.Now()
+	problems := checkIntegrity(ctx, db, cfg.DBIntegrityCheck == "quick")
+	db.Close()
+	if len(problems) == 0 {
+		log.Printf("[integrity] %s check of %s passed in %v", cfg.DBIntegrityCheck, dbPath, time.Since(start).Round(time.Millisecond))
+		return
+	}
+	log.Printf("[integrity] %s is corrupt (%d problems), first: %s", dbPath, len(problems), problems[0])
+
+	switch {
+	case cfg.Mode == "replica" || cfg.DryRun:
+		return
+	case !cfg.DBAutoRepair:
+		log.Println("[integrity] Set DB_AUTO_REPAIR=true with backups configured to restore automatically")
+		return
+	case backups == nil:
+		log.Println("[integrity] DB_AUTO_REPAIR is on but no BACKUP_S3_ENDPOINT is configured; cannot repair")
+		return
+	}
+	key, err := backups.findSnapshot(ctx, time.Time{})
+	if err != nil || key == "" {
+		log.Printf("[integrity] No snapshot to repair from (err: %v)", err)
+		return
+	}
+	aside := fmt.Sprintf("%s.corrupt-%s", dbPath, time.Now().UTC().Format(snapshotTimeFormat))
+	if err := os.Rename(dbPath, aside); err != nil {
+		log.Printf("[integrity] Moving corrupt database aside failed: %v", err)
+		return
+	}
+	if err := backups.restore(ctx, key, dbPath); err != nil {
+		log.Printf("[integrity] Restoring %s failed, putting the corrupt file back: %v", key, err)
+		os.Rename(aside, dbPath)
+		return
+	}
+	log.Printf("[integrity] Restored %s; corrupt database kept at %s", key, aside)
+}
+
+// handleDBCheck serves POST /admin/db/check: a full integrity_check of the
+// live database (?quick=true for quick_check). It only reports; a corrupt
+// database is repaired at the next start when DB_AUTO_REPAIR is on.
+func handleDBCheck(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	quick := qp.bool("quick")
+	if !qp.valid(w) {
+		return
+	}
+	start := time.Now()
+	problems := checkIntegrity(r.Context(), database, quick)
+	if problems == nil {
+		problems = []string{}
+	}
+	logf(r.Context(), "[integrity] Admin check found %d problems", len(problems))
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ok":         len(problems) == 0,
+		"quick":      quick,
+		"problems":   problems,
+		"durationMs": time.Since(start).Milliseconds(),
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir holds the in-cluster credentials Kubernetes mounts
+// into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// leaseTimeFormat is the MicroTime format of Lease timestamps.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// k8sLease is the part of a coordination.k8s.io/v1 Lease the election
+// reads and writes.
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// leaderLease elects the pod that polls with a Kubernetes Lease, the way
+// client-go's leader election does: the holder renews every third of
+// LEADER_LEASE_DURATION, and another pod takes over once it has seen the
+// same renewTime for a whole duration. Expiry is judged by when this pod
+// observed the record, not by the timestamps in it, so clock skew between
+// nodes doesn't matter.
+type leaderLease struct {
+	leases   string // the namespace's leases on the in-cluster API server
+	name     string
+	url      string
+	identity string
+	duration time.Duration
+	client   *http.Client
+	done     chan struct{}
+
+	mu          sync.Mutex
+	held        bool
+	holder      string
+	heldSince   time.Time
+	lastRenew   time.Time // last successful renewal while held
+	lastError   string
+	transitions int
+
+	observed   string // holder and renewTime last read
+	observedAt time.Time
+}
+
+// leader is nil unless LEADER_ELECTION=kubernetes.
+var leader *leaderLease
+
+func newLeaderLease(c Config) (*leaderLease, error) {
+	if c.LeaderElection == "none" {
+		return nil, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("LEADER_ELECTION=kubernetes must run in a cluster (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	namespace := c.LeaderLeaseNamespace
+	if namespace == "" {
+		raw, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("LEADER_LEASE_NAMESPACE is unset and the pod namespace is unreadable: %w", err)
+		}
+		namespace = strings.TrimSpace(string(raw))
+	}
+	identity := c.LeaderIdentity
+	if identity == "" {
+		var err error
+		if identity, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("LEADER_IDENTITY is unset and the hostname is unknown: %w", err)
+		}
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading the cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("the cluster CA has no certificates")
+	}
+	leases := fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), namespace)
+	return &leaderLease{
+		leases:   leases,
+		name:     c.LeaderLeaseName,
+		url:      leases + "/" + c.LeaderLeaseName,
+		identity: identity,
+		duration: c.LeaderLeaseDuration,
+		done:     make(chan struct{}),
+		client: &http.Client{
+			Timeout:   c.LeaderLeaseDuration / 3,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// isHeld reports whether this pod currently holds the lease.
+func (l *leaderLease) isHeld() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// run competes for the lease every third of its duration until ctx is
+// cancelled. While held, the poller and jobs run on a context of their
+// own that is cancelled when the lease is lost. A holder that cannot
+// renew steps down after two thirds of the duration, before anyone else
+// may take over. On shutdown the lease is released so another pod takes
+// over at once, and done is closed.
+func (l *leaderLease) run(ctx context.Context, p *brsProvider, pollInterval time.Duration, jobs []func(context.Context)) {
+	defer close(l.done)
+	var stopTerm context.CancelFunc
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	for {
+		wasHeld := l.isHeld()
+		err := l.tryAcquireOrRenew(ctx)
+		now := time.Now()
+		l.mu.Lock()
+		switch {
+		case err == nil:
+			l.lastError = ""
+		case ctx.Err() == nil:
+			l.lastError = err.Error()
+			log.Printf("[leader] Lease %s: %v", l.name, err)
+			if l.held && now.Sub(l.lastRenew) >= 2*l.duration/3 {
+				l.held = false
+			}
+		}
+		held := l.held
+		if held && !wasHeld {
+			l.heldSince = now
+		}
+		l.mu.Unlock()
+
+		switch {
+		case held && !wasHeld:
+			log.Printf("[leader] %s acquired the lease; starting the poller", l.identity)
+			var termCtx context.Context
+			termCtx, stopTerm = context.WithCancel(ctx)
+			go func() {
+				if err := pollOnce(termCtx, p); err != nil {
+					poller.recordFailure(err)
+				} else {
+					poller.recordSuccess()
+				}
+				runSupervisedPoller(termCtx, p, pollInterval, cfg.PollerWatchdogMultiple)
+			}()
+			for _, job := range jobs {
+				go job(termCtx)
+			}
+		case !held && wasHeld:
+			log.Printf("[leader] %s lost the lease; stopped polling", l.identity)
+			stopTerm()
+		}
+		heldGauge := 0.0
+		if held {
+			heldGauge = 1
+		}
+		metrics.Gauge("leader.held", heldGauge, nil)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if stopTerm != nil {
+				stopTerm()
+			}
+			if held {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := l.release(releaseCtx); err != nil {
+					log.Printf("[leader] Releasing the lease failed: %v", err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew reads the lease and writes this pod into it if it is
+// free, expired or already ours. A write that loses a race to another pod
+// fails on resourceVersion and is simply tried again next round.
+func (l *leaderLease) tryAcquireOrRenew(ctx context.Context) error {
+	now := time.Now()
+	var lease k8sLease
+	status, err := l.call(ctx, http.MethodGet, l.url, nil, &lease)
+	if status == http.StatusNotFound {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name = l.name
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.LeaseDurationSeconds = int(l.duration.Seconds())
+		lease.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+		lease.Spec.RenewTime = lease.Spec.AcquireTime
+		status, err := l.call(ctx, http.MethodPost, l.leases, lease, &lease)
+		if status == http.StatusConflict {
+			return nil // another pod created it first
+		}
+		if err != nil {
+			return err
+		}
+		l.acquired(lease, now)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	if record := lease.Spec.HolderIdentity + " " + lease.Spec.RenewTime; record != l.observed {
+		l.observed, l.observedAt = record, now
+	}
+	l.holder = lease.Spec.HolderIdentity
+	l.transitions = lease.Spec.LeaseTransitions
+	expires := l.observedAt.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+	l.mu.Unlock()
+
+	ours := lease.Spec.HolderIdentity == l.identity
+	if !ours && lease.Spec.HolderIdentity != "" && now.Before(expires) {
+		l.mu.Lock()
+		l.held = false
+		l.mu.Unlock()
+		return nil
+	}
+	if !ours {
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(l.duration.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+	status, err = l.call(ctx, http.MethodPut, l.url, lease, &lease)
+	if status == http.StatusConflict {
+		return nil // another pod wrote first; look again next round
+	}
+	if err != nil {
+		return err
+	}
+	l.acquired(lease, now)
+	return nil
+}
+
+func (l *leaderLease) acquired(lease k8sLease, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held, l.lastRenew = true, now
+	l.holder, l.transitions = lease.Spec.HolderIdentity, lease.Spec.LeaseTransitions
+	l.observed, l.observedAt = lease.Spec.HolderIdentity+" "+lease.Spec.RenewTime, now
+}
+
+// release clears the holder, as client-go does on cancel, so the next pod
+// does not wait out the duration.
+func (l *leaderLease) release(ctx context.Context) error {
+	var lease k8sLease
+	if _, err := l.call(ctx, http.MethodGet, l.url, nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = time.Now().UTC().Format(leaseTimeFormat)
+	_, err := l.call(ctx, http.MethodPut, l.url, lease, nil)
+	return err
+}
+
+// call sends one request to the API server with the pod's service account
+// token, which is re-read each time since Kubernetes rotates it.
+func (l *leaderLease) call(ctx context.Context, method, target string, body, out any) (int, error) {
+	var r io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return 0, err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, fmt.Errorf("reading the service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s lease returned %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding lease: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// checkLeader is the /health component of LEADER_ELECTION=kubernetes. Not
+// holding the lease is normal; being unable to reach it is degraded.
+func checkLeader() map[string]any {
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	result := map[string]any{
+		"status":      healthOK,
+		"identity":    leader.identity,
+		"held":        leader.held,
+		"holder":      leader.holder,
+		"transitions": leader.transitions,
+	}
+	if leader.held {
+		result["heldSince"] = leader.heldSince.UTC().Format(time.RFC3339)
+	}
+	if leader.lastError != "" {
+		result["status"] = healthDegraded
+		result["lastError"] = leader.lastError
+	}
+	return result
+}
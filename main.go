@@ -3,11 +3,10 @@ package main
 import (
 	"context"
 	"database/sql"
-	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
-	"net"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,250 +18,800 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-// GoldPrice is the response and DB model.
+// GoldPrice is the response and DB model. With a PRICE_ROUNDING rule,
+// Price is rounded and PriceRaw holds the cached value.
 type GoldPrice struct {
-	Name      string `json:"name"`
-	Price     int64  `json:"price"`
-	FetchedAt string `json:"fetchedAt"`
-	Stale     bool   `json:"stale"`
+	Name     string        `json:"name"`
+	Price    int64         `json:"price"`
+	PriceRaw *int64        `json:"priceRaw,omitempty"`
+	Rounding *RoundingRule `json:"rounding,omitempty"`
+	Sides
+	FetchedAt      string `json:"fetchedAt"`
+	FetchedAtMs    *int64 `json:"fetchedAtMs,omitempty"`
+	Stale          bool   `json:"stale"`
+	ManualOverride bool   `json:"manualOverride"`
 }
 
-// BrsApiResponse is the shape of the BRS API response.
+// GoldPriceVerbose adds fetch provenance and the change against the
+// previous daily close, served with ?verbose=true.
+type GoldPriceVerbose struct {
+	GoldPrice
+	Source          string      `json:"source"`
+	FetchDurationMs int64       `json:"fetchDurationMs"`
+	Attempt         int         `json:"attempt"`
+	PreviousClose   *DailyClose `json:"previousClose"`
+	Change          *int64      `json:"change"`
+	ChangePercent   *float64    `json:"changePercent"`
+}
+
+// BrsApiResponse is the shape of the BRS API response. Items are spread
+// over per-market sections.
 type BrsApiResponse struct {
-	Gold []BrsApiItem `json:"gold"`
+	Gold           []BrsApiItem `json:"gold"`
+	Currency       []BrsApiItem `json:"currency"`
+	Cryptocurrency []BrsApiItem `json:"cryptocurrency"`
+}
+
+// items returns every item across the sections.
+func (r *BrsApiResponse) items() []*BrsApiItem {
+	var all []*BrsApiItem
+	for _, section := range [][]BrsApiItem{r.Gold, r.Currency, r.Cryptocurrency} {
+		for i := range section {
+			all = append(all, &section[i])
+		}
+	}
+	return all
 }
 
-// BrsApiItem is a single market item from BRS API.
+// BrsApiItem is a single market item from BRS API. Buy and Sell are the
+// dealer's two sides for the instruments quoted that way, else 0.
 type BrsApiItem struct {
 	Symbol string  `json:"symbol"`
 	Name   string  `json:"name"`
 	Price  float64 `json:"price"`
+	Buy    float64 `json:"buy"`
+	Sell   float64 `json:"sell"`
+
+	// Set by tolerant decoding (decode.go): why the item is unusable, and
+	// whether its price had to be read from a string.
+	malformed string
+	coerced   bool
 }
 
+// brsSource is the provider name recorded with prices fetched from BrsApi.ir.
+const brsSource = "brsapi"
+
+// brsAPIURL is the default BrsApi.ir gold and currency market endpoint.
+const brsAPIURL = "https://BrsApi.ir/Api/Market/Gold_Currency.php"
+
 var (
 	database       *sql.DB
 	pollMu         sync.Mutex
 	staleThreshold = 5 * time.Minute
-	consecutiveFails int
+	poller         pollerStatus
+	// primaryProvider is the provider prices are served from; set once
+	// in main.
+	primaryProvider *brsProvider
 )
 
+// errFetchInProgress is returned by fetchAndCache when another fetch holds
+// the overlap guard. It is neither a success nor a failure.
+var errFetchInProgress = errors.New("previous fetch still in progress")
+
+// pollerStatus is written by the poller and read by /health.
+type pollerStatus struct {
+	interval         time.Duration
+	mu               sync.Mutex
+	lastSuccess      time.Time
+	consecutiveFails int
+	failuresByClass  map[string]int
+	nextCycle        time.Time // when runPoller plans its next fetch
+	watchdogRestarts int
+}
+
+// recordSuccess resets the failure count and returns its previous value.
+func (p *pollerStatus) recordSuccess() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fails := p.consecutiveFails
+	p.consecutiveFails = 0
+	p.lastSuccess = clock.Now()
+	return fails
+}
+
+// recordFailure increments the failure count and the lifetime counter
+// for err's class, returning the new consecutive count.
+func (p *pollerStatus) recordFailure(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consecutiveFails++
+	if p.failuresByClass == nil {
+		p.failuresByClass = map[string]int{}
+	}
+	p.failuresByClass[errorClass(err)]++
+	return p.consecutiveFails
+}
+
 func main() {
-	port := envOrDefault("PORT", "8080")
-	apiKey := os.Getenv("BRS_API_KEY")
-	if apiKey == "" {
-		log.Fatal("BRS_API_KEY environment variable is required")
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	cfg.logSummary()
+	if cfg.ClockMode == "simulated" {
+		start := cfg.SimClockStart
+		if start.IsZero() {
+			start = time.Now()
+		}
+		clock = newSimClock(start.Round(0), cfg.SimClockSpeed)
+		log.Printf("[clock] Simulated time from %s at %dx; timestamps written now are not real", start.UTC().Format(time.RFC3339), cfg.SimClockSpeed)
 	}
 
-	pollSeconds, _ := strconv.Atoi(envOrDefault("POLL_INTERVAL", "60"))
-	pollInterval := time.Duration(pollSeconds) * time.Second
+	// The key may also come from a file, Vault or AWS Secrets Manager; see
+	// secretSourceFromEnv.
+	apiKey, apiKeySource, err := loadSecret("BRS_API_KEY")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if apiKeySource == nil && cfg.Mode != "replica" {
+		log.Fatal("BRS_API_KEY environment variable is required (or BRS_API_KEY_FILE, BRS_API_KEY_VAULT_PATH, BRS_API_KEY_AWS_SECRET_ID)")
+	}
+	if err := configureUpstream(cfg); err != nil {
+		log.Fatalf("[upstream] %v", err)
+	}
+	if cfg.MetricsBackend != "prometheus" {
+		sink, err := newStatsdSink(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics = sink
+	}
+	primary := &brsProvider{
+		name:      brsSource,
+		url:       cfg.BRSAPIURL,
+		apiKey:    apiKey,
+		keySource: apiKeySource,
+		headers:   cfg.UpstreamHeaders,
+		keyHeader: cfg.BRSAPIKeyHeader,
+	}
+	primaryProvider = primary
+	refreshes.interval = cfg.RefreshMinInterval
+	revalidations.interval = cfg.RevalidateDebounce
+
+	queryCache.ttl, queryCache.max = cfg.QueryCacheTTL, cfg.QueryCacheMaxEntries
+
+	pollInterval := cfg.PollInterval
+	poller.interval = pollInterval
+	dbPath := cfg.DBPath
+
+	// Optional snapshot shipping to S3-compatible storage
+	backups := newBackupStore(cfg)
+	if backups != nil && cfg.Mode == "primary" && !cfg.DryRun && cfg.DBDriver == "sqlite" {
+		if spec := cfg.BackupRestoreAt; spec != "" {
+			if err := backups.restoreAt(context.Background(), dbPath, spec); err != nil {
+				log.Fatalf("[backup] Restore failed: %v", err)
+			}
+		} else if cfg.BackupWarmStart {
+			backups.warmStart(context.Background(), dbPath)
+		}
+	}
 
-	dbPath := envOrDefault("DB_PATH", "/data/gold.db")
+	if cfg.DBDriver == "sqlite" {
+		checkIntegrityAtBoot(context.Background(), dbPath, backups)
+	}
 
-	// Initialize SQLite
-	var err error
-	database, err = sql.Open("sqlite", dbPath)
+	// Initialize SQLite. Replicas open the file read-only so they can
+	// never write to storage owned by the primary.
+	database, err = sql.Open("sqlite", sqliteDSN(cfg))
 	if err != nil {
 		log.Fatalf("Failed to open SQLite: %v", err)
 	}
 	defer database.Close()
+	database.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	database.SetMaxIdleConns(cfg.DBMaxIdleConns)
 
-	// WAL mode for better concurrent reads
-	database.Exec("PRAGMA journal_mode=WAL")
-
-	// Create table
-	_, err = database.Exec(`
-		CREATE TABLE IF NOT EXISTS gold_prices (
-			symbol     TEXT PRIMARY KEY,
-			name       TEXT NOT NULL,
-			price_rial INTEGER NOT NULL,
-			fetched_at TEXT NOT NULL
-		)
-	`)
-	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
-	}
+	// Cancelled on SIGINT/SIGTERM, which aborts any in-flight poll.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Initial fetch before starting the HTTP server
-	log.Println("[poller] Initial fetch...")
-	if err := fetchAndCache(apiKey); err != nil {
-		log.Printf("[poller] Initial fetch failed: %v (will retry on next tick)", err)
+	if err := setupRateLocks(ctx, cfg.SecretsRefreshInterval); err != nil {
+		log.Fatalf("[ratelock] %v", err)
+	}
+	if cfg.MetricsBackend != "prometheus" {
+		go pushPriceGauges(ctx, cfg.MetricsPushInterval)
 	}
 
-	// Start background poller with backoff
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if cfg.Mode == "replica" {
+		log.Printf("[replica] Serving reads from %s, upstream polling disabled", dbPath)
+	} else {
+		// WAL mode for better concurrent reads; memdb keeps its own
+		// in-memory journal. A dry run opens a file read-only and leaves
+		// its schema as it is.
+		switch {
+		case cfg.DBDriver != "sqlite":
+			log.Println("[db] Using in-memory storage; data is lost on exit")
+		case cfg.DryRun:
+			log.Printf("[dry-run] Reading %s read-only", dbPath)
+		default:
+			database.Exec("PRAGMA journal_mode=WAL")
+		}
 
-	go func() {
-		timer := time.NewTimer(pollInterval)
-		defer timer.Stop()
-		for {
-			select {
-			case <-timer.C:
-				if err := fetchAndCache(apiKey); err != nil {
-					consecutiveFails++
-					wait := backoffDuration(consecutiveFails, pollInterval)
-					log.Printf("[poller] Fetch failed (%d consecutive): %v — next retry in %v", consecutiveFails, err, wait)
-					timer.Reset(wait)
-				} else {
-					if consecutiveFails > 0 {
-						log.Printf("[poller] Recovered after %d consecutive failures", consecutiveFails)
-					}
-					consecutiveFails = 0
-					timer.Reset(pollInterval)
+		if cfg.DBDriver != "sqlite" || !cfg.DryRun {
+			if err := migrate(); err != nil {
+				log.Fatalf("Failed to migrate schema: %v", err)
+			}
+			if err := preparePollStatements(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if cfg.DryRun {
+			log.Printf("[dry-run] Polling without storing prices, sending notifications or running background jobs")
+		}
+
+		// Everything below writes or notifies.
+		if !cfg.DryRun {
+			if seedPath := cfg.SeedFile; seedPath != "" {
+				if err := loadSeedFile(seedPath); err != nil {
+					log.Fatalf("[seed] Failed to load %s: %v", seedPath, err)
 				}
-			case <-ctx.Done():
-				return
 			}
 		}
-	}()
+		// Jobs only the primary runs. A standby leaves notifications and
+		// exports to the primary, even while failed over, so nobody gets
+		// them twice; with LEADER_ELECTION they run only on the lease
+		// holder, for as long as it holds it.
+		var leaderJobs []func(context.Context)
+		if !cfg.DryRun && cfg.Mode == "primary" {
+			if tickSink, err = newClickhouseSink(cfg); err != nil {
+				log.Fatalf("[clickhouse] %v", err)
+			}
+			if tickSink != nil {
+				go tickSink.run(ctx)
+				if tickSink.pwSource != nil && !tickSink.pwSource.static {
+					go refreshSecret(ctx, "CLICKHOUSE_PASSWORD", tickSink.pwSource, tickSink.password, cfg.SecretsRefreshInterval)
+				}
+			}
+			if publisher, err = newTelegramPublisher(cfg); err != nil {
+				log.Fatalf("[telegram] %v", err)
+			}
+			if publisher != nil {
+				leaderJobs = append(leaderJobs, publisher.run)
+				if !publisher.tokenSource.static {
+					go refreshSecret(ctx, "TELEGRAM_BOT_TOKEN", publisher.tokenSource, publisher.token, cfg.SecretsRefreshInterval)
+				}
+			}
+			if sheets, err = newSheetsExporter(cfg); err != nil {
+				log.Fatalf("[sheets] %v", err)
+			}
+			if sheets != nil {
+				leaderJobs = append(leaderJobs, sheets.run)
+				if !sheets.credsSource.static {
+					go refreshSecret(ctx, "GOOGLE_SHEETS_CREDENTIALS", sheets.credsSource, sheets.credentials, cfg.SecretsRefreshInterval)
+				}
+			}
+			if delivery, err = newFileDelivery(cfg); err != nil {
+				log.Fatalf("[delivery] %v", err)
+			}
+			if delivery != nil {
+				leaderJobs = append(leaderJobs, delivery.run)
+			}
+		}
+
+		if !cfg.DryRun {
+			go runFreshnessSampler(ctx, cfg.FreshnessSampleInterval)
+			go runCandleCompactor(ctx)
+		}
+		// A standby gets gaps filled through the primary's candles.
+		if !cfg.DryRun && cfg.Mode == "primary" {
+			if gapBackfill, err = newBackfillSource(cfg); err != nil {
+				log.Fatal(err)
+			}
+			if gapBackfill != nil {
+				go gapBackfill.watchKey(ctx, cfg.SecretsRefreshInterval)
+			}
+			leaderJobs = append(leaderJobs, runGapDetector)
+		}
+
+		secretsInterval := cfg.SecretsRefreshInterval
+		go primary.watchKey(ctx, "BRS_API_KEY", secretsInterval)
+
+		shadow, err := newShadowProvider(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if shadow != nil && !cfg.DryRun && cfg.Mode == "primary" {
+			log.Printf("[shadow] Comparing %q against %s", shadow.name, brsSource)
+			go shadow.watchKey(ctx, "SHADOW_PROVIDER_KEY", secretsInterval)
+			leaderJobs = append(leaderJobs,
+				func(ctx context.Context) { runShadowPoller(ctx, shadow, pollInterval) },
+				func(ctx context.Context) { runCanaryReporter(ctx, shadow.name, cfg.CanaryReportInterval) })
+		}
+
+		if backups != nil && !cfg.DryRun && cfg.Mode == "primary" {
+			leaderJobs = append(leaderJobs, func(ctx context.Context) { backups.run(ctx, dbPath, cfg.BackupInterval) })
+		}
+
+		if leader, err = newLeaderLease(cfg); err != nil {
+			log.Fatalf("[leader] %v", err)
+		}
+		switch {
+		case cfg.Mode == "standby":
+			log.Printf("[sync] Standby of %s; polling upstream only after %v without a pull", cfg.SyncPrimaryURL, cfg.SyncFailoverAfter)
+			go runStandby(ctx, primary, pollInterval)
+		case leader != nil:
+			log.Printf("[leader] Polling only while holding lease %s as %s", leader.name, leader.identity)
+			go leader.run(ctx, primary, pollInterval, leaderJobs)
+		default:
+			// Initial fetch before starting the HTTP server
+			log.Println("[poller] Initial fetch...")
+			if err := pollOnce(ctx, primary); err != nil {
+				poller.recordFailure(err)
+				log.Printf("[poller] Initial fetch failed (%s): %v (will retry on next tick)", errorClass(err), err)
+			} else {
+				poller.recordSuccess()
+			}
+
+			// Start background poller with backoff
+			go runSupervisedPoller(ctx, primary, pollInterval, cfg.PollerWatchdogMultiple)
+			for _, job := range leaderJobs {
+				go job(ctx)
+			}
+		}
+	}
+
+	if err := loadAccess(ctx); err != nil {
+		log.Fatalf("[access] %v", err)
+	}
+	if err := loadFlags(ctx); err != nil {
+		log.Fatalf("[flags] %v", err)
+	}
+	go runAccessReloader(ctx, cfg.AccessReloadInterval)
 
 	// HTTP server
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/gold/18k", handleGold18k)
+	mux.HandleFunc("GET /api/gold/18k/candles", cachedQuery("gold_18k", handleCandles))
+	mux.HandleFunc("GET /api/gold/18k/extremes", cachedQuery("gold_18k", handleExtremes))
+	mux.HandleFunc("GET /api/gold/18k/records", handleRecords)
+	mux.HandleFunc("GET /api/gold/18k/at", cachedQuery("gold_18k", handleGoldAt))
+	mux.HandleFunc("GET /api/gold/18k/crypto", requireFlag("convert", handleGoldInCrypto))
+	mux.HandleFunc("GET /api/gold/{alias}", handleGoldAlias)
+	mux.HandleFunc("GET /api/freshness", handleFreshness)
+	mux.HandleFunc("GET /api/triggers/price-crossed", handlePriceCrossedTrigger)
+	mux.HandleFunc("GET /api/triggers/records", handleRecordTrigger)
+	mux.HandleFunc("GET /api/convert", requireFlag("convert", handleConvert))
+	mux.HandleFunc("PUT /api/watchlists/{id}", requireFlag("watchlists", handlePutWatchlist))
+	mux.HandleFunc("GET /api/watchlists/{id}", requireFlag("watchlists", handleGetWatchlist))
+	mux.HandleFunc("DELETE /api/watchlists/{id}", requireFlag("watchlists", handleDeleteWatchlist))
+	mux.HandleFunc("GET /api/watchlists/{id}/prices", requireFlag("watchlists", handleWatchlistPrices))
+	mux.HandleFunc("POST /api/snapshots", requireFlag("snapshots", idempotent(handleCreateSnapshot)))
+	mux.HandleFunc("GET /api/snapshots/{id}", requireFlag("snapshots", handleGetSnapshot))
+	mux.HandleFunc("POST /api/rate-locks", idempotent(handleCreateRateLock))
+	mux.HandleFunc("POST /api/rate-locks/verify", handleVerifyRateLock)
 	mux.HandleFunc("GET /health", handleHealth)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /admin/providers/diff", requireRole(roleViewer, handleProviderDiff))
+	mux.HandleFunc("GET /admin/providers/canary", requireRole(roleViewer, handleCanaryReports))
+	mux.HandleFunc("POST /admin/providers/canary", requireRole(roleOperator, handleRunCanaryReport))
+	mux.HandleFunc("GET /admin/fetch-log", requireRole(roleViewer, handleFetchLog))
+	mux.HandleFunc("GET /admin/anomalies", requireRole(roleViewer, handleAnomalies))
+	mux.HandleFunc("GET /admin/gaps", requireRole(roleViewer, handleGaps))
+	mux.HandleFunc("GET /internal/sync", handleSync)
+	mux.HandleFunc("GET /admin/upstream/stats", requireRole(roleViewer, handleUpstreamStats))
+	mux.HandleFunc("PUT /admin/prices/{symbol}", requireAdmin(handlePriceOverride))
+	mux.HandleFunc("GET /admin/symbols", requireRole(roleViewer, handleListSymbols))
+	mux.HandleFunc("PUT /admin/symbols/{symbol}", requireAdmin(handleSetSymbol))
+	mux.HandleFunc("PUT /admin/symbols/{symbol}/aliases/{alias}", requireAdmin(handlePutSymbolAlias))
+	mux.HandleFunc("DELETE /admin/symbols/{symbol}/aliases/{alias}", requireAdmin(handleDeleteSymbolAlias))
+	mux.HandleFunc("GET /admin/audit", requireRole(roleViewer, handleAudit))
+	mux.HandleFunc("GET /admin/audit/export", requireAdmin(handleAuditExport))
+	mux.HandleFunc("POST /admin/db/check", requireRole(roleOperator, handleDBCheck))
+	mux.HandleFunc("GET /admin/api-keys", requireAdmin(handleListAPIKeys))
+	mux.HandleFunc("POST /admin/api-keys", requireAdmin(handleCreateAPIKey))
+	mux.HandleFunc("DELETE /admin/api-keys/{id}", requireAdmin(handleRevokeAPIKey))
+	mux.HandleFunc("PUT /admin/api-keys/{id}/limits", requireAdmin(handleSetAPIKeyLimits))
+	mux.HandleFunc("GET /admin/bans", requireRole(roleViewer, handleListBans))
+	mux.HandleFunc("DELETE /admin/bans/{client}", requireRole(roleOperator, handleLiftBan))
+	mux.HandleFunc("GET /admin/scrapers", requireRole(roleViewer, handleListScrapers))
+	mux.HandleFunc("DELETE /admin/scrapers/{client}", requireRole(roleOperator, handleUnflagScraper))
+	mux.HandleFunc("GET /admin/ip-rules", requireRole(roleViewer, handleGetIPRules))
+	mux.HandleFunc("PUT /admin/ip-rules", requireAdmin(handlePutIPRules))
+	mux.HandleFunc("POST /admin/access/reload", requireRole(roleOperator, handleReloadAccess))
+	mux.HandleFunc("GET /admin/config/export", requireAdmin(handleExportConfig))
+	mux.HandleFunc("PUT /admin/config/export", requireAdmin(handleImportConfig))
+	mux.HandleFunc("GET /admin/flags", requireRole(roleViewer, handleListFlags))
+	mux.HandleFunc("PUT /admin/flags/{name}", requireAdmin(handleSetFlag))
+	mux.HandleFunc("DELETE /admin/flags/{name}", requireAdmin(handleDeleteFlag))
+	mux.HandleFunc("GET /admin/clock", requireRole(roleViewer, handleGetClock))
+	mux.HandleFunc("POST /admin/clock/advance", requireRole(roleOperator, handleAdvanceClock))
+	mux.HandleFunc("GET /admin/telegram/posts", requireRole(roleViewer, handleTelegramPosts))
+	mux.HandleFunc("POST /admin/telegram/post", requireRole(roleOperator, handleTelegramPost))
+	mux.HandleFunc("POST /admin/sheets/export", requireRole(roleOperator, handleSheetsExport))
+	mux.HandleFunc("GET /admin/deliveries", requireRole(roleViewer, handleDeliveries))
+	mux.HandleFunc("POST /admin/deliveries", requireRole(roleOperator, handleDeliverNow))
 
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
+		Addr:              ":" + strconv.Itoa(cfg.Port),
+		Handler:           withTrace(withFieldCase(withEnvelope(withAbuseBans(withHoneypot(withAccess(withRateLimit(withDryRun(withStandby(mux))))))))),
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+	}
+
+	// The registrar is created before the shutdown goroutine, which waits
+	// on it.
+	if discovery, err = newDiscoveryRegistrar(cfg); err != nil {
+		log.Fatalf("[discovery] %v", err)
+	}
+	if discovery != nil {
+		go discovery.run(ctx)
 	}
 
-	// Graceful shutdown
+	// Graceful shutdown. ListenAndServe returns as soon as it starts, so
+	// main waits for the drain to finish.
+	drained := make(chan struct{})
 	go func() {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-		<-sigCh
+		<-ctx.Done()
+		stop() // a second signal kills the process
 		log.Println("Shutting down...")
-		cancel()
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer shutdownCancel()
-		server.Shutdown(shutdownCtx)
+		if discovery != nil {
+			<-discovery.done // deregistered, so no new callers are sent here
+		}
+		if leader != nil {
+			<-leader.done // released, so another pod takes over polling
+		}
+		shutdownServer(server)
+		close(drained)
 	}()
 
-	log.Printf("Gold price service listening on :%s", port)
+	log.Printf("Gold price service listening on :%d", cfg.Port)
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-drained
+	if tickSink != nil {
+		<-tickSink.done // last batch flushed
+	}
+}
+
+// runPoller fetches on every tick until ctx is cancelled, backing off
+// while the upstream keeps failing.
+func runPoller(ctx context.Context, p *brsProvider, pollInterval time.Duration) {
+	timer := time.NewTimer(clock.Real(pollInterval))
+	defer timer.Stop()
+	poller.scheduled(pollInterval)
+	for {
+		select {
+		case <-timer.C:
+			err := pollOnce(ctx, p)
+			if ctx.Err() != nil {
+				return // shutting down, or replaced by the watchdog
+			}
+			switch {
+			case errors.Is(err, errFetchInProgress):
+				// Not a completed cycle: if the guard stays held, the
+				// watchdog should notice.
+				timer.Reset(clock.Real(pollInterval))
+			case err != nil:
+				fails := poller.recordFailure(err)
+				wait := backoffDuration(fails, pollInterval)
+				log.Printf("[poller] Fetch failed (%d consecutive, %s): %v — next retry in %v", fails, errorClass(err), err, wait)
+				timer.Reset(clock.Real(wait))
+				poller.scheduled(wait)
+			default:
+				if fails := poller.recordSuccess(); fails > 0 {
+					log.Printf("[poller] Recovered after %d consecutive failures", fails)
+				}
+				timer.Reset(clock.Real(pollInterval))
+				poller.scheduled(pollInterval)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pollOnce runs one scheduled fetch under its own FETCH_TIMEOUT deadline.
+// The HTTP client's UPSTREAM_TIMEOUT only bounds the request; this bounds
+// the whole cycle, so nothing in it can hold pollMu indefinitely.
+func pollOnce(ctx context.Context, p *brsProvider) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, cfg.FetchTimeout)
+	defer cancel()
+	return fetchAndCache(fetchCtx, p)
 }
 
 func handleGold18k(w http.ResponseWriter, r *http.Request) {
+	serveGoldPrice(w, r, "gold_18k")
+}
+
+// serveGoldPrice writes symbol's cached price for /api/gold/18k and its
+// aliases.
+func serveGoldPrice(w http.ResponseWriter, r *http.Request, symbol string) {
+	qp := paramsOf(r)
+	withMs, refresh, verbose := qp.unixMs(), qp.bool("refresh"), qp.bool("verbose")
+	if !qp.valid(w) {
+		return
+	}
+	if refresh && !forceRefresh(w, r) {
+		return
+	}
 	row := database.QueryRow(
-		"SELECT name, price_rial, fetched_at FROM gold_prices WHERE symbol = ?",
-		"gold_18k",
+		"SELECT name, price_rial, buy_rial, sell_rial, fetched_at, source, fetch_duration_ms, attempt, manual_override FROM gold_prices WHERE symbol = ?",
+		symbol,
 	)
 
 	var name string
-	var priceRial int64
+	var priceRial, buyRial, sellRial int64
 	var fetchedAtStr string
+	var source string
+	var fetchDurationMs int64
+	var attempt int
+	var manualOverride bool
 
-	if err := row.Scan(&name, &priceRial, &fetchedAtStr); err != nil {
+	if err := row.Scan(&name, &priceRial, &buyRial, &sellRial, &fetchedAtStr, &source, &fetchDurationMs, &attempt, &manualOverride); err != nil {
 		http.Error(w, `{"error":"no cached price available"}`, http.StatusServiceUnavailable)
 		return
 	}
 
 	fetchedAt, _ := time.Parse(time.RFC3339, fetchedAtStr)
-	stale := time.Since(fetchedAt) > staleThreshold
+	stale := clockSince(fetchedAt) > staleThreshold
+	active := symbolActive(symbol)
+	if stale && active {
+		// Serve what we have now; the next request should see fresh data.
+		revalidate(r.Context())
+	}
 
 	resp := GoldPrice{
-		Name:      name,
-		Price:     priceRial,
-		FetchedAt: fetchedAtStr,
-		Stale:     stale,
+		Name:           name,
+		Price:          priceRial,
+		FetchedAt:      fetchedAtStr,
+		Stale:          stale,
+		ManualOverride: manualOverride,
+	}
+	resp.PriceRaw, resp.Rounding = applyRounding(symbol, &resp.Price)
+	resp.Sides = sides(buyRial, sellRial, resp.Rounding)
+	if withMs {
+		resp.FetchedAtMs = unixMs(fetchedAtStr)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
-}
+	// A deactivated symbol still shows its last-known price, but with 410
+	// so clients stop relying on it.
+	status := http.StatusOK
+	if !active {
+		status = http.StatusGone
+	}
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
+	setDataAge(w, fetchedAt)
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"status":"ok"}`))
+	w.WriteHeader(status)
+	if verbose {
+		verbose := GoldPriceVerbose{
+			GoldPrice:       resp,
+			Source:          source,
+			FetchDurationMs: fetchDurationMs,
+			Attempt:         attempt,
+		}
+		if prev, err := previousClose(r.Context(), symbol, clock.Now()); err == nil {
+			verbose.changeSince(prev)
+		}
+		json.NewEncoder(w).Encode(verbose)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
-func fetchAndCache(apiKey string) error {
+func fetchAndCache(ctx context.Context, p *brsProvider) (err error) {
 	// Overlap guard
 	if !pollMu.TryLock() {
-		log.Println("[poller] Previous fetch still in progress, skipping")
-		return nil
+		logf(ctx, "[poller] Previous fetch still in progress, skipping")
+		return errFetchInProgress
 	}
 	defer pollMu.Unlock()
 
-	url := fmt.Sprintf("https://BrsApi.ir/Api/Market/Gold_Currency.php?key=%s", apiKey)
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{},
-			ForceAttemptHTTP2: false,
-			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				dialer := &net.Dialer{Timeout: 10 * time.Second}
-				conn, err := tls.DialWithDialer(dialer, network, addr, &tls.Config{
-					NextProtos: []string{"http/1.1"},
-				})
-				return conn, err
-			},
-		},
-	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("creating request failed: %w", err)
+	var symbols []trackedSymbol
+	for _, s := range cfg.TrackedSymbols {
+		if !symbolActive(s.Symbol) {
+			logf(ctx, "[poller] %s is deactivated, skipping fetch", s.Symbol)
+			continue
+		}
+		symbols = append(symbols, s)
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("HTTP request failed: %w", err)
+	if len(symbols) == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API returned status %d", resp.StatusCode)
-	}
+	// Which attempt this is since the last success (1 = first try).
+	poller.mu.Lock()
+	attempt := poller.consecutiveFails + 1
+	poller.mu.Unlock()
+
+	jobs := fetchTracked(ctx, p, symbols)
+	// A cycle is partial-success: each symbol is cached or fails on its
+	// own, and failed holds why. The cycle only fails when nothing was
+	// cached.
+	failed := map[string]error{}
+	fetchedAt := clock.Now()
+	defer func() {
+		// Every request lands in fetch_log: a failed one with its own
+		// error, a successful one with whatever first stopped one of its
+		// symbols from being cached.
+		for _, j := range jobs {
+			jobErr := j.err
+			for _, s := range j.symbols {
+				if jobErr == nil {
+					jobErr = failed[s.Symbol]
+				}
+			}
+			recordFetch(p.name, j.start, jobErr)
+		}
+		for _, s := range symbols {
+			recordSymbolFetch(ctx, s.Symbol, fetchedAt, failed[s.Symbol])
+		}
+	}()
 
-	var apiResp BrsApiResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return fmt.Errorf("JSON decode failed: %w", err)
+	type quote struct {
+		symbol    string
+		name      string
+		priceRial int64
+		// buyRial and sellRial are 0 unless the item quotes both sides.
+		buyRial  int64
+		sellRial int64
+		duration time.Duration
+		record   *RecordEvent
+		// pair is the provider's own rate for an FX_QUOTES item.
+		pair *FXPair
 	}
-
-	// Find IR_GOLD_18K
-	var gold18k *BrsApiItem
-	for i := range apiResp.Gold {
-		if apiResp.Gold[i].Symbol == "IR_GOLD_18K" {
-			gold18k = &apiResp.Gold[i]
-			break
+	var quotes []quote
+	rialPrices := map[string]int64{}
+	// Toman-priced items go first: items priced in another currency are
+	// converted with that currency's Rial price from this cycle.
+	for _, quoted := range []bool{false, true} {
+		for _, j := range jobs {
+			for _, s := range j.symbols {
+				if (s.Quote != "") != quoted {
+					continue
+				}
+				if j.err != nil {
+					failed[s.Symbol] = j.err
+					continue
+				}
+				if err := j.symbolErrs[s.Upstream]; err != nil {
+					failed[s.Symbol] = err
+					continue
+				}
+				item := j.items[s.Upstream]
+				// Convert Toman to Rial (x10)
+				q := quote{symbol: s.Symbol, name: item.Name, priceRial: int64(item.Price * 10), buyRial: int64(item.Buy * 10), sellRial: int64(item.Sell * 10), duration: j.duration}
+				if s.Quote != "" {
+					quoteRial, ok := rialPrices[s.Quote]
+					if !ok {
+						cause := failed[s.Quote]
+						failed[s.Symbol] = classified(errorClass(cause), "no %s price this cycle to convert from: %v", s.Quote, cause)
+						continue
+					}
+					q.priceRial = int64(math.Round(item.Price * float64(quoteRial)))
+					q.buyRial = int64(math.Round(item.Buy * float64(quoteRial)))
+					q.sellRial = int64(math.Round(item.Sell * float64(quoteRial)))
+					q.pair = &FXPair{Base: s.Symbol, Quote: s.Quote, Rate: item.Price}
+				}
+				if q.buyRial <= 0 || q.sellRial <= 0 {
+					q.buyRial, q.sellRial = 0, 0
+				}
+				if q.name == "" {
+					q.name = defaultNames[s.Symbol]
+				}
+				if q.name == "" {
+					q.name = s.Upstream
+				}
+				if err := checkPriceWrite(ctx, q.symbol, q.priceRial, fetchedAt); err != nil {
+					failed[s.Symbol] = err
+					continue
+				}
+				// Read the history before this cycle's ticks land in it.
+				q.record = detectRecord(ctx, q.symbol, q.priceRial, fetchedAt)
+				quotes = append(quotes, q)
+				rialPrices[q.symbol] = q.priceRial
+			}
 		}
 	}
-
-	if gold18k == nil || gold18k.Price == 0 {
-		return fmt.Errorf("IR_GOLD_18K not found in API response")
+	if len(quotes) == 0 {
+		return failed[symbols[0].Symbol]
 	}
-
-	// Convert Toman to Rial (x10)
-	priceRial := int64(gold18k.Price * 10)
-	name := gold18k.Name
-	if name == "" {
-		name = "طلای 18 عیار"
+	if cfg.DryRun {
+		// Everything past validation writes or notifies.
+		for _, q := range quotes {
+			metrics.Count("dryrun.quote", 1, map[string]string{"symbol": q.symbol})
+			logf(ctx, "[dry-run] Would update %s: %s = %d Rial (buy %d, sell %d, new record: %t)",
+				q.symbol, q.name, q.priceRial, q.buyRial, q.sellRial, q.record != nil)
+		}
+		for _, s := range symbols {
+			if err := failed[s.Symbol]; err != nil {
+				logf(ctx, "[dry-run] %s would not be updated (%s): %v", s.Symbol, errorClass(err), err)
+			}
+		}
+		return nil
 	}
-	now := time.Now().UTC().Format(time.RFC3339)
-
-	// Upsert
-	_, err = database.Exec(`
-		INSERT INTO gold_prices (symbol, name, price_rial, fetched_at)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(symbol) DO UPDATE SET
-			name = excluded.name,
-			price_rial = excluded.price_rial,
-			fetched_at = excluded.fetched_at
-	`, "gold_18k", name, priceRial, now)
+	now := fetchedAt.UTC().Format(time.RFC3339)
 
+	// Write the cycle's prices and ticks in one transaction so readers
+	// never see it half-applied.
+	storageFailed := func(err error) error {
+		for _, q := range quotes {
+			failed[q.symbol] = err
+		}
+		return err
+	}
+	tx, err := database.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("DB upsert failed: %w", err)
+		return storageFailed(classified(errClassStorage, "DB begin failed: %w", err))
+	}
+	defer tx.Rollback()
+	upsert := tx.StmtContext(ctx, pollStatements.upsertPrice)
+	for _, q := range quotes {
+		if _, err = upsert.ExecContext(ctx, q.symbol, q.name, q.priceRial, q.buyRial, q.sellRial, now, p.name, q.duration.Milliseconds(), attempt); err != nil {
+			return storageFailed(classified(errClassStorage, "DB upsert of %s failed: %w", q.symbol, err))
+		}
+		if err = recordTick(ctx, tx, q.symbol, q.priceRial, fetchedAt); err != nil {
+			return storageFailed(classified(errClassStorage, "recording %s tick failed: %w", q.symbol, err))
+		}
+		if err = recordClose(ctx, tx, q.symbol, q.priceRial, fetchedAt); err != nil {
+			return storageFailed(classified(errClassStorage, "recording %s daily close failed: %w", q.symbol, err))
+		}
+		if q.pair != nil {
+			if err = recordPair(ctx, tx, *q.pair, fetchedAt); err != nil {
+				return storageFailed(classified(errClassStorage, "recording %s/%s rate failed: %w", q.pair.Base, q.pair.Quote, err))
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return storageFailed(classified(errClassStorage, "DB commit failed: %w", err))
 	}
 
-	log.Printf("[poller] Updated gold_18k: %s = %d Rial", name, priceRial)
+	for _, q := range quotes {
+		lastWrites[q.symbol] = fetchedAt
+		queryCache.invalidate(q.symbol, fetchedAt)
+		if tickSink != nil {
+			tickSink.add(q.symbol, q.priceRial, fetchedAt, p.name)
+		}
+		if q.record != nil {
+			storeRecord(ctx, *q.record)
+		}
+		logf(ctx, "[poller] Updated %s: %s = %d Rial", q.symbol, q.name, q.priceRial)
+	}
+	if publisher != nil {
+		publisher.notify()
+	}
+	for _, s := range symbols {
+		if err := failed[s.Symbol]; err != nil {
+			logf(ctx, "[poller] %s not updated (%s): %v", s.Symbol, errorClass(err), err)
+		}
+	}
 	return nil
 }
 
+// upsertPriceSQL writes a fetched price over the cached row, clearing any
+// manual override. Arguments: symbol, name, price, buy, sell, fetched_at,
+// source, fetch duration, attempt. Prepared as pollStatements.upsertPrice.
+const upsertPriceSQL = `
+	INSERT INTO gold_prices (symbol, name, price_rial, buy_rial, sell_rial, fetched_at, source, fetch_duration_ms, attempt, manual_override)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+	ON CONFLICT(symbol) DO UPDATE SET
+		name = excluded.name,
+		price_rial = excluded.price_rial,
+		buy_rial = excluded.buy_rial,
+		sell_rial = excluded.sell_rial,
+		fetched_at = excluded.fetched_at,
+		source = excluded.source,
+		fetch_duration_ms = excluded.fetch_duration_ms,
+		attempt = excluded.attempt,
+		manual_override = 0`
+
 // backoffDuration returns how long to wait before the next retry.
 // Backs off exponentially: normal, 2min, 5min, 10min, capped at 30min.
 func backoffDuration(fails int, base time.Duration) time.Duration {
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricsSink receives measurements for push-based backends such as
+// StatsD. Prometheus needs none of this: it scrapes /metrics, which reads
+// the same state directly.
+type metricsSink interface {
+	Gauge(name string, value float64, tags map[string]string)
+	Count(name string, delta int64, tags map[string]string)
+	Timing(name string, d time.Duration, tags map[string]string)
+}
+
+// metrics is the configured sink; it discards everything unless
+// METRICS_BACKEND selects a push backend.
+var metrics metricsSink = nopMetrics{}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Gauge(string, float64, map[string]string)        {}
+func (nopMetrics) Count(string, int64, map[string]string)          {}
+func (nopMetrics) Timing(string, time.Duration, map[string]string) {}
+
+// priceGauge is the exported state of one cached symbol.
+type priceGauge struct {
+	symbol, source string
+	priceRial      int64
+	age            time.Duration
+	known          bool // age is valid
+	manual, active bool
+}
+
+// readPriceGauges snapshots every cached price for metric export.
+func readPriceGauges(ctx context.Context) ([]priceGauge, error) {
+	rows, err := database.QueryContext(ctx, `
+		SELECT p.symbol, p.source, p.price_rial, p.fetched_at, p.manual_override, COALESCE(s.active, 1)
+		FROM gold_prices p
+		LEFT JOIN symbols s ON s.symbol = p.symbol
+		ORDER BY p.symbol
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gauges []priceGauge
+	now := clock.Now()
+	for rows.Next() {
+		var g priceGauge
+		var fetchedAt string
+		if err := rows.Scan(&g.symbol, &g.source, &g.priceRial, &fetchedAt, &g.manual, &g.active); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, fetchedAt); err == nil {
+			g.age, g.known = now.Sub(t), true
+		}
+		gauges = append(gauges, g)
+	}
+	return gauges, rows.Err()
+}
+
+// pushPriceGauges sends the cached prices to the metrics sink every
+// interval, mirroring the gauges on /metrics.
+func pushPriceGauges(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gauges, err := readPriceGauges(ctx)
+			if err != nil {
+				log.Printf("[metrics] Reading prices failed: %v", err)
+				continue
+			}
+			for _, g := range gauges {
+				tags := map[string]string{"symbol": g.symbol}
+				metrics.Gauge("price_rial", float64(g.priceRial), tags)
+				metrics.Gauge("price_source_info", 1, map[string]string{"symbol": g.symbol, "source": g.source})
+				if g.known {
+					metrics.Gauge("price_age_seconds", g.age.Seconds(), tags)
+					metrics.Gauge("price_stale", float64(boolGauge(g.age > staleThreshold)), tags)
+				}
+				metrics.Gauge("price_manual_override", float64(boolGauge(g.manual)), tags)
+				metrics.Gauge("symbol_active", float64(boolGauge(g.active)), tags)
+			}
+			freshness, err := readFreshness(ctx)
+			if err != nil {
+				log.Printf("[metrics] Reading freshness failed: %v", err)
+				continue
+			}
+			for symbol, windows := range freshness {
+				for window, w := range windows {
+					if w.FreshPercent != nil {
+						metrics.Gauge("price_freshness_ratio", *w.FreshPercent/100, map[string]string{"symbol": symbol, "window": window})
+					}
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text exposition
+// format. Prices are read from the cache on every scrape, so Prometheus
+// keeps the history and the service stays stateless about it.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	gauges, err := readPriceGauges(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var price, source, age, stale, override, active strings.Builder
+	for _, g := range gauges {
+		labels := fmt.Sprintf(`symbol=%q`, g.symbol)
+		fmt.Fprintf(&price, "gold_price_rial{%s} %d\n", labels, g.priceRial)
+		fmt.Fprintf(&source, "gold_price_source_info{%s,source=%q} 1\n", labels, g.source)
+		if g.known {
+			fmt.Fprintf(&age, "gold_price_age_seconds{%s} %.0f\n", labels, g.age.Seconds())
+			fmt.Fprintf(&stale, "gold_price_stale{%s} %d\n", labels, boolGauge(g.age > staleThreshold))
+		}
+		fmt.Fprintf(&override, "gold_price_manual_override{%s} %d\n", labels, boolGauge(g.manual))
+		fmt.Fprintf(&active, "gold_symbol_active{%s} %d\n", labels, boolGauge(g.active))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "gold_price_rial", "gauge", "Cached price in Rial.", price.String())
+	writeMetric(w, "gold_price_source_info", "gauge", "Always 1; source names the provider of the cached price.", source.String())
+	writeMetric(w, "gold_price_age_seconds", "gauge", "Seconds since the cached price was fetched.", age.String())
+	writeMetric(w, "gold_price_stale", "gauge", "1 if the cached price is older than the stale threshold.", stale.String())
+	writeMetric(w, "gold_price_manual_override", "gauge", "1 while an operator correction is served.", override.String())
+	writeMetric(w, "gold_symbol_active", "gauge", "0 once a symbol has been deactivated.", active.String())
+
+	freshness, err := readFreshness(r.Context())
+	if err == nil {
+		symbols := make([]string, 0, len(freshness))
+		for symbol := range freshness {
+			symbols = append(symbols, symbol)
+		}
+		sort.Strings(symbols)
+		var ratio strings.Builder
+		for _, symbol := range symbols {
+			for _, win := range freshnessWindows {
+				if pct := freshness[symbol][win.name].FreshPercent; pct != nil {
+					fmt.Fprintf(&ratio, "gold_price_freshness_ratio{symbol=%q,window=%q} %g\n", symbol, win.name, *pct/100)
+				}
+			}
+		}
+		writeMetric(w, "gold_price_freshness_ratio", "gauge", "Share of freshness samples within the stale threshold.", ratio.String())
+	}
+
+	if !pollsUpstream() {
+		return
+	}
+	poller.mu.Lock()
+	fails := poller.consecutiveFails
+	lastSuccess := poller.lastSuccess
+	restarts := poller.watchdogRestarts
+	classes := make([]string, 0, len(poller.failuresByClass))
+	for class := range poller.failuresByClass {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	var byClass strings.Builder
+	for _, class := range classes {
+		fmt.Fprintf(&byClass, "gold_poller_failures_total{class=%q} %d\n", class, poller.failuresByClass[class])
+	}
+	poller.mu.Unlock()
+
+	writeMetric(w, "gold_poller_consecutive_failures", "gauge", "Upstream fetch failures since the last success.",
+		fmt.Sprintf("gold_poller_consecutive_failures %d\n", fails))
+	writeMetric(w, "gold_poller_failures_total", "counter", "Upstream fetch failures since start, by class.", byClass.String())
+	writeMetric(w, "gold_poller_watchdog_restarts_total", "counter", "Fetch loop restarts by the poller watchdog since start.",
+		fmt.Sprintf("gold_poller_watchdog_restarts_total %d\n", restarts))
+	if !lastSuccess.IsZero() {
+		writeMetric(w, "gold_poller_last_success_timestamp_seconds", "gauge", "Unix time of the last successful fetch.",
+			fmt.Sprintf("gold_poller_last_success_timestamp_seconds %d\n", lastSuccess.Unix()))
+	}
+}
+
+// writeMetric writes one metric family; families with no samples are
+// still announced so dashboards see the metric exists.
+func writeMetric(w http.ResponseWriter, name, kind, help, samples string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s", name, help, name, kind, samples)
+}
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
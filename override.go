@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// priceOverride is the PUT /admin/prices/{symbol} request body. Price is
+// in Rial, like every price the service serves.
+type priceOverride struct {
+	Price  int64  `json:"price"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// cachedPrice is the audited state of a gold_prices row.
+type cachedPrice struct {
+	Name           string `json:"name"`
+	Price          int64  `json:"price"`
+	FetchedAt      string `json:"fetchedAt"`
+	Source         string `json:"source"`
+	ManualOverride bool   `json:"manualOverride"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// handlePriceOverride replaces an obviously wrong cached price. The value
+// is served with manualOverride=true until the next successful upstream
+// fetch overwrites it. Only symbols already in the cache can be corrected.
+func handlePriceOverride(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "prices are read-only on a replica; correct them on the primary")
+		return
+	}
+	symbol := r.PathValue("symbol")
+
+	var req priceOverride
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"price\": 123, \"reason\": \"...\"}")
+		return
+	}
+	if req.Price <= 0 || req.Price > maxSanePriceToman*10 {
+		writeError(w, http.StatusBadRequest, "price must be a positive Rial amount")
+		return
+	}
+
+	// Hold the poller lock so a fetch can't land between the read of the
+	// old value and the write of the new one.
+	pollMu.Lock()
+	defer pollMu.Unlock()
+
+	var before cachedPrice
+	err := database.QueryRow(
+		"SELECT name, price_rial, fetched_at, source, manual_override FROM gold_prices WHERE symbol = ?", symbol,
+	).Scan(&before.Name, &before.Price, &before.FetchedAt, &before.Source, &before.ManualOverride)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "no cached price for symbol "+symbol)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	after := cachedPrice{
+		Name:           before.Name,
+		Price:          req.Price,
+		FetchedAt:      clock.Now().UTC().Format(time.RFC3339),
+		Source:         "manual",
+		ManualOverride: true,
+		Reason:         req.Reason,
+	}
+	if req.Name != "" {
+		after.Name = req.Name
+	}
+	_, err = database.Exec(`
+		UPDATE gold_prices
+		SET name = ?, price_rial = ?, fetched_at = ?, source = ?, buy_rial = 0, sell_rial = 0, fetch_duration_ms = 0, attempt = 0, manual_override = 1
+		WHERE symbol = ?
+	`, after.Name, after.Price, after.FetchedAt, after.Source, symbol)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	auditChange(r, before, after)
+	logf(r.Context(), "[admin] %s manually set to %d Rial (was %d): %s", symbol, after.Price, before.Price, req.Reason)
+	writeJSON(w, http.StatusOK, after)
+}
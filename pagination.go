@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// pageCursor marks the last row of a page: its timestamp plus rowid as a
+// tiebreaker. Clients treat the encoded form as opaque.
+type pageCursor struct {
+	T  string `json:"t"`
+	ID int64  `json:"id"`
+}
+
+func (c pageCursor) String() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+// parseCursor decodes ?cursor=; an empty value is the zero cursor (first
+// page).
+func parseCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	if s == "" {
+		return c, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(raw, &c) != nil || c.T == "" {
+		return pageCursor{}, errBadCursor
+	}
+	return c, nil
+}
+
+// setNextLink advertises the next page in an RFC 5988 Link header: the
+// request URL with cursor replaced. It returns the encoded cursor for the
+// response body.
+func setNextLink(w http.ResponseWriter, r *http.Request, next pageCursor) string {
+	cursor := next.String()
+	u := *r.URL
+	q := u.Query()
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+	w.Header().Add("Link", `<`+u.RequestURI()+`>; rel="next"`)
+	return cursor
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is one invalid query parameter.
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// queryParams reads a request's query parameters like envParser reads the
+// environment: each getter returns its default for a missing parameter,
+// and every bad value is collected so the client learns about all of them
+// at once. Handlers read what they need, then call valid.
+type queryParams struct {
+	q    url.Values
+	errs []FieldError
+}
+
+func paramsOf(r *http.Request) *queryParams {
+	return &queryParams{q: r.URL.Query()}
+}
+
+// fail records a bad parameter.
+func (p *queryParams) fail(field, format string, args ...any) {
+	p.errs = append(p.errs, FieldError{Field: field, Value: p.q.Get(field), Message: fmt.Sprintf(format, args...)})
+}
+
+// valid answers 400 with every field error and reports false if there
+// were any. "error" joins the messages for clients that only read it.
+func (p *queryParams) valid(w http.ResponseWriter) bool {
+	if len(p.errs) == 0 {
+		return true
+	}
+	msgs := make([]string, len(p.errs))
+	for i, e := range p.errs {
+		msgs[i] = e.Message
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]any{"error": strings.Join(msgs, "; "), "fields": p.errs})
+	return false
+}
+
+func (p *queryParams) str(name, def string) string {
+	if v := p.q.Get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// intRange reads an integer in [min, max].
+func (p *queryParams) intRange(name string, def, min, max int) int {
+	v := p.q.Get(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		p.fail(name, "%s must be between %d and %d", name, min, max)
+		return def
+	}
+	return n
+}
+
+// id reads a positive int64, such as a row id; 0 when missing.
+func (p *queryParams) id(name, what string) int64 {
+	v := p.q.Get(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		p.fail(name, "%s must be %s", name, what)
+		return 0
+	}
+	return n
+}
+
+// oneOf reads one of allowed.
+func (p *queryParams) oneOf(name, def string, allowed ...string) string {
+	v := p.q.Get(name)
+	if v == "" {
+		return def
+	}
+	if !slices.Contains(allowed, v) {
+		p.fail(name, "%s must be one of %s", name, strings.Join(allowed, ", "))
+		return def
+	}
+	return v
+}
+
+// bool reads true or false.
+func (p *queryParams) bool(name string) bool {
+	switch p.q.Get(name) {
+	case "", "false":
+		return false
+	case "true":
+		return true
+	}
+	p.fail(name, "%s must be true or false", name)
+	return false
+}
+
+// time reads an RFC3339 time. An unescaped "+" in the offset arrives as a
+// space, so it is put back.
+func (p *queryParams) time(name string, def time.Time) time.Time {
+	v := p.q.Get(name)
+	if v == "" {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, strings.ReplaceAll(v, " ", "+"))
+	if err != nil {
+		p.fail(name, "%s must be an RFC3339 time like 2024-05-01T10:30:00+03:30", name)
+		return def
+	}
+	return t
+}
+
+// duration reads a positive Go duration like 24h.
+func (p *queryParams) duration(name string, def time.Duration) time.Duration {
+	v := p.q.Get(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		p.fail(name, "%s must be a positive duration like 24h", name)
+		return def
+	}
+	return d
+}
+
+// location reads an IANA time zone name; nil when missing.
+func (p *queryParams) location(name string) *time.Location {
+	v := p.q.Get(name)
+	if v == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(v)
+	if err != nil {
+		p.fail(name, "%s must be an IANA time zone name", name)
+		return nil
+	}
+	return loc
+}
+
+// cursor reads a page cursor from a previous response.
+func (p *queryParams) cursor(name string) pageCursor {
+	c, err := parseCursor(p.q.Get(name))
+	if err != nil {
+		p.fail(name, "%s is not a cursor from a previous page", name)
+	}
+	return c
+}
+
+// unixMs reads ?ts=rfc3339|unix_ms and reports whether the client asked
+// for unix_ms, which adds an epoch-millisecond twin (e.g. fetchedAtMs)
+// next to each RFC3339 timestamp for clients that struggle to parse
+// RFC3339.
+func (p *queryParams) unixMs() bool {
+	return p.oneOf("ts", "rfc3339", "rfc3339", "unix_ms") == "unix_ms"
+}
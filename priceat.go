@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// PriceAt is the price in effect at a moment. At is when that price was
+// last seen: the cached tick itself (precision "tick"), or the end of the
+// latest candle that closed by then, so precision is its resolution and
+// the tick could be up to that much older.
+type PriceAt struct {
+	Symbol    string `json:"symbol"`
+	T         string `json:"t"`
+	Price     int64  `json:"price"`
+	At        string `json:"at"`
+	AtMs      *int64 `json:"atMs,omitempty"`
+	Precision string `json:"precision"`
+}
+
+// priceAt finds symbol's price in effect at t, or nil without history
+// before it. A candle still open at t is skipped: its close may come from
+// a later tick. Each resolution is searched because older history
+// survives only as 1h or 1d candles; the candle ending latest wins.
+func priceAt(ctx context.Context, symbol string, t time.Time) (*PriceAt, error) {
+	var best *PriceAt
+	var bestEnd time.Time
+	for _, res := range []string{res1m, res1h, res1d} {
+		d, _ := resolutionDuration(res)
+		var bucket string
+		var price int64
+		err := database.QueryRowContext(ctx, `
+			SELECT bucket_start, close FROM candles
+			WHERE symbol = ? AND resolution = ? AND bucket_start <= ?
+			ORDER BY bucket_start DESC LIMIT 1
+		`, symbol, res, t.Add(-d).UTC().Format(time.RFC3339)).Scan(&bucket, &price)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, _ := time.Parse(time.RFC3339, bucket)
+		if end := start.Add(d); best == nil || end.After(bestEnd) {
+			bestEnd = end
+			best = &PriceAt{Price: price, At: end.UTC().Format(time.RFC3339), Precision: res}
+		}
+	}
+
+	// The cached row is an exact tick, and the only source for the
+	// current, still open minute.
+	var fetched string
+	var price int64
+	err := database.QueryRowContext(ctx, "SELECT price_rial, fetched_at FROM gold_prices WHERE symbol = ?", symbol).Scan(&price, &fetched)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if at, perr := time.Parse(time.RFC3339, fetched); err == nil && perr == nil && !at.After(t) && (best == nil || at.After(bestEnd)) {
+		best = &PriceAt{Price: price, At: at.UTC().Format(time.RFC3339), Precision: "tick"}
+	}
+	if best != nil {
+		best.Symbol, best.T = symbol, t.UTC().Format(time.RFC3339)
+	}
+	return best, nil
+}
+
+// handleGoldAt serves GET /api/gold/18k/at?t=<RFC3339>: the price in
+// effect at t, for reconciliation. A t in the future is a 400 and one
+// without a known price by then a 404.
+func handleGoldAt(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	withMs := qp.unixMs()
+	t := qp.time("t", time.Time{})
+	switch {
+	case qp.q.Get("t") == "":
+		qp.fail("t", "t is required")
+	case t.After(clock.Now()):
+		qp.fail("t", "t is in the future")
+	}
+	if !qp.valid(w) {
+		return
+	}
+	p, err := priceAt(r.Context(), "gold_18k", t)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if p == nil {
+		writeError(w, http.StatusNotFound, "no price known at "+t.Format(time.RFC3339))
+		return
+	}
+	if withMs {
+		p.AtMs = unixMs(p.At)
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fetch failure classes, kept distinct in logs, counters and fetch_log so
+// schema drift isn't mistaken for an outage.
+const (
+	errClassOutage   = "outage"   // network errors, timeouts, 5xx
+	errClassRejected = "rejected" // 4xx: bad key, rate limited, banned
+	errClassSchema   = "schema"   // undecodable or invalid payload
+	errClassStorage  = "storage"  // fetched fine but the DB write failed
+	errClassAnomaly  = "anomaly"  // fetched fine but failed checkPriceWrite
+)
+
+// fetchError is a fetch failure tagged with its class.
+type fetchError struct {
+	class string
+	err   error
+}
+
+func (e *fetchError) Error() string { return e.err.Error() }
+func (e *fetchError) Unwrap() error { return e.err }
+
+func classified(class string, format string, args ...any) error {
+	return &fetchError{class: class, err: fmt.Errorf(format, args...)}
+}
+
+// errorClass returns the class of err, treating untagged errors as outages.
+func errorClass(err error) string {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe.class
+	}
+	return errClassOutage
+}
+
+// brsProvider fetches quotes from a BrsApi.ir-compatible endpoint. The
+// shadow provider uses the same shape with a different URL and key.
+type brsProvider struct {
+	name      string
+	url       string
+	apiKey    *secret
+	keySource *secretSource
+	headers   map[string]string
+	// keyHeader, when set, sends the API key in this header instead of
+	// the ?key= query parameter.
+	keyHeader string
+}
+
+// fetchGold18k returns the IR_GOLD_18K item from the provider's endpoint.
+func (p *brsProvider) fetchGold18k(ctx context.Context) (*BrsApiItem, error) {
+	items, symbolErrs, err := p.fetchItems(ctx, p.url, []string{"IR_GOLD_18K"})
+	if err != nil {
+		return nil, err
+	}
+	if err := symbolErrs["IR_GOLD_18K"]; err != nil {
+		return nil, err
+	}
+	return items["IR_GOLD_18K"], nil
+}
+
+// fetchItems requests endpoint with the provider's key and headers and
+// returns the usable wanted items by upstream symbol. A wanted symbol that
+// is missing or unusable gets a schema error in symbolErrs instead; err is
+// for failures of the whole request. Returned errors never contain the
+// API key. A caller's trace in ctx is continued on the upstream request.
+func (p *brsProvider) fetchItems(ctx context.Context, endpoint string, want []string) (items map[string]*BrsApiItem, symbolErrs map[string]error, err error) {
+	defer func() {
+		if err != nil {
+			err = p.redact(err)
+		}
+	}()
+
+	apiKey := p.apiKey.Get()
+	reqURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, nil, classified(errClassOutage, "invalid provider URL: %w", err)
+	}
+	if p.keyHeader == "" {
+		q := reqURL.Query()
+		q.Set("key", apiKey)
+		reqURL.RawQuery = q.Encode()
+	}
+
+	client := newUpstreamClient()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, nil, classified(errClassOutage, "creating request failed: %w", err)
+	}
+	req.Header.Set("User-Agent", upstreamUserAgent)
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	if p.keyHeader != "" {
+		req.Header.Set(p.keyHeader, apiKey)
+	}
+	if t, ok := traceFrom(ctx); ok {
+		t.inject(req)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, classified(errClassOutage, "HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, nil, classified(errClassRejected, "API returned status %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, classified(errClassOutage, "API returned status %d", resp.StatusCode)
+	}
+
+	var apiResp BrsApiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, nil, classified(errClassSchema, "JSON decode failed: %w", err)
+	}
+	invalid, err := validateBrsResponse(&apiResp, want)
+	if err != nil {
+		return nil, nil, classified(errClassSchema, "invalid API response: %w", err)
+	}
+	symbolErrs = map[string]error{}
+	for symbol, e := range invalid {
+		symbolErrs[symbol] = classified(errClassSchema, "invalid API response: %w", e)
+	}
+
+	items = map[string]*BrsApiItem{}
+	var skipped, coerced []string // by upstream symbol
+	for _, item := range apiResp.items() {
+		switch {
+		case symbolErrs[item.Symbol] != nil:
+			continue
+		case item.malformed != "", item.Symbol == "":
+			skipped = append(skipped, item.Symbol)
+			continue
+		case item.coerced:
+			coerced = append(coerced, item.Symbol)
+		}
+		items[item.Symbol] = item
+	}
+	if len(coerced) > 0 {
+		metrics.Count("upstream.coerced_prices", int64(len(coerced)), map[string]string{"provider": p.name})
+	}
+	if len(skipped) > 0 {
+		metrics.Count("upstream.malformed_items", int64(len(skipped)), map[string]string{"provider": p.name})
+		log.Printf("[upstream] %s: skipped %d malformed items: %v", p.name, len(skipped), skipped)
+	}
+	return items, symbolErrs, nil
+}
+
+// watchKey keeps p.apiKey current when it comes from a file or secret
+// manager, re-reading it every interval until ctx is cancelled.
+func (p *brsProvider) watchKey(ctx context.Context, envName string, interval time.Duration) {
+	if p.keySource == nil || p.keySource.static {
+		return
+	}
+	refreshSecret(ctx, envName, p.keySource, p.apiKey, interval)
+}
+
+// redact strips the API key (raw and query-escaped) from err's message,
+// keeping its class. Transport errors embed the full request URL, which
+// would otherwise carry the key into logs, fetch_log and admin responses.
+func (p *brsProvider) redact(err error) error {
+	apiKey := p.apiKey.Get()
+	if apiKey == "" {
+		return err
+	}
+	msg := err.Error()
+	for _, secret := range []string{apiKey, url.QueryEscape(apiKey)} {
+		msg = strings.ReplaceAll(msg, secret, "REDACTED")
+	}
+	return &fetchError{class: errorClass(err), err: errors.New(msg)}
+}
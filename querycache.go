@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a stored 200 response of a history query. to is the
+// end of the time range it read; zero means open-ended (up to now).
+type cachedResponse struct {
+	symbol      string
+	to          time.Time
+	contentType string
+	link        []string
+	body        []byte
+	stored      time.Time
+}
+
+// responseCache holds computed candle and extremes responses, keyed by
+// path and query, so popular dashboard queries don't hit SQLite on every
+// request. A new tick drops the responses whose range it falls in; a
+// compaction, which rewrites and prunes candles, drops everything. Entries
+// also expire after ttl, which bounds staleness on replicas (they never
+// see the primary's writes) and for sliding ranges like the default 24h.
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]*cachedResponse
+	generation uint64 // bumped by every invalidation
+	ttl        time.Duration
+	max        int
+}
+
+var queryCache = &responseCache{entries: map[string]*cachedResponse{}}
+
+// cachedQuery serves GET requests for symbol's history from queryCache,
+// storing successful responses. Streamed NDJSON exports bypass it.
+func cachedQuery(symbol string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := queryCache
+		if c.max == 0 || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+			next(w, r)
+			return
+		}
+		// ?envelope only changes the wrapping, added outside the cache.
+		q := r.URL.Query()
+		q.Del("envelope")
+		key := r.URL.Path + "?" + q.Encode()
+		e, gen := c.get(key)
+		if e != nil {
+			metrics.Count("query_cache", 1, map[string]string{"result": "hit"})
+			w.Header().Set("Content-Type", e.contentType)
+			for _, l := range e.link {
+				w.Header().Add("Link", l)
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+			w.Write(e.body)
+			return
+		}
+		metrics.Count("query_cache", 1, map[string]string{"result": "miss"})
+		w.Header().Set("X-Cache", "MISS")
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status != http.StatusOK {
+			return
+		}
+		var to time.Time
+		if v := r.URL.Query().Get("to"); v != "" {
+			to, _ = time.Parse(time.RFC3339, v)
+		}
+		c.put(key, gen, &cachedResponse{
+			symbol:      symbol,
+			to:          to,
+			contentType: rec.Header().Get("Content-Type"),
+			link:        rec.Header().Values("Link"),
+			body:        rec.body.Bytes(),
+		})
+	}
+}
+
+// get returns a live entry for key, or nil and the current generation to
+// pass to put.
+func (c *responseCache) get(key string) (*cachedResponse, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e != nil && time.Since(e.stored) < c.ttl {
+		return e, c.generation
+	}
+	delete(c.entries, key)
+	return nil, c.generation
+}
+
+// put stores e unless an invalidation ran since gen was read: the
+// response may have been computed from data that is already outdated.
+// When full, the oldest entry is evicted.
+func (c *responseCache) put(key string, gen uint64, e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.generation {
+		return
+	}
+	if len(c.entries) >= c.max {
+		var oldest string
+		for k, v := range c.entries {
+			if oldest == "" || v.stored.Before(c.entries[oldest].stored) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	e.stored = time.Now()
+	c.entries[key] = e
+}
+
+// invalidate drops symbol's responses whose range reaches the 1m bucket a
+// tick at t was written to.
+func (c *responseCache) invalidate(symbol string, t time.Time) {
+	bucket := t.UTC().Truncate(time.Minute)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for k, e := range c.entries {
+		if e.symbol == symbol && (e.to.IsZero() || !e.to.Before(bucket)) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// invalidateAll drops every response.
+func (c *responseCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	clear(c.entries)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestLimiter counts /api/ requests per client in fixed windows of
+// RATE_LIMIT_WINDOW. Counts are per instance: replicas behind a load
+// balancer each allow the full limit.
+type requestLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var requestLimits = &requestLimiter{windows: map[string]*rateWindow{}}
+
+// take counts a request by client against limit and returns how many
+// remain in the window, when the window resets, and whether the request
+// is allowed.
+func (l *requestLimiter) take(client string, limit int, window time.Duration, now time.Time) (remaining int, reset time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Forget finished windows once per window so the map stays small.
+	if now.Sub(l.lastSweep) >= window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= window {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	w := l.windows[client]
+	if w == nil || now.Sub(w.start) >= window {
+		w = &rateWindow{start: now}
+		l.windows[client] = w
+	}
+	reset = w.start.Add(window)
+	if w.count >= limit {
+		return 0, reset, false
+	}
+	w.count++
+	return limit - w.count, reset, true
+}
+
+// rateClient identifies a caller for rate limits, forced refreshes, flag
+// rollouts, bans and scraper flags: "key:<id>" for an active API key,
+// otherwise "ip:<address>". Keys that don't exist are ignored, so made-up
+// keys can't each get a fresh quota or rollout bucket.
+func rateClient(r *http.Request) string {
+	if k := requestAPIKey(r); k != nil {
+		return fmt.Sprintf("key:%d", k.ID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// withRateLimit enforces RATE_LIMIT_REQUESTS, or the caller's API key
+// override, on /api/ routes, per rateClient. A client flagged by the
+// honeypot gets SCRAPER_RATE_LIMIT_REQUESTS when that is lower. Limited
+// responses carry X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (seconds until the window resets); a request over the
+// limit gets 429 with Retry-After.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := cfg.RateLimitRequests
+		if k := requestAPIKey(r); k != nil && k.RateLimitRequests != nil {
+			limit = *k.RateLimitRequests
+		}
+		client, now := rateClient(r), time.Now()
+		if n := cfg.ScraperRateLimitRequests; n > 0 && (limit == 0 || n < limit) && scrapers.flagged(client, now) {
+			limit = n
+		}
+		if limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		remaining, reset, ok := requestLimits.take(client, limit, cfg.RateLimitWindow, now)
+		resetIn := int(reset.Sub(now).Seconds() + 0.999)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(resetIn))
+		if !ok {
+			metrics.Count("http.rate_limited", 1, nil)
+			w.Header().Set("Retry-After", strconv.Itoa(resetIn))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSetAPIKeyLimits serves PUT /admin/api-keys/{id}/limits with
+// {"rateLimitRequests": 600, "refreshIntervalSeconds": 5}. Each field
+// replaces the key's override; null or absent returns it to the
+// environment's default.
+func handleSetAPIKeyLimits(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "API keys are read-only on a replica; change them on the primary")
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "id must be an integer")
+		return
+	}
+	var req struct {
+		RateLimitRequests      *int `json:"rateLimitRequests"`
+		RefreshIntervalSeconds *int `json:"refreshIntervalSeconds"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"rateLimitRequests\": 600, \"refreshIntervalSeconds\": 5}")
+		return
+	}
+	if msg := checkKeyLimits(req.RateLimitRequests, req.RefreshIntervalSeconds); msg != "" {
+		writeError(w, http.StatusBadRequest, msg)
+		return
+	}
+	k, err := readAPIKey(r, id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no API key "+r.PathValue("id"))
+		return
+	}
+	before := k
+	k.RateLimitRequests, k.RefreshIntervalSeconds = req.RateLimitRequests, req.RefreshIntervalSeconds
+	_, err = database.ExecContext(r.Context(), `
+		UPDATE api_keys SET rate_limit_requests = ?, refresh_interval_seconds = ? WHERE id = ?
+	`, k.RateLimitRequests, k.RefreshIntervalSeconds, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	reloadAfterWrite(r)
+	auditChange(r, before, k)
+	logf(r.Context(), "[admin] API key %d (%s) limits changed", k.ID, k.Name)
+	writeJSON(w, http.StatusOK, k)
+}
+
+// checkKeyLimits validates an API key's overrides, returning the error
+// message for a 400 or "".
+func checkKeyLimits(requests, refreshSeconds *int) string {
+	if n := requests; n != nil && (*n < 0 || *n > 1000000) {
+		return "rateLimitRequests must be between 0 (unlimited) and 1000000"
+	}
+	if n := refreshSeconds; n != nil && (*n < 1 || *n > 86400) {
+		return "refreshIntervalSeconds must be between 1 and 86400"
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLockKey signs rate-lock tokens; nil unless RATE_LOCK_SECRET (or its
+// _FILE etc. forms) is set. Tokens are stateless, so any instance sharing
+// the secret, replicas included, can issue and verify them. Rotating the
+// secret invalidates outstanding tokens.
+var rateLockKey *secret
+
+// setupRateLocks loads RATE_LOCK_SECRET and keeps it current.
+func setupRateLocks(ctx context.Context, refresh time.Duration) error {
+	key, source, err := loadSecret("RATE_LOCK_SECRET")
+	if err != nil || source == nil {
+		return err
+	}
+	if len(key.Get()) < 16 {
+		return errors.New("RATE_LOCK_SECRET must be at least 16 characters")
+	}
+	rateLockKey = key
+	if !source.static {
+		go refreshSecret(ctx, "RATE_LOCK_SECRET", source, key, refresh)
+	}
+	return nil
+}
+
+// RateLock is the claim a rate-lock token carries: price per unit and
+// total for a quantity, honored until ExpiresAt.
+type RateLock struct {
+	ID        string  `json:"id"`
+	Symbol    string  `json:"symbol"`
+	Grams     float64 `json:"grams"`
+	Price     int64   `json:"price"`
+	PriceRaw  *int64  `json:"priceRaw,omitempty"`
+	Total     int64   `json:"total"`
+	FetchedAt string  `json:"fetchedAt"`
+	IssuedAt  string  `json:"issuedAt"`
+	ExpiresAt string  `json:"expiresAt"`
+}
+
+// signRateLock encodes l as base64url(JSON) "." base64url(HMAC-SHA256).
+func signRateLock(l RateLock) string {
+	payload, _ := json.Marshal(l)
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(rateLockKey.Get()))
+	mac.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseRateLock checks a token's signature and decodes its claim; expiry
+// is left to the caller.
+func parseRateLock(token string) (*RateLock, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, []byte(rateLockKey.Get()))
+	mac.Write([]byte(body))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, errors.New("signature does not match")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var l RateLock
+	if err := json.Unmarshal(payload, &l); err != nil {
+		return nil, errors.New("malformed token")
+	}
+	return &l, nil
+}
+
+// handleCreateRateLock serves POST /api/rate-locks with a body of
+// {"symbol": "gold_18k", "grams": 2.5, "minutes": 10}: a signed token
+// locking the current cached price for that quantity, for checkout flows
+// that must honor a displayed price briefly. A stale price can't be
+// locked.
+func handleCreateRateLock(w http.ResponseWriter, r *http.Request) {
+	if rateLockKey == nil {
+		writeError(w, http.StatusConflict, "rate locks are off; set RATE_LOCK_SECRET")
+		return
+	}
+	var req struct {
+		Symbol  string  `json:"symbol"`
+		Grams   float64 `json:"grams"`
+		Minutes int     `json:"minutes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"symbol\": \"gold_18k\", \"grams\": 2.5, \"minutes\": 10}")
+		return
+	}
+	if req.Symbol == "" {
+		req.Symbol = "gold_18k"
+	}
+	if req.Minutes == 0 {
+		req.Minutes = cfg.RateLockDefaultMinutes
+	}
+	if req.Grams <= 0 || req.Grams > 1e6 || math.IsNaN(req.Grams) {
+		writeError(w, http.StatusBadRequest, "grams must be positive")
+		return
+	}
+	if req.Minutes < 1 || req.Minutes > cfg.RateLockMaxMinutes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("minutes must be between 1 and %d", cfg.RateLockMaxMinutes))
+		return
+	}
+
+	var price int64
+	var fetched string
+	err := database.QueryRowContext(r.Context(), "SELECT price_rial, fetched_at FROM gold_prices WHERE symbol = ?", req.Symbol).Scan(&price, &fetched)
+	if err != nil || !symbolActive(req.Symbol) {
+		writeError(w, http.StatusNotFound, "no cached price for "+req.Symbol)
+		return
+	}
+	fetchedAt, _ := time.Parse(time.RFC3339, fetched)
+	if clockSince(fetchedAt) > staleThreshold {
+		writeError(w, http.StatusServiceUnavailable, "the cached price is stale and can't be locked")
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := clock.Now().UTC()
+	lock := RateLock{
+		ID:        "rl_" + hex.EncodeToString(id),
+		Symbol:    req.Symbol,
+		Grams:     req.Grams,
+		Price:     price,
+		FetchedAt: fetched,
+		IssuedAt:  now.Format(time.RFC3339),
+		ExpiresAt: now.Add(time.Duration(req.Minutes) * time.Minute).Format(time.RFC3339),
+	}
+	// Lock the price the customer was shown, rounded like every served
+	// price, and keep the cached one in the claim.
+	raw, rule := applyRounding(req.Symbol, &lock.Price)
+	lock.PriceRaw = raw
+	lock.Total = int64(math.Round(float64(lock.Price) * req.Grams))
+	if rule != nil {
+		lock.Total = rule.round(lock.Total)
+	}
+	metrics.Count("ratelock.issued", 1, map[string]string{"symbol": req.Symbol})
+	writeJSON(w, http.StatusCreated, map[string]any{"token": signRateLock(lock), "lock": lock})
+}
+
+// handleVerifyRateLock serves POST /api/rate-locks/verify with a body of
+// {"token": "..."}. A genuine token gets 200 with its lock and "valid"
+// saying whether it is still within its window; a forged or garbled one
+// gets 400.
+func handleVerifyRateLock(w http.ResponseWriter, r *http.Request) {
+	if rateLockKey == nil {
+		writeError(w, http.StatusConflict, "rate locks are off; set RATE_LOCK_SECRET")
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil || req.Token == "" {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"token\": \"...\"}")
+		return
+	}
+	lock, err := parseRateLock(req.Token)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token: "+err.Error())
+		return
+	}
+	expires, _ := time.Parse(time.RFC3339, lock.ExpiresAt)
+	valid := clock.Now().Before(expires)
+	metrics.Count("ratelock.verified", 1, map[string]string{"valid": strconv.FormatBool(valid)})
+	writeJSON(w, http.StatusOK, map[string]any{"valid": valid, "lock": lock})
+}
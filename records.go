@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Record event kinds. A new all-time high is reported only as such, not
+// also as a 52-week high.
+const (
+	recordAllTimeHigh = "all_time_high"
+	record52WeekHigh  = "52_week_high"
+)
+
+// RecordEvent is emitted when a fetched price beats a previous record.
+type RecordEvent struct {
+	ID            int64  `json:"id"`
+	Symbol        string `json:"symbol"`
+	Kind          string `json:"kind"`
+	Price         int64  `json:"price"`
+	At            string `json:"at"`
+	AtMs          *int64 `json:"atMs,omitempty"`
+	PreviousPrice int64  `json:"previousPrice"`
+	PreviousAt    string `json:"previousAt"`
+	PreviousAtMs  *int64 `json:"previousAtMs,omitempty"`
+}
+
+var recordWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// detectRecord compares a new price with the all-time and 52-week highs
+// in the candle history, returning the event to store once the price is
+// cached, or nil. It must run before the price is recorded as a tick.
+// Nothing fires without previous history to beat.
+func detectRecord(ctx context.Context, symbol string, priceRial int64, at time.Time) *RecordEvent {
+	ath, err := findExtreme(ctx, symbol, time.Time{}, true)
+	if err != nil || ath == nil {
+		return nil
+	}
+	kind, prev := "", ath
+	if priceRial > ath.Price {
+		kind = recordAllTimeHigh
+	} else if yearHigh, err := findExtreme(ctx, symbol, at.AddDate(-1, 0, 0), true); err == nil && yearHigh != nil && priceRial > yearHigh.Price {
+		kind, prev = record52WeekHigh, yearHigh
+	}
+	if kind == "" {
+		return nil
+	}
+	return &RecordEvent{
+		Symbol:        symbol,
+		Kind:          kind,
+		Price:         priceRial,
+		At:            at.UTC().Format(time.RFC3339),
+		PreviousPrice: prev.Price,
+		PreviousAt:    prev.At,
+	}
+}
+
+// storeRecord saves, logs and counts an event from detectRecord and sends
+// the webhook.
+func storeRecord(ctx context.Context, ev RecordEvent) {
+	res, err := database.Exec(`
+		INSERT INTO record_events (symbol, kind, price_rial, at, previous_price_rial, previous_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ev.Symbol, ev.Kind, ev.Price, ev.At, ev.PreviousPrice, ev.PreviousAt)
+	if err != nil {
+		logf(ctx, "[records] Storing %s event failed: %v", ev.Kind, err)
+		return
+	}
+	ev.ID, _ = res.LastInsertId()
+	logf(ctx, "[records] New %s for %s: %d Rial (previous %d at %s)", ev.Kind, ev.Symbol, ev.Price, ev.PreviousPrice, ev.PreviousAt)
+	metrics.Count("price.record", 1, map[string]string{"symbol": ev.Symbol, "kind": ev.Kind})
+
+	if cfg.RecordWebhookURL != "" {
+		go sendRecordWebhook(ev)
+	}
+}
+
+// sendRecordWebhook POSTs the event as JSON, retrying twice. With
+// RECORD_WEBHOOK_SECRET set the body is signed in X-Signature as
+// "sha256=<hex HMAC>".
+func sendRecordWebhook(ev RecordEvent) {
+	body, _ := json.Marshal(ev)
+	var lastErr error
+	for attempt := 1; attempt <= 3; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 2 * time.Second)
+		}
+		req, err := http.NewRequest(http.MethodPost, cfg.RecordWebhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[records] Webhook request invalid: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-Kind", ev.Kind)
+		if cfg.RecordWebhookSecret != "" {
+			mac := hmac.New(sha256.New, []byte(cfg.RecordWebhookSecret))
+			mac.Write(body)
+			req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := recordWebhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		lastErr = err
+	}
+	log.Printf("[records] Webhook for event %d failed after 3 attempts: %v", ev.ID, lastErr)
+}
+
+// handleRecords serves GET /api/gold/18k/records?limit=20: record events,
+// newest first, paged with ?cursor= from the previous page's nextCursor.
+func handleRecords(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 20, 1, 500)
+	before := qp.cursor("cursor")
+	withMs := qp.unixMs()
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, symbol, kind, price_rial, at, previous_price_rial, previous_at
+		FROM record_events
+		WHERE symbol = ? AND (? = '' OR (at, id) < (?, ?))
+		ORDER BY at DESC, id DESC
+		LIMIT ?
+	`, "gold_18k", before.T, before.T, before.ID, limit+1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	events := []RecordEvent{}
+	more := false
+	for rows.Next() {
+		if len(events) == limit {
+			more = true
+			break
+		}
+		var ev RecordEvent
+		if err := rows.Scan(&ev.ID, &ev.Symbol, &ev.Kind, &ev.Price, &ev.At, &ev.PreviousPrice, &ev.PreviousAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if withMs {
+			ev.AtMs, ev.PreviousAtMs = unixMs(ev.At), unixMs(ev.PreviousAt)
+		}
+		events = append(events, ev)
+	}
+	resp := map[string]any{"events": events, "nextCursor": nil}
+	if more {
+		last := events[len(events)-1]
+		resp["nextCursor"] = setNextLink(w, r, pageCursor{T: last.At, ID: last.ID})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
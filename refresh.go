@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// refreshTimeout bounds the synchronous upstream fetch of ?refresh=true.
+const refreshTimeout = 4 * time.Second
+
+// refreshLimiter allows each client one forced refresh per interval.
+type refreshLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time // when each client may refresh again
+}
+
+var refreshes = &refreshLimiter{next: map[string]time.Time{}}
+
+// allow records a refresh for client and reports whether it is permitted,
+// returning how long to wait when it isn't.
+func (l *refreshLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	return l.allowEvery(client, l.interval, now)
+}
+
+// allowEvery is allow with a per-client interval (an API key's override).
+func (l *refreshLimiter) allowEvery(client string, interval time.Duration, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next, ok := l.next[client]; ok && now.Before(next) {
+		return false, next.Sub(now)
+	}
+	l.next[client] = now.Add(interval)
+	// Forget clients whose window has passed so the map stays small.
+	for k, t := range l.next {
+		if !now.Before(t) {
+			delete(l.next, k)
+		}
+	}
+	return true, 0
+}
+
+// forceRefresh handles ?refresh=true: it fetches upstream synchronously
+// before the cached price is read, so the response carries the freshest
+// value. It reports the outcome in X-Refresh and returns false when the
+// request was rejected (429 already written).
+//
+// The fetch goes through fetchAndCache, so the overlap guard still
+// applies: if a poll is already running, the refresh is skipped and the
+// cache is served as is.
+func forceRefresh(w http.ResponseWriter, r *http.Request) bool {
+	if !pollsUpstream() {
+		w.Header().Set("X-Refresh", "disabled")
+		return true
+	}
+	interval := refreshes.interval
+	if k := requestAPIKey(r); k != nil && k.RefreshIntervalSeconds != nil {
+		interval = time.Duration(*k.RefreshIntervalSeconds) * time.Second
+	}
+	if ok, wait := refreshes.allowEvery(rateClient(r), interval, time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "refresh rate limit exceeded; retry later or omit refresh=true")
+		return false
+	}
+
+	// Leave room within the server's WriteTimeout to send the response.
+	ctx, cancel := context.WithTimeout(r.Context(), refreshTimeout)
+	defer cancel()
+	start := time.Now()
+	err := fetchAndCache(ctx, primaryProvider)
+	switch {
+	case errors.Is(err, errFetchInProgress):
+		w.Header().Set("X-Refresh", "in-progress")
+		return true
+	case err != nil:
+		w.Header().Set("X-Refresh", "failed")
+		logf(r.Context(), "[refresh] Forced fetch failed (%s): %v", errorClass(err), err)
+		return true
+	}
+	poller.recordSuccess()
+	w.Header().Set("X-Refresh", "ok")
+	logf(r.Context(), "[refresh] Forced fetch took %v", time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// revalidations debounces stale-while-revalidate fetches service-wide.
+var revalidations = &refreshLimiter{next: map[string]time.Time{}}
+
+// revalidate starts a background fetch when a request finds the cache
+// stale, at most once per REVALIDATE_DEBOUNCE. The request that noticed
+// is served the stale value without waiting. Failures are only logged:
+// the poller's own backoff is left alone.
+func revalidate(ctx context.Context) {
+	if !pollsUpstream() {
+		return
+	}
+	if ok, _ := revalidations.allow("swr", time.Now()); !ok {
+		return
+	}
+	// Detach from the request, which ends before the fetch does, but keep
+	// its trace so the upstream call can be joined to it.
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upstreamTimeout+time.Second)
+	go func() {
+		defer cancel()
+		switch err := fetchAndCache(fetchCtx, primaryProvider); {
+		case errors.Is(err, errFetchInProgress):
+		case err != nil:
+			logf(fetchCtx, "[revalidate] Background fetch failed (%s): %v", errorClass(err), err)
+		default:
+			poller.recordSuccess()
+			logf(fetchCtx, "[revalidate] Refreshed stale cache")
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamRecording is one provider request and its outcome, stored as
+// <seq>.json under UPSTREAM_RECORD_DIR. URL has the key parameter removed
+// and request headers are not kept, so recordings never hold the API key.
+// Error is set instead of Status and Body when the request failed at the
+// transport level. Recordings are meant to be edited by hand to build
+// test cases.
+type upstreamRecording struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        string `json:"body,omitempty"`
+	Error       string `json:"error,omitempty"`
+	RecordedAt  string `json:"recordedAt"`
+}
+
+// replayKey identifies a request regardless of the API key it carried.
+func replayKey(method, rawURL string) string {
+	return method + " " + stripKeyParam(rawURL)
+}
+
+func stripKeyParam(rawURL string) string {
+	before, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	kept := []string{}
+	for _, part := range strings.Split(query, "&") {
+		if part != "" && part != "key" && !strings.HasPrefix(part, "key=") {
+			kept = append(kept, part)
+		}
+	}
+	sort.Strings(kept)
+	if len(kept) == 0 {
+		return before
+	}
+	return before + "?" + strings.Join(kept, "&")
+}
+
+// upstreamRecorder writes every provider exchange to dir, numbering files
+// after any recordings already there.
+type upstreamRecorder struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+func newUpstreamRecorder(dir string) (*upstreamRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating UPSTREAM_RECORD_DIR: %w", err)
+	}
+	names, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &upstreamRecorder{dir: dir}
+	for _, name := range names {
+		var n int
+		if _, err := fmt.Sscanf(name, "%d.json", &n); err == nil {
+			r.seq = max(r.seq, n)
+		}
+	}
+	return r, nil
+}
+
+func (r *upstreamRecorder) save(rec upstreamRecording) {
+	encoded, _ := json.MarshalIndent(rec, "", "  ")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	path := filepath.Join(r.dir, fmt.Sprintf("%06d.json", r.seq))
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		log.Printf("[upstream] Recording %s failed: %v", path, err)
+	}
+}
+
+// recordingTransport passes requests to next and records each exchange.
+type recordingTransport struct {
+	next     http.RoundTripper
+	recorder *upstreamRecorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := upstreamRecording{
+		Method:     req.Method,
+		URL:        stripKeyParam(req.URL.String()),
+		RecordedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		rec.Error = err.Error()
+		t.recorder.save(rec)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		rec.Error = err.Error()
+		t.recorder.save(rec)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	rec.Status, rec.ContentType, rec.Body = resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	t.recorder.save(rec)
+	return resp, nil
+}
+
+// replayTransport answers provider requests from recordings instead of the
+// network. Each request gets the next unused recording with the same
+// method and URL (ignoring the key), in file order; once they run out,
+// requests fail as outages.
+type replayTransport struct {
+	mu      sync.Mutex
+	pending map[string][]upstreamRecording
+}
+
+func loadReplay(dir string) (*replayTransport, error) {
+	names, err := recordingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	t := &replayTransport{pending: map[string][]upstreamRecording{}}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var rec upstreamRecording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("recording %s: %w", name, err)
+		}
+		if rec.Method == "" {
+			rec.Method = http.MethodGet
+		}
+		key := replayKey(rec.Method, rec.URL)
+		t.pending[key] = append(t.pending[key], rec)
+	}
+	log.Printf("[upstream] Replaying %d recordings from %s", len(names), dir)
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := replayKey(req.Method, req.URL.String())
+	t.mu.Lock()
+	queue := t.pending[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("replay: no recording left for %s", key)
+	}
+	rec := queue[0]
+	t.pending[key] = queue[1:]
+	t.mu.Unlock()
+
+	if rec.Error != "" {
+		return nil, fmt.Errorf("replay: %s", rec.Error)
+	}
+	header := http.Header{}
+	if rec.ContentType != "" {
+		header.Set("Content-Type", rec.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
+
+// recordingFiles lists the *.json files in dir in name order.
+func recordingFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
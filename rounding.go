@@ -0,0 +1,39 @@
+package main
+
+// Rounding modes for RoundingRule.
+const (
+	roundNearest = "nearest"
+	roundDown    = "down"
+	roundUp      = "up"
+)
+
+// RoundingRule makes served prices of a symbol a multiple of Step Rial,
+// the way shops quote them. Stored prices, history and conversions stay
+// raw.
+type RoundingRule struct {
+	Step int64  `json:"step"`
+	Mode string `json:"mode"`
+}
+
+// round applies the rule to a positive price; halves round up.
+func (r RoundingRule) round(price int64) int64 {
+	switch r.Mode {
+	case roundDown:
+		return price / r.Step * r.Step
+	case roundUp:
+		return (price + r.Step - 1) / r.Step * r.Step
+	}
+	return (price + r.Step/2) / r.Step * r.Step
+}
+
+// applyRounding rounds *price in place by symbol's PRICE_ROUNDING rule and
+// returns the raw price and the rule, or nils when the symbol has none.
+func applyRounding(symbol string, price *int64) (raw *int64, rule *RoundingRule) {
+	r, ok := cfg.PriceRounding[symbol]
+	if !ok {
+		return nil, nil
+	}
+	unrounded := *price
+	*price = r.round(unrounded)
+	return &unrounded, &r
+}
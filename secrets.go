@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// secret holds a value that may be rotated while in use.
+type secret struct {
+	v atomic.Value
+}
+
+func (s *secret) Get() string {
+	v, _ := s.v.Load().(string)
+	return v
+}
+
+func (s *secret) Set(v string) {
+	s.v.Store(v)
+}
+
+// secretSource loads the current value of a secret from wherever it is
+// configured. Static sources (plain env vars) are never re-read.
+type secretSource struct {
+	desc   string
+	static bool
+	load   func(ctx context.Context) (string, error)
+}
+
+// secretSourceFromEnv resolves how the secret NAME is provided, in order
+// of precedence:
+//
+//	NAME                     plain value
+//	NAME_FILE                file contents (Docker/K8s secrets)
+//	NAME_VAULT_PATH          Vault KV v1/v2 path, field NAME_VAULT_FIELD
+//	NAME_AWS_SECRET_ID       AWS Secrets Manager, optional JSON field NAME_AWS_FIELD
+//
+// It returns nil when none is set.
+func secretSourceFromEnv(name string) *secretSource {
+	if v := os.Getenv(name); v != "" {
+		return &secretSource{desc: name, static: true, load: func(context.Context) (string, error) { return v, nil }}
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		return &secretSource{desc: "file " + path, load: func(context.Context) (string, error) {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(raw)), nil
+		}}
+	}
+	if path := os.Getenv(name + "_VAULT_PATH"); path != "" {
+		field := envOrDefault(name+"_VAULT_FIELD", strings.ToLower(name))
+		return &secretSource{desc: "vault " + path, load: func(ctx context.Context) (string, error) {
+			return readVaultSecret(ctx, path, field)
+		}}
+	}
+	if id := os.Getenv(name + "_AWS_SECRET_ID"); id != "" {
+		field := os.Getenv(name + "_AWS_FIELD")
+		return &secretSource{desc: "aws secret " + id, load: func(ctx context.Context) (string, error) {
+			return readAWSSecret(ctx, id, field)
+		}}
+	}
+	return nil
+}
+
+// loadSecret resolves NAME via secretSourceFromEnv and loads its current
+// value. src is nil (and the secret empty) when NAME isn't configured.
+func loadSecret(name string) (s *secret, src *secretSource, err error) {
+	s = &secret{}
+	src = secretSourceFromEnv(name)
+	if src == nil {
+		return s, nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	v, err := src.load(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading %s from %s: %w", name, src.desc, err)
+	}
+	if v == "" {
+		return nil, nil, fmt.Errorf("%s from %s is empty", name, src.desc)
+	}
+	s.Set(v)
+	return s, src, nil
+}
+
+// refreshSecret re-reads src every interval and swaps the new value into
+// s, so keys can rotate without a restart. Values are never logged.
+func refreshSecret(ctx context.Context, name string, src *secretSource, s *secret, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			v, err := src.load(loadCtx)
+			cancel()
+			switch {
+			case err != nil:
+				log.Printf("[secrets] Re-reading %s from %s failed: %v (keeping current value)", name, src.desc, err)
+			case v == "":
+				log.Printf("[secrets] %s from %s is empty (keeping current value)", name, src.desc)
+			case v != s.Get():
+				s.Set(v)
+				log.Printf("[secrets] %s rotated from %s", name, src.desc)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var secretsHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// readVaultSecret reads field from a Vault KV secret using VAULT_ADDR and
+// VAULT_TOKEN (or VAULT_TOKEN_FILE, re-read on every call so an agent can
+// renew it). Both KV v1 and v2 response shapes are accepted.
+func readVaultSecret(ctx context.Context, path, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if tokenFile := os.Getenv("VAULT_TOKEN_FILE"); token == "" && tokenFile != "" {
+		raw, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := secretsHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding vault response: %w", err)
+	}
+	data := body.Data
+	// KV v2 nests the secret under data.data.
+	if nested, ok := body.Data["data"]; ok {
+		var inner map[string]json.RawMessage
+		if json.Unmarshal(nested, &inner) == nil {
+			data = inner
+		}
+	}
+	var value string
+	if err := json.Unmarshal(data[field], &value); err != nil || value == "" {
+		return "", fmt.Errorf("field %q not found in vault secret", field)
+	}
+	return value, nil
+}
+
+// readAWSSecret calls Secrets Manager GetSecretValue with static
+// credentials from AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY (and
+// AWS_SESSION_TOKEN). With field set, SecretString is parsed as a JSON
+// object and that key is returned.
+func readAWSSecret(ctx context.Context, id, field string) (string, error) {
+	region := envOrDefault("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION"))
+	if region == "" {
+		return "", fmt.Errorf("AWS_REGION is not set")
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, "secretsmanager", region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), time.Now())
+
+	resp, err := secretsHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("secrets manager returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decoding secrets manager response: %w", err)
+	}
+	if field == "" {
+		return strings.TrimSpace(out.SecretString), nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(out.SecretString), &fields); err != nil || fields[field] == "" {
+		return "", fmt.Errorf("field %q not found in secret %s", field, id)
+	}
+	return fields[field], nil
+}
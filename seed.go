@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// seedEntry is one row of SEED_FILE. FetchedAt defaults to load time.
+type seedEntry struct {
+	Symbol    string `json:"symbol"`
+	Name      string `json:"name"`
+	Price     int64  `json:"price"`
+	FetchedAt string `json:"fetchedAt"`
+}
+
+// loadSeedFile inserts the prices in path when the cache is empty, so a
+// fresh deployment serves data before the first upstream poll completes.
+// The file is loaded in one transaction, all or nothing. Once any price
+// exists (seeded or fetched) the file is ignored.
+func loadSeedFile(path string) error {
+	var n int
+	if err := database.QueryRow("SELECT COUNT(*) FROM gold_prices").Scan(&n); err != nil {
+		return fmt.Errorf("counting cached prices failed: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []seedEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("invalid seed JSON: %w", err)
+	}
+
+	// Validate everything before writing anything: a partial seed would
+	// make the cache non-empty and the file would never be loaded again.
+	// A fetchedAt in the future would make the poller's first writes look
+	// older than the cached rows, and checkPriceWrite would refuse them.
+	now := clock.Now().UTC()
+	latest := now.Add(clockJumpTolerance)
+	for i, e := range entries {
+		if e.Symbol == "" || e.Name == "" || e.Price <= 0 {
+			return fmt.Errorf("seed entry %d: symbol, name and a positive price are required", i)
+		}
+		if e.FetchedAt == "" {
+			entries[i].FetchedAt = now.Format(time.RFC3339)
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, e.FetchedAt)
+		if err != nil {
+			return fmt.Errorf("seed entry %d: fetchedAt must be RFC3339: %w", i, err)
+		}
+		if t.After(latest) {
+			return fmt.Errorf("seed entry %d: fetchedAt %s is in the future", i, e.FetchedAt)
+		}
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, e := range entries {
+		_, err := tx.Exec(
+			"INSERT OR IGNORE INTO gold_prices (symbol, name, price_rial, fetched_at, source) VALUES (?, ?, ?, ?, 'seed')",
+			e.Symbol, e.Name, e.Price, e.FetchedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("seed entry %d: insert failed: %w", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing seed failed: %w", err)
+	}
+	log.Printf("[seed] Loaded %d prices from %s", len(entries), path)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// shadowRetention bounds how long shadow comparisons are kept.
+const shadowRetention = 30 * 24 * time.Hour
+
+// newShadowProvider returns nil unless SHADOW_PROVIDER_URL is set. The
+// shadow must speak the BrsApi.ir response format.
+func newShadowProvider(c Config) (*brsProvider, error) {
+	if c.ShadowURL == "" {
+		return nil, nil
+	}
+	key, keySource, err := loadSecret("SHADOW_PROVIDER_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return &brsProvider{
+		name:      c.ShadowName,
+		url:       c.ShadowURL,
+		apiKey:    key,
+		keySource: keySource,
+		headers:   c.ShadowHeaders,
+		keyHeader: c.ShadowKeyHeader,
+	}, nil
+}
+
+// runShadowPoller fetches from the shadow provider every interval and
+// stores each quote next to the price currently being served. Shadow
+// quotes are never served to clients.
+func runShadowPoller(ctx context.Context, p *brsProvider, interval time.Duration) {
+	ticker := time.NewTicker(clock.Real(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			recordShadowQuote(ctx, p)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func recordShadowQuote(ctx context.Context, p *brsProvider) {
+	if !symbolActive("gold_18k") {
+		return
+	}
+	var price, primaryPrice sql.NullInt64
+	errMsg := ""
+	start := time.Now()
+	item, err := p.fetchGold18k(ctx)
+	recordFetch(p.name, start, err)
+	if err != nil {
+		errMsg = err.Error()
+		log.Printf("[shadow] %s fetch failed (%s): %v", p.name, errorClass(err), err)
+	} else {
+		// Convert Toman to Rial (x10)
+		price = sql.NullInt64{Int64: int64(item.Price * 10), Valid: true}
+	}
+	database.QueryRow("SELECT price_rial FROM gold_prices WHERE symbol = ?", "gold_18k").Scan(&primaryPrice)
+
+	now := clock.Now().UTC()
+	_, err = database.Exec(`
+		INSERT INTO shadow_quotes (provider, symbol, price_rial, primary_price_rial, error, fetched_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, p.name, "gold_18k", price, primaryPrice, errMsg, now.Format(time.RFC3339))
+	if err != nil {
+		log.Printf("[shadow] Insert failed: %v", err)
+		return
+	}
+	database.Exec("DELETE FROM shadow_quotes WHERE fetched_at < ?", now.Add(-shadowRetention).Format(time.RFC3339))
+}
+
+// ProviderDiff summarizes how far a shadow provider diverged from the
+// served price over a window. Diff fields only count samples where both
+// prices were available.
+type ProviderDiff struct {
+	Provider             string   `json:"provider"`
+	Samples              int      `json:"samples"`
+	Failures             int      `json:"failures"`
+	MeanAbsDiffRial      *float64 `json:"meanAbsDiffRial"`
+	MeanAbsDiffPercent   *float64 `json:"meanAbsDiffPercent"`
+	MaxAbsDiffPercent    *float64 `json:"maxAbsDiffPercent"`
+	LastPriceRial        *int64   `json:"lastPriceRial"`
+	LastPrimaryPriceRial *int64   `json:"lastPrimaryPriceRial"`
+	LastFetchedAt        string   `json:"lastFetchedAt"`
+}
+
+// handleProviderDiff serves GET /admin/providers/diff?window=24h.
+func handleProviderDiff(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	window := qp.duration("window", 24*time.Hour)
+	if !qp.valid(w) {
+		return
+	}
+	since := clock.Now().UTC().Add(-window).Format(time.RFC3339)
+
+	rows, err := database.Query(`
+		SELECT provider,
+		       COUNT(*),
+		       SUM(CASE WHEN error != '' THEN 1 ELSE 0 END),
+		       AVG(ABS(price_rial - primary_price_rial)),
+		       AVG(ABS(price_rial - primary_price_rial) * 100.0 / primary_price_rial),
+		       MAX(ABS(price_rial - primary_price_rial) * 100.0 / primary_price_rial),
+		       MAX(fetched_at)
+		FROM shadow_quotes
+		WHERE fetched_at >= ?
+		GROUP BY provider
+		ORDER BY provider
+	`, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	diffs := []ProviderDiff{}
+	for rows.Next() {
+		var d ProviderDiff
+		var meanRial, meanPct, maxPct sql.NullFloat64
+		if err := rows.Scan(&d.Provider, &d.Samples, &d.Failures, &meanRial, &meanPct, &maxPct, &d.LastFetchedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		d.MeanAbsDiffRial = nullFloat(meanRial)
+		d.MeanAbsDiffPercent = nullFloat(meanPct)
+		d.MaxAbsDiffPercent = nullFloat(maxPct)
+		diffs = append(diffs, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for i := range diffs {
+		var last, lastPrimary sql.NullInt64
+		database.QueryRow(`
+			SELECT price_rial, primary_price_rial FROM shadow_quotes
+			WHERE provider = ? ORDER BY id DESC LIMIT 1
+		`, diffs[i].Provider).Scan(&last, &lastPrimary)
+		diffs[i].LastPriceRial = nullInt(last)
+		diffs[i].LastPrimaryPriceRial = nullInt(lastPrimary)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window":    window.String(),
+		"providers": diffs,
+	})
+}
+
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+func nullInt(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// sheetsExporter appends prices to a Google Sheet as a service account.
+// In daily mode each completed local day's close is appended once, in day
+// order, and remembered in sheets_exports; in snapshot mode the current
+// prices are appended every SHEETS_INTERVAL.
+type sheetsExporter struct {
+	apiURL        string
+	spreadsheetID string
+	sheetRange    string
+	mode          string
+	symbols       []string
+	interval      time.Duration
+	credentials   *secret
+	credsSource   *secretSource
+	client        *http.Client
+
+	// mu serializes exports and guards the cached access token.
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+}
+
+// sheets is nil unless SHEETS_SPREADSHEET_ID is set.
+var sheets *sheetsExporter
+
+func newSheetsExporter(c Config) (*sheetsExporter, error) {
+	if c.SheetsSpreadsheetID == "" {
+		return nil, nil
+	}
+	creds, source, err := loadSecret("GOOGLE_SHEETS_CREDENTIALS")
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, errors.New("SHEETS_SPREADSHEET_ID requires GOOGLE_SHEETS_CREDENTIALS (or GOOGLE_SHEETS_CREDENTIALS_FILE, ..._VAULT_PATH, ..._AWS_SECRET_ID)")
+	}
+	if _, err := parseServiceAccount(creds.Get()); err != nil {
+		return nil, fmt.Errorf("GOOGLE_SHEETS_CREDENTIALS: %w", err)
+	}
+	return &sheetsExporter{
+		apiURL:        strings.TrimSuffix(c.SheetsAPIURL, "/"),
+		spreadsheetID: c.SheetsSpreadsheetID,
+		sheetRange:    c.SheetsRange,
+		mode:          c.SheetsMode,
+		symbols:       c.SheetsSymbols,
+		interval:      c.SheetsInterval,
+		credentials:   creds,
+		credsSource:   source,
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// run exports at startup and then every interval until ctx is done.
+func (s *sheetsExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(clock.Real(s.interval))
+	defer ticker.Stop()
+	for {
+		if _, err := s.export(ctx); err != nil {
+			log.Printf("[sheets] Export failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// export appends whatever is due and returns the number of rows written.
+func (s *sheetsExporter) export(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	var err error
+	if s.mode == "snapshot" {
+		n, err = s.exportSnapshot(ctx)
+	} else {
+		n, err = s.exportCloses(ctx)
+	}
+	if err != nil {
+		metrics.Count("sheets.export", 1, map[string]string{"result": "error"})
+		return 0, err
+	}
+	if n > 0 {
+		metrics.Count("sheets.export", 1, map[string]string{"result": "ok"})
+		metrics.Count("sheets.rows", int64(n), nil)
+		log.Printf("[sheets] Appended %d rows to %s", n, s.sheetRange)
+	}
+	return n, nil
+}
+
+// exportCloses appends the closes of completed days not exported yet, as
+// rows of day, symbol, close. The current day is left until it ends.
+// Rows are marked after the append succeeds, so a crash in between can
+// repeat them once but never lose them.
+func (s *sheetsExporter) exportCloses(ctx context.Context) (int, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(s.symbols)), ",")
+	args := []any{closeDay(clock.Now())}
+	for _, symbol := range s.symbols {
+		args = append(args, symbol)
+	}
+	rows, err := database.QueryContext(ctx, `
+		SELECT c.day, c.symbol, c.close_rial FROM daily_closes c
+		LEFT JOIN sheets_exports e ON e.symbol = c.symbol AND e.day = c.day
+		WHERE e.day IS NULL AND c.day < ? AND c.symbol IN (`+placeholders+`)
+		ORDER BY c.day, c.symbol LIMIT 1000
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	var values [][]any
+	for rows.Next() {
+		var day, symbol string
+		var price int64
+		if err := rows.Scan(&day, &symbol, &price); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values = append(values, []any{day, symbol, price})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if err := s.append(ctx, values); err != nil {
+		return 0, err
+	}
+
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, v := range values {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO sheets_exports (symbol, day, exported_at) VALUES (?, ?, ?)
+		`, v[1], v[0], now); err != nil {
+			return 0, err
+		}
+	}
+	return len(values), tx.Commit()
+}
+
+// exportSnapshot appends the current price of each symbol as rows of
+// time (in DAILY_CLOSE_TZ), symbol, price.
+func (s *sheetsExporter) exportSnapshot(ctx context.Context) (int, error) {
+	at := clock.Now().In(cfg.DailyCloseTZ).Format(time.DateTime)
+	var values [][]any
+	for _, symbol := range s.symbols {
+		var price int64
+		err := database.QueryRowContext(ctx, "SELECT price_rial FROM gold_prices WHERE symbol = ?", symbol).Scan(&price)
+		if err != nil || !symbolActive(symbol) {
+			continue
+		}
+		values = append(values, []any{at, symbol, price})
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	return len(values), s.append(ctx, values)
+}
+
+// append calls spreadsheets.values.append with RAW input, inserting rows
+// after the last row of the range's table.
+func (s *sheetsExporter) append(ctx context.Context, values [][]any) error {
+	token, err := s.token(ctx)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]any{"values": values})
+	endpoint := fmt.Sprintf("%s/v4/spreadsheets/%s/values/%s:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS",
+		s.apiURL, url.PathEscape(s.spreadsheetID), url.PathEscape(s.sheetRange))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.accessToken = ""
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Sheets API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// serviceAccount is the part of a Google service account key file the
+// exporter needs.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+func parseServiceAccount(raw string) (*serviceAccount, error) {
+	var sa serviceAccount
+	if err := json.Unmarshal([]byte(raw), &sa); err != nil {
+		return nil, fmt.Errorf("not a service account key file: %w", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("client_email and private_key are required")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("private_key: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	sa.key = key
+	return &sa, nil
+}
+
+// token returns a cached access token, or exchanges a freshly signed JWT
+// assertion for one (RFC 7523). The key file is re-read from the secret
+// each time, so it can rotate. Callers hold s.mu.
+func (s *sheetsExporter) token(ctx context.Context) (string, error) {
+	if s.accessToken != "" && time.Until(s.tokenExpiry) > time.Minute {
+		return s.accessToken, nil
+	}
+	sa, err := parseServiceAccount(s.credentials.Get())
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := signJWT(sa.key, map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   sa.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sa.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("token exchange returned status %d: %s", resp.StatusCode, result.ErrorDescription)
+	}
+	s.accessToken = result.AccessToken
+	s.tokenExpiry = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.accessToken, nil
+}
+
+// signJWT encodes claims as an RS256-signed JWT.
+func signJWT(key *rsa.PrivateKey, claims map[string]any) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// handleSheetsExport serves POST /admin/sheets/export: append whatever is
+// due now instead of waiting for the next interval.
+func handleSheetsExport(w http.ResponseWriter, r *http.Request) {
+	if sheets == nil {
+		writeError(w, http.StatusConflict, "Sheets export is off; set SHEETS_SPREADSHEET_ID and GOOGLE_SHEETS_CREDENTIALS on the primary")
+		return
+	}
+	n, err := sheets.export(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logf(r.Context(), "[admin] Exported %d rows to Google Sheets", n)
+	writeJSON(w, http.StatusOK, map[string]int{"rows": n})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// snapshotIDRe accepts caller-chosen snapshot IDs such as invoice numbers.
+var snapshotIDRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// maxSnapshotsPerKey bounds what one API key can store, since snapshots
+// are never deleted.
+const maxSnapshotsPerKey = 10000
+
+// Snapshot is a pinned copy of cached prices, owned by one API key. It
+// never changes once taken, so it can back the rates on an invoice.
+type Snapshot struct {
+	ID        string          `json:"id"`
+	CreatedAt string          `json:"createdAt"`
+	Note      string          `json:"note,omitempty"`
+	Prices    []SnapshotPrice `json:"prices"`
+}
+
+// SnapshotPrice is one symbol's cached price at snapshot time.
+type SnapshotPrice struct {
+	Symbol   string        `json:"symbol"`
+	Name     string        `json:"name"`
+	Price    int64         `json:"price"`
+	PriceRaw *int64        `json:"priceRaw,omitempty"`
+	Rounding *RoundingRule `json:"rounding,omitempty"`
+	Sides
+	FetchedAt string `json:"fetchedAt"`
+	Stale     bool   `json:"stale"`
+}
+
+// handleCreateSnapshot serves POST /api/snapshots with an optional body of
+// {"id": "INV-1042", "symbols": ["gold_18k"], "note": "..."}. It pins the
+// current cached price of the listed symbols, or of every active symbol,
+// under id (generated when omitted). An id that already exists is a 409,
+// so a retried request can't overwrite what an invoice refers to.
+func handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "snapshots are taken on the primary")
+		return
+	}
+	owner, ok := keyOwner(w, r, "snapshots")
+	if !ok {
+		return
+	}
+	var req struct {
+		ID      string   `json:"id"`
+		Symbols []string `json:"symbols"`
+		Note    string   `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be JSON like {\"id\": \"INV-1042\", \"symbols\": [\"gold_18k\"]}")
+			return
+		}
+	}
+	if req.ID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		req.ID = "snap_" + hex.EncodeToString(b)
+	}
+	if !snapshotIDRe.MatchString(req.ID) {
+		writeError(w, http.StatusBadRequest, "snapshot id must be 1-64 characters of A-Z, a-z, 0-9, _, . and -")
+		return
+	}
+	if len(req.Note) > 500 {
+		writeError(w, http.StatusBadRequest, "note must be at most 500 characters")
+		return
+	}
+	if len(req.Symbols) > maxWatchlistSymbols {
+		writeError(w, http.StatusBadRequest, "a snapshot holds at most 100 symbols")
+		return
+	}
+
+	query := `
+		SELECT p.symbol, p.name, p.price_rial, p.buy_rial, p.sell_rial, p.fetched_at FROM gold_prices p
+		LEFT JOIN symbols s ON s.symbol = p.symbol
+		WHERE COALESCE(s.active, 1) = 1
+		ORDER BY p.symbol`
+	var args []any
+	if len(req.Symbols) > 0 {
+		encoded, _ := json.Marshal(req.Symbols)
+		query = `
+			SELECT p.symbol, p.name, p.price_rial, p.buy_rial, p.sell_rial, p.fetched_at FROM gold_prices p
+			LEFT JOIN symbols s ON s.symbol = p.symbol
+			WHERE COALESCE(s.active, 1) = 1 AND p.symbol IN (SELECT value FROM json_each(?))
+			ORDER BY p.symbol`
+		args = append(args, string(encoded))
+	}
+	rows, err := database.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	snap := Snapshot{ID: req.ID, CreatedAt: clock.Now().UTC().Format(time.RFC3339), Note: req.Note, Prices: []SnapshotPrice{}}
+	found := map[string]bool{}
+	for rows.Next() {
+		var p SnapshotPrice
+		var buy, sell int64
+		if err := rows.Scan(&p.Symbol, &p.Name, &p.Price, &buy, &sell, &p.FetchedAt); err != nil {
+			rows.Close()
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		fetchedAt, _ := time.Parse(time.RFC3339, p.FetchedAt)
+		p.Stale = clockSince(fetchedAt) > staleThreshold
+		p.PriceRaw, p.Rounding = applyRounding(p.Symbol, &p.Price)
+		p.Sides = sides(buy, sell, p.Rounding)
+		snap.Prices = append(snap.Prices, p)
+		found[p.Symbol] = true
+	}
+	rows.Close()
+	for _, s := range req.Symbols {
+		if !found[s] {
+			writeError(w, http.StatusBadRequest, "unknown or deactivated symbol "+s)
+			return
+		}
+	}
+	if len(snap.Prices) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "no cached prices to snapshot")
+		return
+	}
+
+	var stored int
+	if err := database.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM price_snapshots WHERE owner = ?", owner).Scan(&stored); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if stored >= maxSnapshotsPerKey {
+		writeError(w, http.StatusConflict, fmt.Sprintf("an API key may keep at most %d snapshots", maxSnapshotsPerKey))
+		return
+	}
+
+	encoded, _ := json.Marshal(snap.Prices)
+	res, err := database.ExecContext(r.Context(), `
+		INSERT INTO price_snapshots (owner, id, created_at, note, prices) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(owner, id) DO NOTHING
+	`, owner, snap.ID, snap.CreatedAt, snap.Note, string(encoded))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusConflict, "snapshot "+snap.ID+" already exists")
+		return
+	}
+	w.Header().Set("Location", "/api/snapshots/"+snap.ID)
+	writeJSON(w, http.StatusCreated, snap)
+}
+
+// handleGetSnapshot serves GET /api/snapshots/{id}.
+func handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	owner, ok := keyOwner(w, r, "snapshots")
+	if !ok {
+		return
+	}
+	snap := Snapshot{ID: r.PathValue("id")}
+	var prices string
+	err := database.QueryRowContext(r.Context(), "SELECT created_at, note, prices FROM price_snapshots WHERE owner = ? AND id = ?", owner, snap.ID).
+		Scan(&snap.CreatedAt, &snap.Note, &prices)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "no snapshot "+snap.ID)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.Unmarshal([]byte(prices), &snap.Prices)
+	writeJSON(w, http.StatusOK, snap)
+}
@@ -0,0 +1,24 @@
+package main
+
+// Sides are the buy and sell prices in Rial of an item the provider quotes
+// both sides of, and the spread between them. All three are omitted for
+// items with a single price.
+type Sides struct {
+	Buy    *int64 `json:"buy,omitempty"`
+	Sell   *int64 `json:"sell,omitempty"`
+	Spread *int64 `json:"spread,omitempty"`
+}
+
+// sides builds the served sides from a row's buy_rial and sell_rial,
+// rounded by the symbol's PRICE_ROUNDING rule like its price. The spread
+// is between the served values.
+func sides(buy, sell int64, rule *RoundingRule) Sides {
+	if buy <= 0 || sell <= 0 {
+		return Sides{}
+	}
+	if rule != nil {
+		buy, sell = rule.round(buy), rule.round(sell)
+	}
+	spread := sell - buy
+	return Sides{Buy: &buy, Sell: &sell, Spread: &spread}
+}
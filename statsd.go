@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdSink sends metrics over UDP in plain StatsD or DogStatsD format.
+// Sends are fire-and-forget; a missing agent never slows the service.
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	tags      map[string]string // added to every DogStatsD metric
+}
+
+// newStatsdSink "connects" the UDP socket; nothing is sent until the
+// first metric.
+func newStatsdSink(c Config) (*statsdSink, error) {
+	conn, err := net.Dial("udp", c.StatsDAddr)
+	if err != nil {
+		return nil, fmt.Errorf("STATSD_ADDR %s: %w", c.StatsDAddr, err)
+	}
+	return &statsdSink{
+		conn:      conn,
+		prefix:    c.StatsDPrefix,
+		dogstatsd: c.MetricsBackend == "dogstatsd",
+		tags:      c.StatsDTags,
+	}, nil
+}
+
+func (s *statsdSink) Gauge(name string, value float64, tags map[string]string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (s *statsdSink) Count(name string, delta int64, tags map[string]string) {
+	s.send(name, strconv.FormatInt(delta, 10), "c", tags)
+}
+
+func (s *statsdSink) Timing(name string, d time.Duration, tags map[string]string) {
+	s.send(name, strconv.FormatInt(d.Milliseconds(), 10), "ms", tags)
+}
+
+// send writes one datagram. DogStatsD gets tags as "|#k:v,..."; plain
+// StatsD has no tags, so their values are appended to the metric name in
+// key order (gold.price_rial.gold_18k).
+func (s *statsdSink) send(name, value, kind string, tags map[string]string) {
+	keys := make([]string, 0, len(tags)+len(s.tags))
+	merged := map[string]string{}
+	for k, v := range s.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	if !s.dogstatsd {
+		for _, k := range keys {
+			if _, perMetric := tags[k]; perMetric {
+				b.WriteByte('.')
+				b.WriteString(statsdSanitize(merged[k]))
+			}
+		}
+	}
+	b.WriteString(":" + value + "|" + kind)
+	if s.dogstatsd && len(keys) > 0 {
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k + ":" + statsdSanitize(merged[k]))
+		}
+	}
+	// Errors (e.g. ECONNREFUSED while the agent restarts) are dropped.
+	s.conn.Write([]byte(b.String()))
+}
+
+// statsdSanitize replaces characters that delimit the StatsD line format.
+func statsdSanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SymbolState is a row of the symbols table. Symbols without a row are
+// active; a deactivated symbol is a tombstone: it is no longer polled and
+// its last cached price is served with 410 Gone.
+type SymbolState struct {
+	Symbol        string `json:"symbol"`
+	Active        bool   `json:"active"`
+	DeactivatedAt string `json:"deactivatedAt,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	// Aliases are the legacy IDs /api/gold/{alias} serves this symbol as.
+	Aliases []string `json:"aliases,omitempty"`
+
+	Fetch *SymbolFetchStatus `json:"fetch,omitempty"`
+}
+
+// SymbolFetchStatus is a symbol's outcome in recent poll cycles, kept in
+// symbol_fetch_status. A cycle can cache some symbols and fail others.
+type SymbolFetchStatus struct {
+	OK                  bool   `json:"ok"`
+	LastAttemptAt       string `json:"lastAttemptAt"`
+	LastSuccessAt       string `json:"lastSuccessAt,omitempty"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	ErrorClass          string `json:"errorClass,omitempty"`
+	Error               string `json:"error,omitempty"`
+}
+
+// recordSymbolFetch stores symbol's outcome in the poll cycle at at;
+// err == nil records a success. A dry run stores nothing.
+func recordSymbolFetch(ctx context.Context, symbol string, at time.Time, err error) {
+	if cfg.DryRun {
+		return
+	}
+	ok, class, msg := true, "", ""
+	if err != nil {
+		ok, class, msg = false, errorClass(err), err.Error()
+	}
+	_, dbErr := database.ExecContext(ctx, `
+		INSERT INTO symbol_fetch_status (symbol, ok, last_attempt_at, last_success_at, consecutive_failures, error_class, error)
+		VALUES (?1, ?2, ?3, CASE WHEN ?2 THEN ?3 ELSE '' END, CASE WHEN ?2 THEN 0 ELSE 1 END, ?4, ?5)
+		ON CONFLICT(symbol) DO UPDATE SET
+			ok = excluded.ok,
+			last_attempt_at = excluded.last_attempt_at,
+			last_success_at = CASE WHEN excluded.ok THEN excluded.last_attempt_at ELSE last_success_at END,
+			consecutive_failures = CASE WHEN excluded.ok THEN 0 ELSE consecutive_failures + 1 END,
+			error_class = excluded.error_class,
+			error = excluded.error
+	`, symbol, ok, at.UTC().Format(time.RFC3339), class, msg)
+	if dbErr != nil {
+		log.Printf("[poller] Recording fetch status of %s failed: %v", symbol, dbErr)
+	}
+}
+
+// symbolActive reports whether symbol should be polled and served
+// normally. Lookup errors count as active so a DB hiccup can't silently
+// stop polling.
+func symbolActive(symbol string) bool {
+	var active bool
+	err := database.QueryRow("SELECT active FROM symbols WHERE symbol = ?", symbol).Scan(&active)
+	return err != nil || active
+}
+
+// handleListSymbols serves GET /admin/symbols: every cached, tombstoned
+// or polled symbol, with its state, aliases and latest fetch status.
+func handleListSymbols(w http.ResponseWriter, r *http.Request) {
+	aliases, err := symbolAliases()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rows, err := database.Query(`
+		SELECT p.symbol, COALESCE(s.active, 1), COALESCE(s.deactivated_at, ''), COALESCE(s.reason, ''),
+		       f.ok, f.last_attempt_at, f.last_success_at, f.consecutive_failures, f.error_class, f.error
+		FROM (SELECT symbol FROM gold_prices UNION SELECT symbol FROM symbols UNION SELECT symbol FROM symbol_fetch_status) p
+		LEFT JOIN symbols s ON s.symbol = p.symbol
+		LEFT JOIN symbol_fetch_status f ON f.symbol = p.symbol
+		ORDER BY p.symbol
+	`)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	states := []SymbolState{}
+	for rows.Next() {
+		var s SymbolState
+		var ok sql.NullBool
+		var f SymbolFetchStatus
+		var lastAttempt, lastSuccess, class, msg sql.NullString
+		var fails sql.NullInt64
+		if err := rows.Scan(&s.Symbol, &s.Active, &s.DeactivatedAt, &s.Reason,
+			&ok, &lastAttempt, &lastSuccess, &fails, &class, &msg); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if ok.Valid {
+			f.OK, f.LastAttemptAt, f.LastSuccessAt = ok.Bool, lastAttempt.String, lastSuccess.String
+			f.ConsecutiveFailures, f.ErrorClass, f.Error = int(fails.Int64), class.String, msg.String
+			s.Fetch = &f
+		}
+		s.Aliases = aliases[s.Symbol]
+		states = append(states, s)
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// handleSetSymbol serves PUT /admin/symbols/{symbol} with a body of
+// {"active": false, "reason": "discontinued by provider"}. Reactivating
+// resumes polling on the next tick.
+func handleSetSymbol(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "symbols are read-only on a replica; change them on the primary")
+		return
+	}
+	symbol := r.PathValue("symbol")
+
+	var req struct {
+		Active *bool  `json:"active"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Active == nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"active\": false, \"reason\": \"...\"}")
+		return
+	}
+
+	before := SymbolState{Symbol: symbol, Active: true}
+	err := database.QueryRow("SELECT active, deactivated_at, reason FROM symbols WHERE symbol = ?", symbol).
+		Scan(&before.Active, &before.DeactivatedAt, &before.Reason)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		var n int
+		database.QueryRow("SELECT COUNT(*) FROM gold_prices WHERE symbol = ?", symbol).Scan(&n)
+		if n == 0 {
+			writeError(w, http.StatusNotFound, "unknown symbol "+symbol)
+			return
+		}
+	}
+
+	after := SymbolState{Symbol: symbol, Active: *req.Active}
+	if !after.Active {
+		after.DeactivatedAt = time.Now().UTC().Format(time.RFC3339)
+		after.Reason = req.Reason
+		if !before.Active {
+			// Deactivating again keeps the original tombstone time.
+			after.DeactivatedAt = before.DeactivatedAt
+		}
+	}
+	_, err = database.Exec(`
+		INSERT INTO symbols (symbol, active, deactivated_at, reason) VALUES (?, ?, ?, ?)
+		ON CONFLICT(symbol) DO UPDATE SET
+			active = excluded.active,
+			deactivated_at = excluded.deactivated_at,
+			reason = excluded.reason
+	`, after.Symbol, after.Active, after.DeactivatedAt, after.Reason)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	auditChange(r, before, after)
+	if after.Active {
+		logf(r.Context(), "[admin] Symbol %s reactivated", symbol)
+	} else {
+		logf(r.Context(), "[admin] Symbol %s deactivated: %s", symbol, after.Reason)
+	}
+	writeJSON(w, http.StatusOK, after)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncCandleBatch caps the 1m candles in one /internal/sync response; a
+// standby catching up pages through with the returned cursor.
+const syncCandleBatch = 5000
+
+// SyncPrice is a gold_prices row as shipped to a standby.
+type SyncPrice struct {
+	Symbol          string `json:"symbol"`
+	Name            string `json:"name"`
+	Price           int64  `json:"price"`
+	Buy             int64  `json:"buy"`
+	Sell            int64  `json:"sell"`
+	FetchedAt       string `json:"fetchedAt"`
+	Source          string `json:"source"`
+	FetchDurationMs int64  `json:"fetchDurationMs"`
+	Attempt         int    `json:"attempt"`
+	ManualOverride  bool   `json:"manualOverride"`
+}
+
+// SyncCandle is a 1m candle as shipped to a standby.
+type SyncCandle struct {
+	Symbol string `json:"symbol"`
+	Candle
+}
+
+// SyncClose is a daily_closes row as shipped to a standby.
+type SyncClose struct {
+	Symbol   string `json:"symbol"`
+	Day      string `json:"day"`
+	Close    int64  `json:"close"`
+	ClosedAt string `json:"closedAt"`
+}
+
+// SyncBatch is the GET /internal/sync body: every cached price, and the
+// 1m candles and daily closes written since the cursor. With More set,
+// the standby asks again from the last candle.
+type SyncBatch struct {
+	GeneratedAt string       `json:"generatedAt"`
+	Prices      []SyncPrice  `json:"prices"`
+	Candles     []SyncCandle `json:"candles"`
+	DailyCloses []SyncClose  `json:"dailyCloses"`
+	More        bool         `json:"more"`
+}
+
+// handleSync serves GET /internal/sync?since=<RFC3339> to standbys,
+// authenticated with SYNC_TOKEN. It is 404 while no token is set.
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	if cfg.SyncToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(cfg.SyncToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid or missing sync token")
+		return
+	}
+	qp := paramsOf(r)
+	since := qp.time("since", clock.Now().Add(-time.Duration(cfg.SyncHistoryHours)*time.Hour)).UTC().Format(time.RFC3339)
+	if !qp.valid(w) {
+		return
+	}
+	batch, err := readSyncBatch(r.Context(), since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, batch)
+}
+
+func readSyncBatch(ctx context.Context, since string) (*SyncBatch, error) {
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	batch := &SyncBatch{GeneratedAt: clock.Now().UTC().Format(time.RFC3339), Prices: []SyncPrice{}, Candles: []SyncCandle{}, DailyCloses: []SyncClose{}}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT symbol, name, price_rial, buy_rial, sell_rial, fetched_at, source, fetch_duration_ms, attempt, manual_override
+		FROM gold_prices ORDER BY symbol
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p SyncPrice
+		if err := rows.Scan(&p.Symbol, &p.Name, &p.Price, &p.Buy, &p.Sell, &p.FetchedAt, &p.Source, &p.FetchDurationMs, &p.Attempt, &p.ManualOverride); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		batch.Prices = append(batch.Prices, p)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT symbol, bucket_start, open, high, low, close, samples, source FROM candles
+		WHERE resolution = ? AND bucket_start >= ?
+		ORDER BY bucket_start, symbol
+		LIMIT ?
+	`, res1m, since, syncCandleBatch+1)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		if len(batch.Candles) == syncCandleBatch {
+			batch.More = true
+			break
+		}
+		var c SyncCandle
+		if err := rows.Scan(&c.Symbol, &c.BucketStart, &c.Open, &c.High, &c.Low, &c.Close, &c.Samples, &c.Source); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		batch.Candles = append(batch.Candles, c)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT symbol, day, close_rial, closed_at FROM daily_closes
+		WHERE closed_at >= ? ORDER BY day, symbol
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c SyncClose
+		if err := rows.Scan(&c.Symbol, &c.Day, &c.Close, &c.ClosedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		batch.DailyCloses = append(batch.DailyCloses, c)
+	}
+	rows.Close()
+	return batch, rows.Err()
+}
+
+// standby is the sync state of MODE=standby, read by /health.
+var standby struct {
+	mu           sync.Mutex
+	cursor       string    // since= of the next pull
+	lastSync     time.Time // last successful pull, or startup
+	lastError    string
+	failedOver   bool
+	failedOverAt time.Time
+	failovers    int
+}
+
+// pollsUpstream reports whether this instance fetches from the upstream
+// provider: on a primary unless another pod holds the leader lease, and on
+// a standby only while failed over.
+func pollsUpstream() bool {
+	switch cfg.Mode {
+	case "primary":
+		return leader == nil || leader.isHeld()
+	case "standby":
+		standby.mu.Lock()
+		defer standby.mu.Unlock()
+		return standby.failedOver
+	}
+	return false
+}
+
+var syncClient = &http.Client{Timeout: 30 * time.Second}
+
+// runStandby pulls from SYNC_PRIMARY_URL every SYNC_INTERVAL. Once pulls
+// have failed for SYNC_FAILOVER_AFTER it starts polling the upstream
+// itself, and stops again at the first successful pull.
+func runStandby(ctx context.Context, p *brsProvider, pollInterval time.Duration) {
+	standby.mu.Lock()
+	standby.lastSync = time.Now()
+	standby.cursor = clock.Now().Add(-time.Duration(cfg.SyncHistoryHours) * time.Hour).UTC().Format(time.RFC3339)
+	standby.mu.Unlock()
+
+	var stopPolling context.CancelFunc
+	ticker := time.NewTicker(clock.Real(cfg.SyncInterval))
+	defer ticker.Stop()
+	for {
+		err := pullFromPrimary(ctx)
+		now := time.Now()
+		standby.mu.Lock()
+		switch {
+		case err == nil:
+			standby.lastSync, standby.lastError = now, ""
+			if standby.failedOver {
+				down := now.Sub(standby.failedOverAt).Round(time.Second)
+				standby.failedOver = false
+				stopPolling()
+				log.Printf("[sync] Primary reachable again; stopped local polling after %v", down)
+			}
+		case ctx.Err() == nil:
+			standby.lastError = err.Error()
+			log.Printf("[sync] Pull from primary failed: %v", err)
+			if !standby.failedOver && now.Sub(standby.lastSync) >= cfg.SyncFailoverAfter {
+				standby.failedOver, standby.failedOverAt = true, now
+				standby.failovers++
+				var pollCtx context.Context
+				pollCtx, stopPolling = context.WithCancel(ctx)
+				log.Printf("[sync] No successful pull for %v; failing over to local polling", now.Sub(standby.lastSync).Round(time.Second))
+				go func() {
+					if err := pollOnce(pollCtx, p); err != nil {
+						poller.recordFailure(err)
+					} else {
+						poller.recordSuccess()
+					}
+					runSupervisedPoller(pollCtx, p, pollInterval, cfg.PollerWatchdogMultiple)
+				}()
+			}
+		}
+		failedOver := 0.0
+		if standby.failedOver {
+			failedOver = 1
+		}
+		standby.mu.Unlock()
+		metrics.Gauge("sync.failed_over", failedOver, nil)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if stopPolling != nil {
+				stopPolling()
+			}
+			return
+		}
+	}
+}
+
+// pullFromPrimary applies batches from the primary until it has nothing
+// more, advancing the cursor to the newest candle received. That candle is
+// asked for again next time, since its minute may still have been open.
+func pullFromPrimary(ctx context.Context) error {
+	for range 100 {
+		standby.mu.Lock()
+		cursor := standby.cursor
+		standby.mu.Unlock()
+
+		batch, err := fetchSyncBatch(ctx, cursor)
+		if err != nil {
+			return err
+		}
+		if err := applySyncBatch(ctx, batch); err != nil {
+			return fmt.Errorf("applying batch: %w", err)
+		}
+		next := cursor
+		if n := len(batch.Candles); n > 0 {
+			next = batch.Candles[n-1].BucketStart
+		}
+		standby.mu.Lock()
+		standby.cursor = next
+		standby.mu.Unlock()
+		metrics.Count("sync.candles", int64(len(batch.Candles)), nil)
+		if !batch.More || next == cursor {
+			return nil
+		}
+	}
+	return nil
+}
+
+func fetchSyncBatch(ctx context.Context, since string) (*SyncBatch, error) {
+	u, _ := url.Parse(cfg.SyncPrimaryURL)
+	u = u.JoinPath("/internal/sync")
+	// case=camel keeps a JSON_FIELD_CASE=snake primary from renaming the
+	// fields SyncBatch decodes.
+	u.RawQuery = url.Values{"since": {since}, "case": {"camel"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.SyncToken)
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("primary returned %s", resp.Status)
+	}
+	var batch SyncBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("decoding sync batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// applySyncBatch writes a batch in one transaction, holding pollMu so it
+// never interleaves with a local poll cycle. A cached price is only
+// replaced by one fetched at the same time or later, so prices this
+// standby fetched itself while failed over aren't rolled back.
+func applySyncBatch(ctx context.Context, batch *SyncBatch) error {
+	pollMu.Lock()
+	defer pollMu.Unlock()
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range batch.Prices {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO gold_prices (symbol, name, price_rial, buy_rial, sell_rial, fetched_at, source, fetch_duration_ms, attempt, manual_override)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(symbol) DO UPDATE SET
+				name = excluded.name,
+				price_rial = excluded.price_rial,
+				buy_rial = excluded.buy_rial,
+				sell_rial = excluded.sell_rial,
+				fetched_at = excluded.fetched_at,
+				source = excluded.source,
+				fetch_duration_ms = excluded.fetch_duration_ms,
+				attempt = excluded.attempt,
+				manual_override = excluded.manual_override
+			WHERE excluded.fetched_at >= gold_prices.fetched_at
+		`, p.Symbol, p.Name, p.Price, p.Buy, p.Sell, p.FetchedAt, p.Source, p.FetchDurationMs, p.Attempt, p.ManualOverride)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range batch.Candles {
+		_, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO candles (symbol, resolution, bucket_start, open, high, low, close, samples, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, c.Symbol, res1m, c.BucketStart, c.Open, c.High, c.Low, c.Close, c.Samples, c.Source)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range batch.DailyCloses {
+		if _, err := tx.ExecContext(ctx, upsertCloseSQL, c.Symbol, c.Day, c.Close, c.ClosedAt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	queryCache.invalidateAll()
+	return nil
+}
+
+// checkSync reports a standby's sync with the primary. Failing over is
+// degraded, not unhealthy: prices are still served and kept fresh.
+func checkSync() map[string]any {
+	standby.mu.Lock()
+	defer standby.mu.Unlock()
+	result := map[string]any{
+		"status":     healthOK,
+		"primary":    cfg.SyncPrimaryURL,
+		"lastSync":   standby.lastSync.UTC().Format(time.RFC3339),
+		"failedOver": standby.failedOver,
+		"failovers":  standby.failovers,
+	}
+	if standby.lastError != "" {
+		result["lastError"] = standby.lastError
+	}
+	if standby.failedOver {
+		result["status"] = healthDegraded
+		result["failedOverAt"] = standby.failedOverAt.UTC().Format(time.RFC3339)
+	}
+	return result
+}
+
+// withStandby answers 409 to changes sent to a standby, which would never
+// reach the primary or other regions. Routes that don't write
+// (dryRunWrites) still work.
+func withStandby(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Mode == "standby" && r.Method != http.MethodGet && r.Method != http.MethodHead && !dryRunWrites[r.Method+" "+r.URL.Path] {
+			writeError(w, http.StatusConflict, "this is a standby region; make changes on the primary")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a Telegram post was sent.
+const (
+	telegramReasonChange   = "change"
+	telegramReasonSchedule = "schedule"
+	telegramReasonManual   = "manual"
+)
+
+// telegramPublisher posts price updates to a Telegram channel: when a
+// symbol has moved TELEGRAM_CHANGE_BPS since the last post, and every
+// TELEGRAM_POST_INTERVAL. The poller only wakes it; posting happens on
+// its own goroutine so a slow Bot API never delays a cycle.
+type telegramPublisher struct {
+	apiURL      string
+	token       *secret
+	tokenSource *secretSource
+	chatID      string
+	symbols     []string
+	changeBps   int
+	interval    time.Duration
+	wake        chan struct{}
+	client      *http.Client
+
+	// mu serializes posts, scheduled and manual; last is the price of
+	// each symbol in the last successful post.
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// publisher is nil unless TELEGRAM_CHAT_ID is set.
+var publisher *telegramPublisher
+
+func newTelegramPublisher(c Config) (*telegramPublisher, error) {
+	if c.TelegramChatID == "" {
+		return nil, nil
+	}
+	token, source, err := loadSecret("TELEGRAM_BOT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, errors.New("TELEGRAM_CHAT_ID requires TELEGRAM_BOT_TOKEN (or TELEGRAM_BOT_TOKEN_FILE, ..._VAULT_PATH, ..._AWS_SECRET_ID)")
+	}
+	return &telegramPublisher{
+		apiURL:      strings.TrimSuffix(c.TelegramAPIURL, "/"),
+		token:       token,
+		tokenSource: source,
+		chatID:      c.TelegramChatID,
+		symbols:     c.TelegramSymbols,
+		changeBps:   c.TelegramChangeBps,
+		interval:    c.TelegramPostInterval,
+		wake:        make(chan struct{}, 1),
+		client:      &http.Client{Timeout: 15 * time.Second},
+		last:        map[string]int64{},
+	}, nil
+}
+
+// notify tells the publisher new prices were cached, without blocking.
+func (t *telegramPublisher) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run posts on significant changes and on schedule until ctx is done.
+func (t *telegramPublisher) run(ctx context.Context) {
+	var encoded string
+	err := database.QueryRowContext(ctx, "SELECT prices FROM telegram_posts WHERE error = '' ORDER BY id DESC LIMIT 1").Scan(&encoded)
+	if err == nil {
+		json.Unmarshal([]byte(encoded), &t.last)
+	}
+
+	var tick <-chan time.Time
+	if t.interval > 0 {
+		ticker := time.NewTicker(clock.Real(t.interval))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-t.wake:
+			if t.changeBps > 0 {
+				t.post(ctx, telegramReasonChange)
+			}
+		case <-tick:
+			t.post(ctx, telegramReasonSchedule)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TelegramPost is a row of telegram_posts.
+type TelegramPost struct {
+	ID        int64            `json:"id"`
+	PostedAt  string           `json:"postedAt"`
+	Reason    string           `json:"reason"`
+	Prices    map[string]int64 `json:"prices"`
+	MessageID int64            `json:"messageId,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// post sends the current prices. For reason "change" it only does so when
+// some symbol moved at least changeBps from the last post (or was never
+// posted). Every attempt is stored; nil means nothing was due.
+func (t *telegramPublisher) post(ctx context.Context, reason string) *TelegramPost {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prices, names, err := t.currentPrices(ctx)
+	if err != nil {
+		log.Printf("[telegram] Reading prices failed: %v", err)
+		return nil
+	}
+	if len(prices) == 0 || (reason == telegramReasonChange && !t.significant(prices)) {
+		return nil
+	}
+
+	p := &TelegramPost{PostedAt: clock.Now().UTC().Format(time.RFC3339), Reason: reason, Prices: prices}
+	p.MessageID, err = t.send(ctx, t.format(ctx, prices, names))
+	if err != nil {
+		p.Error = err.Error()
+		metrics.Count("telegram.post", 1, map[string]string{"result": "error"})
+		log.Printf("[telegram] Post (%s) failed: %v", reason, err)
+	} else {
+		t.last = prices
+		metrics.Count("telegram.post", 1, map[string]string{"result": "ok"})
+		log.Printf("[telegram] Posted %s update to %s (message %d)", reason, t.chatID, p.MessageID)
+	}
+	encoded, _ := json.Marshal(prices)
+	res, dbErr := database.ExecContext(ctx, `
+		INSERT INTO telegram_posts (posted_at, reason, prices, message_id, error) VALUES (?, ?, ?, ?, ?)
+	`, p.PostedAt, p.Reason, string(encoded), p.MessageID, p.Error)
+	if dbErr != nil {
+		log.Printf("[telegram] Recording post failed: %v", dbErr)
+	} else {
+		p.ID, _ = res.LastInsertId()
+	}
+	return p
+}
+
+// currentPrices reads the cached price and name of each configured,
+// active symbol.
+func (t *telegramPublisher) currentPrices(ctx context.Context) (map[string]int64, map[string]string, error) {
+	prices, names := map[string]int64{}, map[string]string{}
+	for _, symbol := range t.symbols {
+		var name string
+		var price int64
+		err := database.QueryRowContext(ctx, "SELECT name, price_rial FROM gold_prices WHERE symbol = ?", symbol).Scan(&name, &price)
+		if errors.Is(err, sql.ErrNoRows) || !symbolActive(symbol) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		prices[symbol], names[symbol] = price, name
+	}
+	return prices, names, nil
+}
+
+func (t *telegramPublisher) significant(prices map[string]int64) bool {
+	for symbol, price := range prices {
+		last, ok := t.last[symbol]
+		if !ok || last <= 0 {
+			return true
+		}
+		diff := price - last
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff*10000 >= int64(t.changeBps)*last {
+			return true
+		}
+	}
+	return false
+}
+
+// format renders one HTML message: per symbol, an emoji for the change
+// since the previous daily close, the price, and a sparkline of the last
+// 24 hourly closes.
+func (t *telegramPublisher) format(ctx context.Context, prices map[string]int64, names map[string]string) string {
+	now := clock.Now()
+	var b strings.Builder
+	for _, symbol := range t.symbols {
+		price, ok := prices[symbol]
+		if !ok {
+			continue
+		}
+		emoji, change := "⚪", ""
+		if prev, err := previousClose(ctx, symbol, now); err == nil && prev != nil && prev.Price > 0 {
+			pct := float64(price-prev.Price) * 100 / float64(prev.Price)
+			switch {
+			case price > prev.Price:
+				emoji = "🟢"
+			case price < prev.Price:
+				emoji = "🔴"
+			}
+			change = fmt.Sprintf(" (%+.2f%%)", pct)
+		}
+		fmt.Fprintf(&b, "%s <b>%s</b>\n%s ریال%s\n", emoji, html.EscapeString(names[symbol]), groupDigits(price), change)
+		if candles, err := localCandles(ctx, symbol, res1h, time.UTC, now.Add(-24*time.Hour), now); err == nil && len(candles) > 1 {
+			closes := make([]int64, len(candles))
+			for i, c := range candles {
+				closes[i] = c.Close
+			}
+			b.WriteString(sparkline(closes) + "\n")
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "<i>%s</i>", now.In(cfg.DailyCloseTZ).Format("2006-01-02 15:04"))
+	return b.String()
+}
+
+// sparkline draws values as a row of block characters.
+func sparkline(values []int64) string {
+	blocks := []rune("▁▂▃▄▅▆▇█")
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	out := make([]rune, len(values))
+	for i, v := range values {
+		level := len(blocks) / 2
+		if hi > lo {
+			level = int((v - lo) * int64(len(blocks)-1) / (hi - lo))
+		}
+		out[i] = blocks[level]
+	}
+	return string(out)
+}
+
+// groupDigits formats n with comma thousands separators.
+func groupDigits(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	if neg {
+		return "-" + b.String()
+	}
+	return b.String()
+}
+
+// send calls the Bot API sendMessage method and returns the message ID.
+// Errors never contain the bot token, which is part of the URL.
+func (t *telegramPublisher) send(ctx context.Context, text string) (int64, error) {
+	token := t.token.Get()
+	body, _ := json.Marshal(map[string]any{
+		"chat_id":                  t.chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.apiURL+"/bot"+token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.New(strings.ReplaceAll(err.Error(), token, "REDACTED"))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, errors.New(strings.ReplaceAll(err.Error(), token, "REDACTED"))
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			MessageID int64 `json:"message_id"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("Bot API returned status %d", resp.StatusCode)
+	}
+	if !result.OK {
+		return 0, fmt.Errorf("Bot API returned status %d: %s", resp.StatusCode, result.Description)
+	}
+	return result.Result.MessageID, nil
+}
+
+// handleTelegramPosts serves GET /admin/telegram/posts?limit=20: recent
+// post attempts, newest first.
+func handleTelegramPosts(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	limit := qp.intRange("limit", 20, 1, 1000)
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, posted_at, reason, prices, message_id, error FROM telegram_posts
+		ORDER BY id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	posts := []TelegramPost{}
+	for rows.Next() {
+		var p TelegramPost
+		var encoded string
+		if err := rows.Scan(&p.ID, &p.PostedAt, &p.Reason, &encoded, &p.MessageID, &p.Error); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.Unmarshal([]byte(encoded), &p.Prices)
+		posts = append(posts, p)
+	}
+	writeJSON(w, http.StatusOK, posts)
+}
+
+// handleTelegramPost serves POST /admin/telegram/post: post the current
+// prices now, regardless of change or schedule.
+func handleTelegramPost(w http.ResponseWriter, r *http.Request) {
+	if publisher == nil {
+		writeError(w, http.StatusConflict, "Telegram publishing is off; set TELEGRAM_CHAT_ID and TELEGRAM_BOT_TOKEN on the primary")
+		return
+	}
+	p := publisher.post(r.Context(), telegramReasonManual)
+	if p == nil {
+		writeError(w, http.StatusConflict, "no cached prices to post")
+		return
+	}
+	if p.Error != "" {
+		writeJSON(w, http.StatusBadGateway, p)
+		return
+	}
+	logf(r.Context(), "[admin] Posted prices to Telegram (message %d)", p.MessageID)
+	writeJSON(w, http.StatusCreated, p)
+}
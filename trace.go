@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// traceContext is a W3C Trace Context (traceparent + tracestate) received
+// from a caller. The service doesn't record spans itself; it passes the
+// trace through to logs and to upstream calls made on the caller's behalf.
+type traceContext struct {
+	traceID  string // 32 hex
+	parentID string // 16 hex, the caller's span
+	flags    string // 2 hex
+	state    string // tracestate, forwarded unchanged
+}
+
+type traceKey struct{}
+
+// parseTraceparent accepts version-00 headers ("00-<trace>-<span>-<flags>")
+// and rejects the all-zero IDs the spec marks invalid.
+func parseTraceparent(h string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return traceContext{}, false
+	}
+	t := traceContext{traceID: parts[1], parentID: parts[2], flags: parts[3]}
+	if !isLowerHex(t.traceID, 32) || !isLowerHex(t.parentID, 16) || !isLowerHex(t.flags, 2) ||
+		t.traceID == strings.Repeat("0", 32) || t.parentID == strings.Repeat("0", 16) {
+		return traceContext{}, false
+	}
+	return t, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// withTrace attaches a valid incoming traceparent/tracestate to the
+// request context. Requests without one are left untraced.
+func withTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			t.state = r.Header.Get("tracestate")
+			r = r.WithContext(context.WithValue(r.Context(), traceKey{}, t))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func traceFrom(ctx context.Context) (traceContext, bool) {
+	t, ok := ctx.Value(traceKey{}).(traceContext)
+	return t, ok
+}
+
+// inject sets traceparent/tracestate on an outgoing request, continuing
+// the caller's trace with a fresh span ID for the upstream hop.
+func (t traceContext) inject(req *http.Request) {
+	var span [8]byte
+	rand.Read(span[:])
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", t.traceID, hex.EncodeToString(span[:]), t.flags))
+	if t.state != "" {
+		req.Header.Set("tracestate", t.state)
+	}
+}
+
+// logf logs like log.Printf, appending trace_id and parent_id when ctx
+// carries a caller's trace so log lines can be joined to it.
+func logf(ctx context.Context, format string, args ...any) {
+	if t, ok := traceFrom(ctx); ok {
+		format += " trace_id=%s parent_id=%s"
+		args = append(args, t.traceID, t.parentID)
+	}
+	log.Printf(format, args...)
+}
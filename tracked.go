@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// trackedSymbol maps a cached symbol to the provider item it is read from.
+type trackedSymbol struct {
+	Symbol   string // cache key, e.g. gold_18k
+	Upstream string // provider item symbol, e.g. IR_GOLD_18K
+	URL      string // provider endpoint; empty means the provider's own
+	// Quote is the tracked symbol the provider prices this item in (see
+	// FX_QUOTES); empty means Toman.
+	Quote string
+}
+
+// defaultNames are served for tracked symbols whose provider item has no
+// name; other symbols fall back to the upstream symbol.
+var defaultNames = map[string]string{
+	"gold_18k": "طلای 18 عیار",
+}
+
+// fetchJob is one upstream request of a poll cycle, covering every tracked
+// symbol served by the same endpoint.
+type fetchJob struct {
+	url      string
+	symbols  []trackedSymbol
+	start    time.Time
+	duration time.Duration
+	items    map[string]*BrsApiItem
+	// symbolErrs holds per-symbol problems (by upstream symbol) of a
+	// request that otherwise succeeded; err fails every symbol.
+	symbolErrs map[string]error
+	err        error
+}
+
+// fetchTracked requests every endpoint the symbols need, at most
+// POLL_CONCURRENCY at a time, so adding endpoints doesn't stretch the
+// poll cycle. Each job carries its own result; the caller decides what a
+// failed job means for the cycle.
+func fetchTracked(ctx context.Context, p *brsProvider, symbols []trackedSymbol) []*fetchJob {
+	var jobs []*fetchJob
+	byURL := map[string]*fetchJob{}
+	for _, s := range symbols {
+		endpoint := s.URL
+		if endpoint == "" {
+			endpoint = p.url
+		}
+		j := byURL[endpoint]
+		if j == nil {
+			j = &fetchJob{url: endpoint}
+			byURL[endpoint] = j
+			jobs = append(jobs, j)
+		}
+		j.symbols = append(j.symbols, s)
+	}
+
+	sem := make(chan struct{}, max(cfg.PollConcurrency, 1))
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			want := make([]string, len(j.symbols))
+			for i, s := range j.symbols {
+				want[i] = s.Upstream
+			}
+			j.start = time.Now()
+			j.items, j.symbolErrs, j.err = p.fetchItems(ctx, j.url, want)
+			j.duration = time.Since(j.start)
+		}()
+	}
+	wg.Wait()
+	return jobs
+}
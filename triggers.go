@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// triggerLookback bounds how far back polling triggers look for events.
+// It is within the default 1m candle retention.
+const triggerLookback = 7 * 24 * time.Hour
+
+// triggerMeta is the per-item metadata IFTTT expects; Zapier ignores it
+// and deduplicates on id.
+type triggerMeta struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// CrossingEvent is a 1m close crossing a threshold from the previous one.
+type CrossingEvent struct {
+	ID            string      `json:"id"`
+	Symbol        string      `json:"symbol"`
+	Direction     string      `json:"direction"`
+	Threshold     int64       `json:"threshold"`
+	Price         int64       `json:"price"`
+	PreviousPrice int64       `json:"previousPrice"`
+	At            string      `json:"at"`
+	Meta          triggerMeta `json:"meta"`
+}
+
+// triggerParams reads the parameters shared by the trigger endpoints:
+// symbol (default gold_18k), limit (default 50) and format.
+func triggerParams(qp *queryParams) (symbol string, limit int) {
+	symbol = qp.str("symbol", "gold_18k")
+	if !validSymbol(symbol) {
+		qp.fail("symbol", "symbol must be lower-case letters, digits and underscores")
+	}
+	qp.oneOf("format", "", "ifttt")
+	return symbol, qp.intRange("limit", 50, 1, 500)
+}
+
+// writeTriggerItems answers with a bare array, newest first, as Zapier
+// polling triggers expect, or {"data": [...]} with format=ifttt.
+func writeTriggerItems[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	if items == nil {
+		items = []T{}
+	}
+	if r.URL.Query().Get("format") == "ifttt" {
+		writeJSON(w, http.StatusOK, map[string]any{"data": items})
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handlePriceCrossedTrigger serves GET /api/triggers/price-crossed with
+// above=X or below=X (Rial): each 1m close that crossed X from the
+// previous close, within the last week, newest first. IDs are stable for
+// a symbol, direction and threshold; since=<id> returns only later
+// events.
+func handlePriceCrossedTrigger(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	symbol, limit := triggerParams(qp)
+	direction, raw := "above", qp.q.Get("above")
+	if b := qp.q.Get("below"); b != "" {
+		if raw != "" {
+			qp.fail("below", "give either above or below, not both")
+		}
+		direction, raw = "below", b
+	}
+	threshold, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || threshold <= 0 {
+		qp.fail(direction, "above or below must be a positive price in Rial")
+	}
+	from := clock.Now().Add(-triggerLookback)
+	if since := qp.q.Get("since"); since != "" {
+		unix, err := strconv.ParseInt(since[strings.LastIndex(since, ":")+1:], 10, 64)
+		if err != nil {
+			qp.fail("since", "since must be an event id from this trigger")
+		}
+		from = time.Unix(unix+1, 0)
+	}
+	if !qp.valid(w) {
+		return
+	}
+
+	// Start a bucket early so the first returned candle has a previous
+	// close to compare with.
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT bucket_start, close FROM candles
+		WHERE symbol = ? AND resolution = ? AND bucket_start >= ?
+		ORDER BY bucket_start
+	`, symbol, res1m, from.Add(-time.Minute).UTC().Format(time.RFC3339))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	var events []CrossingEvent
+	var prev int64
+	for rows.Next() {
+		var bucket string
+		var price int64
+		if err := rows.Scan(&bucket, &price); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		at, _ := time.Parse(time.RFC3339, bucket)
+		crossed := prev > 0 && (direction == "above" && prev <= threshold && price > threshold ||
+			direction == "below" && prev >= threshold && price < threshold)
+		if crossed && !at.Before(from) {
+			id := fmt.Sprintf("%s:%s:%d:%d", symbol, direction, threshold, at.Unix())
+			events = append(events, CrossingEvent{
+				ID:            id,
+				Symbol:        symbol,
+				Direction:     direction,
+				Threshold:     threshold,
+				Price:         price,
+				PreviousPrice: prev,
+				At:            bucket,
+				Meta:          triggerMeta{ID: id, Timestamp: at.Unix()},
+			})
+		}
+		prev = price
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Newest first, capped at limit.
+	out := make([]CrossingEvent, 0, min(len(events), limit))
+	for i := len(events) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, events[i])
+	}
+	writeTriggerItems(w, r, out)
+}
+
+// recordTriggerItem is a record event with IFTTT metadata.
+type recordTriggerItem struct {
+	RecordEvent
+	Meta triggerMeta `json:"meta"`
+}
+
+// handleRecordTrigger serves GET /api/triggers/records: new all-time and
+// 52-week highs, newest first, with since=<id> returning only later ones.
+func handleRecordTrigger(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	symbol, limit := triggerParams(qp)
+	var since int64
+	if v := qp.q.Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			qp.fail("since", "since must be an event id")
+		}
+		since = n
+	}
+	if !qp.valid(w) {
+		return
+	}
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT id, symbol, kind, price_rial, at, previous_price_rial, previous_at
+		FROM record_events
+		WHERE symbol = ? AND id > ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, symbol, since, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	var items []recordTriggerItem
+	for rows.Next() {
+		var it recordTriggerItem
+		ev := &it.RecordEvent
+		if err := rows.Scan(&ev.ID, &ev.Symbol, &ev.Kind, &ev.Price, &ev.At, &ev.PreviousPrice, &ev.PreviousAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		at, _ := time.Parse(time.RFC3339, ev.At)
+		it.Meta = triggerMeta{ID: strconv.FormatInt(ev.ID, 10), Timestamp: at.Unix()}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeTriggerItems(w, r, items)
+}
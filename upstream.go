@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultUserAgent mimics a desktop browser; BrsApi.ir rejects obvious bots.
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+
+// Upstream request settings, overridable via UPSTREAM_TIMEOUT and
+// UPSTREAM_USER_AGENT.
+var (
+	upstreamTimeout   = 10 * time.Second
+	upstreamUserAgent = defaultUserAgent
+)
+
+// upstreamProxy picks the proxy for upstream requests. It honors
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY unless UPSTREAM_SOCKS5_PROXY overrides it.
+var upstreamProxy = http.ProxyFromEnvironment
+
+// Record/replay of provider exchanges (UPSTREAM_RECORD_DIR and
+// UPSTREAM_REPLAY_DIR); at most one is set.
+var (
+	upstreamRecord *upstreamRecorder
+	upstreamReplay *replayTransport
+)
+
+// configureUpstream applies the parsed upstream settings: request
+// timeout, user agent and decoding strictness, a SOCKS5 proxy (hostnames
+// are then resolved by the proxy), a custom DNS server, pinned IPs, and
+// recording or replay. DNS settings only change the dial target: the URL
+// host is still used for TLS SNI and certificate verification, and neither
+// applies to hosts reached through a proxy.
+func configureUpstream(c Config) error {
+	upstreamTimeout = c.UpstreamTimeout
+	upstreamUserAgent = c.UpstreamUserAgent
+	upstreamDecodeStrict = c.UpstreamDecode == "strict"
+
+	if c.SOCKS5Proxy != nil {
+		upstreamProxy = http.ProxyURL(c.SOCKS5Proxy)
+		log.Printf("[upstream] Using SOCKS5 proxy %s", c.SOCKS5Proxy.Redacted())
+	}
+	if server := c.DNSServer; server != "" {
+		upstreamDialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		log.Printf("[upstream] Resolving via DNS server %s", server)
+	}
+	for host, ips := range c.PinnedIPs {
+		pinnedIPs[host] = ips
+		log.Printf("[upstream] Pinned %s to %s", host, strings.Join(ips, ", "))
+	}
+
+	var err error
+	if c.UpstreamRecordDir != "" {
+		if upstreamRecord, err = newUpstreamRecorder(c.UpstreamRecordDir); err != nil {
+			return err
+		}
+		log.Printf("[upstream] Recording provider exchanges to %s", c.UpstreamRecordDir)
+	}
+	if c.UpstreamReplayDir != "" {
+		if upstreamReplay, err = loadReplay(c.UpstreamReplayDir); err != nil {
+			return fmt.Errorf("loading UPSTREAM_REPLAY_DIR: %w", err)
+		}
+	}
+	return nil
+}
+
+// newUpstreamClient builds the client for provider calls. HTTP/2 stays
+// off (TLSClientConfig set, ForceAttemptHTTP2 false) and ALPN only offers
+// http/1.1, which BrsApi.ir handles more reliably. In replay mode the
+// client never touches the network.
+func newUpstreamClient() *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               upstreamProxy,
+		DialContext:         upstreamDial,
+		TLSClientConfig:     &tls.Config{NextProtos: []string{"http/1.1"}},
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   false,
+	}
+	switch {
+	case upstreamReplay != nil:
+		transport = upstreamReplay
+	case upstreamRecord != nil:
+		transport = &recordingTransport{next: transport, recorder: upstreamRecord}
+	}
+	return &http.Client{Timeout: upstreamTimeout, Transport: transport}
+}
+
+// upstreamDialer resolves hostnames for upstream connections. Its
+// Resolver is replaced when UPSTREAM_DNS_SERVER is set.
+var upstreamDialer = &net.Dialer{Timeout: 10 * time.Second}
+
+// pinnedIPs maps lower-cased hostnames to the IPs to dial instead of
+// resolving them (UPSTREAM_PIN_IPS).
+var pinnedIPs = map[string][]string{}
+
+// upstreamDial connects to addr, trying pinned IPs in order when the host
+// has any, and otherwise resolving through upstreamDialer.
+func upstreamDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, ok := pinnedIPs[strings.ToLower(host)]
+	if !ok {
+		return upstreamDialer.DialContext(ctx, network, addr)
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := upstreamDialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("all pinned IPs for %s failed: %w", host, lastErr)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// UpstreamStats summarises fetch_log attempts for one provider over a
+// period. Latency percentiles cover successful attempts only, so timeouts
+// show up in the success rate rather than as a latency spike.
+type UpstreamStats struct {
+	Attempts    int            `json:"attempts"`
+	Successes   int            `json:"successes"`
+	SuccessRate *float64       `json:"successRate"`
+	P50Ms       *int64         `json:"p50Ms"`
+	P95Ms       *int64         `json:"p95Ms"`
+	Errors      map[string]int `json:"errors"`
+
+	latencies []int64
+}
+
+func (s *UpstreamStats) add(ok bool, durationMs int64, class string) {
+	s.Attempts++
+	if ok {
+		s.Successes++
+		s.latencies = append(s.latencies, durationMs)
+		return
+	}
+	s.Errors[class]++
+}
+
+func (s *UpstreamStats) finish() {
+	if s.Attempts > 0 {
+		rate := float64(s.Successes) / float64(s.Attempts)
+		s.SuccessRate = &rate
+	}
+	if len(s.latencies) > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		s.P50Ms, s.P95Ms = percentile(s.latencies, 0.50), percentile(s.latencies, 0.95)
+	}
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []int64, p float64) *int64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	v := sorted[max(i, 0)]
+	return &v
+}
+
+// HourlyUpstreamStats is UpstreamStats for one UTC hour.
+type HourlyUpstreamStats struct {
+	Hour string `json:"hour"`
+	*UpstreamStats
+}
+
+// handleUpstreamStats serves GET /admin/upstream/stats?hours=24: per
+// provider, the success rate, p50/p95 latency and error classes over the
+// last ?hours (max 720, the fetch_log retention), overall and per hour.
+func handleUpstreamStats(w http.ResponseWriter, r *http.Request) {
+	qp := paramsOf(r)
+	hours := qp.intRange("hours", 24, 1, 720)
+	if !qp.valid(w) {
+		return
+	}
+	since := clock.Now().UTC().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT provider, started_at, duration_ms, ok, error_class
+		FROM fetch_log
+		WHERE started_at >= ?
+		ORDER BY started_at
+	`, since.Format(time.RFC3339))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	type providerStats struct {
+		total  *UpstreamStats
+		hourly []HourlyUpstreamStats
+	}
+	byProvider := map[string]*providerStats{}
+	for rows.Next() {
+		var provider, startedAt, class string
+		var durationMs int64
+		var ok bool
+		if err := rows.Scan(&provider, &startedAt, &durationMs, &ok, &class); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		t, err := time.Parse(time.RFC3339, startedAt)
+		if err != nil {
+			continue
+		}
+		ps := byProvider[provider]
+		if ps == nil {
+			ps = &providerStats{total: &UpstreamStats{Errors: map[string]int{}}}
+			byProvider[provider] = ps
+		}
+		ps.total.add(ok, durationMs, class)
+		hour := t.Truncate(time.Hour).Format(time.RFC3339)
+		if n := len(ps.hourly); n == 0 || ps.hourly[n-1].Hour != hour {
+			ps.hourly = append(ps.hourly, HourlyUpstreamStats{Hour: hour, UpstreamStats: &UpstreamStats{Errors: map[string]int{}}})
+		}
+		ps.hourly[len(ps.hourly)-1].add(ok, durationMs, class)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	providers := map[string]any{}
+	for name, ps := range byProvider {
+		ps.total.finish()
+		for _, h := range ps.hourly {
+			h.finish()
+		}
+		providers[name] = map[string]any{
+			"total":  ps.total,
+			"hourly": ps.hourly,
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"since":     since.Format(time.RFC3339),
+		"providers": providers,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxSanePriceToman bounds upstream prices; anything above is a unit or
+// parsing change, not a market move.
+const maxSanePriceToman = 1e10
+
+// validateBrsResponse checks the decoded payload against the shape the
+// poller relies on: at least one item, or the whole response fails.
+// Problems with individual wanted symbols (missing, no price, a price
+// outside a plausible range, or marked malformed by tolerant decoding)
+// are returned per upstream symbol, so the others can still be used.
+// Unwanted bad items, including items without a symbol, are skipped.
+func validateBrsResponse(resp *BrsApiResponse, want []string) (map[string]error, error) {
+	items := resp.items()
+	if len(items) == 0 {
+		return nil, errors.New("response has no items")
+	}
+	prices := map[string]float64{}
+	malformed := map[string]string{}
+	for i, item := range items {
+		if item.Symbol == "" {
+			// Keyed by position: it can't match a wanted symbol.
+			malformed[fmt.Sprintf("item %d", i)] = "no symbol"
+			continue
+		}
+		if item.malformed != "" {
+			malformed[item.Symbol] = item.malformed
+			continue
+		}
+		if item.Price < 0 || item.Price > maxSanePriceToman {
+			malformed[item.Symbol] = fmt.Sprintf("price %v out of range", item.Price)
+			continue
+		}
+		prices[item.Symbol] = item.Price
+	}
+	symbolErrs := map[string]error{}
+	for _, symbol := range want {
+		price, ok := prices[symbol]
+		switch {
+		case !ok && malformed[symbol] != "":
+			symbolErrs[symbol] = fmt.Errorf("%s: %s", symbol, malformed[symbol])
+		case !ok:
+			symbolErrs[symbol] = fmt.Errorf("%s not found in API response", symbol)
+		case price == 0:
+			symbolErrs[symbol] = fmt.Errorf("%s has no price", symbol)
+		}
+	}
+	return symbolErrs, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// scheduled records that runPoller finished a cycle and plans the next
+// fetch after wait. The watchdog measures overdue cycles against it.
+func (p *pollerStatus) scheduled(wait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextCycle = clock.Now().Add(wait)
+}
+
+// overdue returns how far the poller is past its planned fetch plus grace,
+// or zero when it is on schedule.
+func (p *pollerStatus) overdue(grace time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nextCycle.IsZero() {
+		return 0
+	}
+	return max(clockSince(p.nextCycle)-grace, 0)
+}
+
+// runSupervisedPoller runs runPoller under a watchdog. When a cycle hasn't
+// finished within multiple×interval of its planned start (a hung upstream
+// call, or pollMu held elsewhere) the loop's context is cancelled, which
+// aborts its in-flight fetch, and a fresh loop is started. multiple == 0
+// runs the poller unsupervised.
+func runSupervisedPoller(ctx context.Context, p *brsProvider, interval time.Duration, multiple int) {
+	if multiple == 0 {
+		runPoller(ctx, p, interval)
+		return
+	}
+	grace := time.Duration(multiple) * interval
+	for {
+		loopCtx, cancelLoop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runPoller(loopCtx, p, interval)
+		}()
+		late := watchPoller(ctx, done, interval, grace)
+		cancelLoop()
+		if late == 0 {
+			return
+		}
+		poller.mu.Lock()
+		poller.watchdogRestarts++
+		restarts := poller.watchdogRestarts
+		poller.mu.Unlock()
+		metrics.Count("poller.watchdog_restart", 1, nil)
+		log.Printf("[watchdog] Poller cycle %v behind schedule (limit %v); restarting fetch loop (restart #%d)",
+			(late + grace).Round(time.Second), grace, restarts)
+	}
+}
+
+// watchPoller checks the poller every interval and returns how late it is
+// once overdue, or zero when ctx is cancelled or the loop exits.
+func watchPoller(ctx context.Context, done <-chan struct{}, interval, grace time.Duration) time.Duration {
+	ticker := time.NewTicker(clock.Real(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if late := poller.overdue(grace); late > 0 {
+				return late
+			}
+		case <-done:
+			return 0
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxWatchlistSymbols caps one watchlist, and maxWatchlistsPerKey how many
+// one API key may keep.
+const (
+	maxWatchlistSymbols = 100
+	maxWatchlistsPerKey = 100
+)
+
+// Watchlist is a named set of symbols owned by one API key.
+type Watchlist struct {
+	ID        string   `json:"id"`
+	Symbols   []string `json:"symbols"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+// keyOwner identifies the caller's watchlists or snapshots (what) by a
+// hash of its X-API-Key, so the keys themselves are never stored. Only
+// active keys own anything, whatever API_KEY_MODE is, so made-up keys
+// can't store rows; other callers get a 401 and false.
+func keyOwner(w http.ResponseWriter, r *http.Request, what string) (string, bool) {
+	if requestAPIKey(r) == nil {
+		writeError(w, http.StatusUnauthorized, what+" require a valid X-API-Key header")
+		return "", false
+	}
+	return hashAPIKey(r.Header.Get("X-API-Key")), true
+}
+
+// validWatchlistID accepts 1-64 characters of [a-z0-9_-].
+func validWatchlistID(id string) bool {
+	return len(id) <= 64 && validSymbol(strings.ReplaceAll(id, "-", "_"))
+}
+
+// loadWatchlist returns the caller's watchlist id, writing the error
+// response (401, 404, 500) and returning nil when there is none.
+func loadWatchlist(w http.ResponseWriter, r *http.Request) *Watchlist {
+	owner, ok := keyOwner(w, r, "watchlists")
+	if !ok {
+		return nil
+	}
+	wl := Watchlist{ID: r.PathValue("id")}
+	var symbols string
+	err := database.QueryRowContext(r.Context(), "SELECT symbols, updated_at FROM watchlists WHERE owner = ? AND id = ?", owner, wl.ID).
+		Scan(&symbols, &wl.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "no watchlist "+wl.ID)
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	json.Unmarshal([]byte(symbols), &wl.Symbols)
+	return &wl
+}
+
+// handlePutWatchlist serves PUT /api/watchlists/{id} with a body of
+// {"symbols": ["gold_18k", "usd"]}, creating or replacing the caller's
+// watchlist. Every symbol must have a cached price.
+func handlePutWatchlist(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "watchlists are read-only on a replica; change them on the primary")
+		return
+	}
+	owner, ok := keyOwner(w, r, "watchlists")
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	if !validWatchlistID(id) {
+		writeError(w, http.StatusBadRequest, "watchlist id must be 1-64 characters of a-z, 0-9, _ and -")
+		return
+	}
+	var req struct {
+		Symbols []string `json:"symbols"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || len(req.Symbols) == 0 {
+		writeError(w, http.StatusBadRequest, "body must be JSON like {\"symbols\": [\"gold_18k\"]}")
+		return
+	}
+	if len(req.Symbols) > maxWatchlistSymbols {
+		writeError(w, http.StatusBadRequest, "a watchlist holds at most 100 symbols")
+		return
+	}
+	seen := map[string]bool{}
+	symbols := []string{}
+	for _, s := range req.Symbols {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		var n int
+		database.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM gold_prices WHERE symbol = ?", s).Scan(&n)
+		if n == 0 {
+			writeError(w, http.StatusBadRequest, "unknown symbol "+s)
+			return
+		}
+		symbols = append(symbols, s)
+	}
+
+	var others int
+	err := database.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM watchlists WHERE owner = ? AND id != ?", owner, id).Scan(&others)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if others >= maxWatchlistsPerKey {
+		writeError(w, http.StatusConflict, fmt.Sprintf("an API key may keep at most %d watchlists; delete one first", maxWatchlistsPerKey))
+		return
+	}
+
+	wl := Watchlist{ID: id, Symbols: symbols, UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
+	encoded, _ := json.Marshal(symbols)
+	_, err = database.ExecContext(r.Context(), `
+		INSERT INTO watchlists (owner, id, symbols, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(owner, id) DO UPDATE SET
+			symbols = excluded.symbols,
+			updated_at = excluded.updated_at
+	`, owner, id, string(encoded), wl.UpdatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, wl)
+}
+
+// handleGetWatchlist serves GET /api/watchlists/{id}.
+func handleGetWatchlist(w http.ResponseWriter, r *http.Request) {
+	if wl := loadWatchlist(w, r); wl != nil {
+		writeJSON(w, http.StatusOK, wl)
+	}
+}
+
+// handleDeleteWatchlist serves DELETE /api/watchlists/{id}.
+func handleDeleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	if cfg.Mode == "replica" {
+		writeError(w, http.StatusConflict, "watchlists are read-only on a replica; change them on the primary")
+		return
+	}
+	owner, ok := keyOwner(w, r, "watchlists")
+	if !ok {
+		return
+	}
+	res, err := database.ExecContext(r.Context(), "DELETE FROM watchlists WHERE owner = ? AND id = ?", owner, r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "no watchlist "+r.PathValue("id"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WatchlistPrice is one symbol's cached price in a batch response.
+type WatchlistPrice struct {
+	Symbol   string        `json:"symbol"`
+	Name     string        `json:"name"`
+	Price    int64         `json:"price"`
+	PriceRaw *int64        `json:"priceRaw,omitempty"`
+	Rounding *RoundingRule `json:"rounding,omitempty"`
+	Sides
+	FetchedAt string `json:"fetchedAt"`
+	Stale     bool   `json:"stale"`
+	Active    bool   `json:"active"`
+}
+
+// handleWatchlistPrices serves GET /api/watchlists/{id}/prices: the cached
+// price of every symbol in the watchlist, in its order, read in one query.
+// Symbols that lost their cached price since are listed in missing.
+func handleWatchlistPrices(w http.ResponseWriter, r *http.Request) {
+	wl := loadWatchlist(w, r)
+	if wl == nil {
+		return
+	}
+	encoded, _ := json.Marshal(wl.Symbols)
+	rows, err := database.QueryContext(r.Context(), `
+		SELECT p.symbol, p.name, p.price_rial, p.buy_rial, p.sell_rial, p.fetched_at, COALESCE(s.active, 1)
+		FROM gold_prices p
+		LEFT JOIN symbols s ON s.symbol = p.symbol
+		WHERE p.symbol IN (SELECT value FROM json_each(?))
+	`, string(encoded))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	found := map[string]WatchlistPrice{}
+	var oldest time.Time
+	for rows.Next() {
+		var p WatchlistPrice
+		var buy, sell int64
+		if err := rows.Scan(&p.Symbol, &p.Name, &p.Price, &buy, &sell, &p.FetchedAt, &p.Active); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		fetchedAt, _ := time.Parse(time.RFC3339, p.FetchedAt)
+		p.Stale = clockSince(fetchedAt) > staleThreshold
+		if oldest.IsZero() || fetchedAt.Before(oldest) {
+			oldest = fetchedAt
+		}
+		p.PriceRaw, p.Rounding = applyRounding(p.Symbol, &p.Price)
+		p.Sides = sides(buy, sell, p.Rounding)
+		found[p.Symbol] = p
+	}
+	prices, missing := []WatchlistPrice{}, []string{}
+	for _, s := range wl.Symbols {
+		if p, ok := found[s]; ok {
+			prices = append(prices, p)
+		} else {
+			missing = append(missing, s)
+		}
+	}
+	if !oldest.IsZero() {
+		setDataAge(w, oldest)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":      wl.ID,
+		"prices":  prices,
+		"missing": missing,
+	})
+}